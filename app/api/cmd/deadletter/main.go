@@ -0,0 +1,119 @@
+// Command deadletter replays the dead letters of a topic created in a time
+// range back to the topic, e.g.
+//
+//	deadletter --topic=do-task --from=2024-01-02T15:04:05Z --to=1704208000
+package main
+
+import (
+	"ascale/app/api/conf"
+	"ascale/app/api/model"
+	"ascale/app/api/service"
+	"ascale/pkg/def"
+	ecode "ascale/pkg/ecode/tip"
+	"ascale/pkg/gid"
+	"ascale/pkg/log"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+var (
+	topic  string
+	from   string
+	to     string
+	dryRun bool
+)
+
+func init() {
+	flag.StringVar(&topic, "topic", "", "source topic of the dead letters, as named in the config e.g. do-task")
+	flag.StringVar(&from, "from", "", "replay dead letters created since, unix seconds or RFC3339")
+	flag.StringVar(&to, "to", "", "replay dead letters created until, unix seconds or RFC3339")
+	flag.BoolVar(&dryRun, "dry-run", false, "list the dead letters without replaying them")
+}
+
+func main() {
+	flag.Parse()
+	if err := conf.Init(); err != nil {
+		log.Fatalf("conf.Init() error(%v)", err)
+	}
+	if err := gid.Init(); err != nil {
+		log.Fatalf("gid.Init() error(%v)", err)
+	}
+	ecode.Init()
+	log.Init(conf.Conf.Log)
+
+	err := run(context.Background())
+	log.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "deadletter: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run lists or replays the dead letters, the service is closed before it
+// returns.
+func run(c context.Context) (err error) {
+	arg := &model.ArgReplayDeadLetter{}
+	if topic != "" {
+		arg.Topic = def.TopicName(topic)
+	}
+	if arg.From, err = parseTime(from); err != nil {
+		return fmt.Errorf("invalid --from(%s): %w", from, err)
+	}
+	if arg.To, err = parseTime(to); err != nil {
+		return fmt.Errorf("invalid --to(%s): %w", to, err)
+	}
+	if err = arg.Validate(); err != nil {
+		return
+	}
+
+	var svc *service.Service
+	if svc, err = service.NewTool(conf.Conf); err != nil {
+		return
+	}
+	defer svc.Close(c)
+
+	if dryRun {
+		list := &model.ArgDeadLetterList{Topic: arg.Topic, From: arg.From, To: arg.To, Limit: 100}
+		for {
+			var page *model.DeadLetterPage
+			if page, err = svc.ListDeadLetters(c, list); err != nil {
+				return
+			}
+			for _, v := range page.Items {
+				fmt.Printf("%s\t%s\tattempt=%d\treplayed_at=%d\terror=%s\n",
+					v.ID, time.Unix(v.CreatedAt, 0).Format(time.RFC3339), v.Attempt, v.ReplayedAt, v.Error)
+			}
+			if page.Cursor == "" {
+				return
+			}
+			list.Cursor = page.Cursor
+		}
+	}
+
+	var ret *model.ReplayResult
+	if ret, err = svc.ReplayDeadLetters(c, arg); err != nil {
+		return
+	}
+	fmt.Printf("replayed(%d) skipped(%d) failed(%d) %v\n", ret.Replayed, ret.Skipped, len(ret.Failed), ret.Failed)
+	return
+}
+
+// parseTime parses unix seconds or a RFC3339 time, empty is 0.
+func parseTime(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return v, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Unix(), nil
+}
@@ -2,10 +2,15 @@ package conf
 
 import (
 	"ascale/pkg/cache/redis"
+	"ascale/pkg/cron"
 	"ascale/pkg/database/sqalx"
+	"ascale/pkg/keda"
 	"ascale/pkg/log"
+	"ascale/pkg/mq"
+	mqredis "ascale/pkg/mq/redis"
 	"ascale/pkg/net/http/vin"
 	"ascale/pkg/tracing"
+	"ascale/pkg/xtime"
 
 	"github.com/BurntSushi/toml"
 	flag "github.com/spf13/pflag"
@@ -23,6 +28,82 @@ type Config struct {
 	Tracer *tracing.Config
 	DB     *sqalx.Config
 	Redis  *redis.Config
+	// Redlock nodes of the distributed locks, independent redis masters.
+	// Locks are taken on the Redis pool when empty.
+	Redlock []*redis.Config
+	MQ      *MQ
+	Cron    *Cron
+	// Scaler is the KEDA external scaler served by the workers.
+	Scaler *keda.Config
+}
+
+// MQ message queue config.
+type MQ struct {
+	// Driver selects the broker: pubsub (default), redis or memory.
+	Driver string
+	// Redis is the redis streams driver config, it shares the Redis pool.
+	Redis *mqredis.Config
+	// Batch is the config of batch publishing, e.g. load test jobs.
+	Batch *mq.BatchConfig
+	// DrainTimeout is how long Close waits for the messages in flight, the
+	// rest are nacked. It must fit in the termination grace period of the
+	// pod, default 20s.
+	DrainTimeout xtime.Duration
+	// Concurrency adapts the tasks handled at once by a worker to their
+	// handling time and its cpu usage, tasks are handled one at a time
+	// when nil.
+	Concurrency *mq.AdaptiveConfig
+	// Supervisor restarts failing subscriptions with backoff.
+	Supervisor *mq.SupervisorConfig
+	// Topics and Subscriptions are provisioned at startup, they are named
+	// without the deploy env, e.g. do-task is uat-do-task. The settings of
+	// subscriptions which drifted from their declaration are updated when
+	// they can be changed, the others, e.g. the filter, are reported.
+	Topics        []string
+	Subscriptions []*Subscription
+}
+
+// Subscription declares a subscription, see mq.SubscriptionConfig.
+type Subscription struct {
+	Topic string
+	// Name default mq.SubscriptionName(topic, "ascale").
+	Name        string
+	AckDeadline xtime.Duration
+	Retention   xtime.Duration
+	// DeadLetterTopic receives the messages failing MaxDeliveryAttempts
+	// times, they are redelivered forever when empty. Pubsub accepts 5 to
+	// 100 attempts.
+	DeadLetterTopic     string
+	MaxDeliveryAttempts int
+	Filter              string
+	RetryPolicy         *RetryPolicy
+	// MaxOutstandingMessages and Ordered are how a worker receives it.
+	MaxOutstandingMessages int
+	Ordered                bool
+}
+
+// RetryPolicy is the backoff of the broker between deliveries.
+type RetryPolicy struct {
+	MinimumBackoff xtime.Duration
+	MaximumBackoff xtime.Duration
+}
+
+// Cron in-process scheduler config.
+type Cron struct {
+	Enabled   bool
+	Scheduler *cron.Config
+	Jobs      []*CronJob
+}
+
+// CronJob schedules a registered trigger job.
+type CronJob struct {
+	// Job is the name the job is registered with.
+	Job string
+	// Spec is a standard cron expression.
+	Spec    string
+	CatchUp cron.CatchUp
+	// Params of the job, e.g. the load profile of LoadProfile.
+	Params map[string]interface{}
 }
 
 type DC struct {
@@ -14,6 +14,7 @@ type Dao struct {
 	db            sqalx.Node
 	c             *conf.Config
 	redis         *redis.Pool
+	redlock       []*redis.Pool
 	redisExpire   int32
 	valcodeExpire int32
 }
@@ -26,6 +27,9 @@ func New(c *conf.Config) (dao *Dao) {
 		redisExpire:   int32(5 * 60),
 		valcodeExpire: int32(2 * 60),
 	}
+	for _, rc := range c.Redlock {
+		dao.redlock = append(dao.redlock, redis.NewPool(rc))
+	}
 
 	return
 }
@@ -38,6 +42,11 @@ func (d *Dao) Redis() *redis.Pool {
 	return d.redis
 }
 
+// Redlock returns the pools of the redlock nodes, nil when not configured.
+func (d *Dao) Redlock() []*redis.Pool {
+	return d.redlock
+}
+
 // Ping check db and mc health.
 func (d *Dao) Ping(c context.Context) (err error) {
 	// if err = d.db.Ping(c); err != nil {
@@ -60,6 +69,10 @@ func (d *Dao) Close(ctx context.Context) {
 	if d.redis != nil {
 		d.redis.Close()
 	}
+
+	for _, p := range d.redlock {
+		p.Close()
+	}
 }
 
 // PromError prometheus error count.
@@ -0,0 +1,198 @@
+package dao
+
+import (
+	"ascale/app/api/model"
+	"ascale/pkg/cache/redis"
+	"ascale/pkg/def"
+	"ascale/pkg/log"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// _deadLetterExpire is how long dead letters are kept.
+const _deadLetterExpire = 14 * 24 * time.Hour
+
+// AddDeadLetter stores a dead letter and indexes it by time, globally and
+// per source topic.
+func (p *Dao) AddDeadLetter(c context.Context, item *model.DeadLetter) (err error) {
+	var data []byte
+	if data, err = jsoniter.Marshal(item); err != nil {
+		log.For(c).Errorf("dao.AddDeadLetter() error(%+v)", err)
+		return
+	}
+
+	var conn redis.Conn
+	if conn, err = p.redis.GetContext(c); err != nil {
+		log.For(c).Errorf("dao.AddDeadLetter() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	expired := time.Now().Add(-_deadLetterExpire).Unix()
+	indexes := []string{def.DeadLetterIndexAllKey, def.DeadLetterIndexKey(item.Topic)}
+	if err = conn.Send("SET", def.DeadLetterKey(item.ID), data, "EX", int64(_deadLetterExpire/time.Second)); err != nil {
+		log.For(c).Errorf("dao.AddDeadLetter() SET error(%+v)", err)
+		return
+	}
+	for _, key := range indexes {
+		if err = conn.Send("ZADD", key, item.CreatedAt, item.ID); err != nil {
+			log.For(c).Errorf("dao.AddDeadLetter() ZADD error(%+v)", err)
+			return
+		}
+		if err = conn.Send("ZREMRANGEBYSCORE", key, "-inf", expired); err != nil {
+			log.For(c).Errorf("dao.AddDeadLetter() ZREMRANGEBYSCORE error(%+v)", err)
+			return
+		}
+	}
+	if err = conn.Flush(); err != nil {
+		log.For(c).Errorf("dao.AddDeadLetter() Flush error(%+v)", err)
+		return
+	}
+	for i := 0; i < 1+2*len(indexes); i++ {
+		if _, err = conn.Receive(); err != nil {
+			log.For(c).Errorf("dao.AddDeadLetter() Receive error(%+v)", err)
+			return
+		}
+	}
+	return
+}
+
+// UpdateDeadLetter overwrites a stored dead letter, keeping its expiry.
+func (p *Dao) UpdateDeadLetter(c context.Context, item *model.DeadLetter) (err error) {
+	var data []byte
+	if data, err = jsoniter.Marshal(item); err != nil {
+		log.For(c).Errorf("dao.UpdateDeadLetter() error(%+v)", err)
+		return
+	}
+
+	var conn redis.Conn
+	if conn, err = p.redis.GetContext(c); err != nil {
+		log.For(c).Errorf("dao.UpdateDeadLetter() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err = conn.Do("SET", def.DeadLetterKey(item.ID), data, "XX", "KEEPTTL"); err != nil {
+		log.For(c).Errorf("dao.UpdateDeadLetter() SET(%s) error(%+v)", item.ID, err)
+	}
+	return
+}
+
+// DeadLetters returns the stored dead letters of ids, missing ones are skipped.
+func (p *Dao) DeadLetters(c context.Context, ids []string) (items []*model.DeadLetter, err error) {
+	items = make([]*model.DeadLetter, 0, len(ids))
+	if len(ids) == 0 {
+		return
+	}
+
+	var conn redis.Conn
+	if conn, err = p.redis.GetContext(c); err != nil {
+		log.For(c).Errorf("dao.DeadLetters() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	args := redis.Args{}
+	for _, id := range ids {
+		args = args.Add(def.DeadLetterKey(id))
+	}
+	var values [][]byte
+	if values, err = redis.ByteSlices(conn.Do("MGET", args...)); err != nil {
+		log.For(c).Errorf("dao.DeadLetters() MGET error(%+v)", err)
+		return
+	}
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		item := new(model.DeadLetter)
+		if err = jsoniter.Unmarshal(v, item); err != nil {
+			log.For(c).Errorf("dao.DeadLetters() Unmarshal error(%+v)", err)
+			return
+		}
+		items = append(items, item)
+	}
+	return
+}
+
+// DeadLetterIDs returns a page of the ids of dead letters created in [from,
+// to], newest first, and the cursor of the next page. An empty topic lists
+// all topics, to 0 means no upper bound and an empty cursor the first page.
+// The next cursor is empty once a page is empty, dead letters added while
+// paging do not shift the pages.
+func (p *Dao) DeadLetterIDs(c context.Context, topic string, from, to int64, cursor string, limit int) (ids []string, next string, err error) {
+	key := def.DeadLetterIndexAllKey
+	if topic != "" {
+		key = def.DeadLetterIndexKey(topic)
+	}
+	var max interface{} = "+inf"
+	if to > 0 {
+		max = to
+	}
+	var (
+		score  int64
+		lastID string
+	)
+	if cursor != "" {
+		if score, lastID, err = parseDeadLetterCursor(cursor); err != nil {
+			log.For(c).Errorf("dao.DeadLetterIDs() cursor(%s) error(%+v)", cursor, err)
+			return
+		}
+		max = fmt.Sprintf("(%d", score)
+	}
+
+	var conn redis.Conn
+	if conn, err = p.redis.GetContext(c); err != nil {
+		log.For(c).Errorf("dao.DeadLetterIDs() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	ids = make([]string, 0, limit)
+	if cursor != "" {
+		// members of the same score are ordered by id, newest first too.
+		var same []string
+		if same, err = redis.Strings(conn.Do("ZREVRANGEBYSCORE", key, score, score)); err != nil {
+			log.For(c).Errorf("dao.DeadLetterIDs() ZREVRANGEBYSCORE(%s) error(%+v)", key, err)
+			return
+		}
+		for _, id := range same {
+			if id < lastID && len(ids) < limit {
+				ids = append(ids, id)
+			}
+		}
+	}
+	if len(ids) < limit {
+		var values []string
+		if values, err = redis.Strings(conn.Do("ZREVRANGEBYSCORE", key, max, from, "WITHSCORES", "LIMIT", 0, limit-len(ids))); err != nil {
+			log.For(c).Errorf("dao.DeadLetterIDs() ZREVRANGEBYSCORE(%s) error(%+v)", key, err)
+			return
+		}
+		for i := 0; i+1 < len(values); i += 2 {
+			ids = append(ids, values[i])
+			score, _ = strconv.ParseInt(values[i+1], 10, 64)
+		}
+	}
+	if len(ids) > 0 {
+		next = fmt.Sprintf("%d:%s", score, ids[len(ids)-1])
+	}
+	return
+}
+
+// parseDeadLetterCursor parses a cursor of DeadLetterIDs.
+func parseDeadLetterCursor(cursor string) (score int64, id string, err error) {
+	i := strings.IndexByte(cursor, ':')
+	if i < 0 {
+		err = fmt.Errorf("invalid dead letter cursor(%s)", cursor)
+		return
+	}
+	if score, err = strconv.ParseInt(cursor[:i], 10, 64); err != nil {
+		return
+	}
+	return score, cursor[i+1:], nil
+}
@@ -0,0 +1,305 @@
+package dao
+
+import (
+	"ascale/app/api/model"
+	"ascale/pkg/cache/redis"
+	"ascale/pkg/def"
+	"ascale/pkg/log"
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// _experimentExpire is how long experiments and their series are kept.
+const _experimentExpire = 30 * 24 * time.Hour
+
+// luaExperimentSamples adds the samples of replica ARGV[1] to the series
+// KEYS[1], five args a second: second, published, consumed, latency sum and
+// latency max. Fields are "<second>:<metric>", the replica is recorded as
+// "<second>:w:<replica>" and the totals as "total:<metric>".
+var luaExperimentSamples = redis.NewScript(1, `
+local key = KEYS[1]
+for i = 3, #ARGV, 5 do
+	local sec = ARGV[i]
+	local p, c, ls, lm = tonumber(ARGV[i+1]), tonumber(ARGV[i+2]), tonumber(ARGV[i+3]), tonumber(ARGV[i+4])
+	redis.call("hset", key, sec .. ":w:" .. ARGV[1], 1)
+	if p ~= 0 then
+		redis.call("hincrby", key, sec .. ":p", p)
+		redis.call("hincrby", key, "total:p", p)
+	end
+	if c ~= 0 then
+		redis.call("hincrby", key, sec .. ":c", c)
+		redis.call("hincrby", key, sec .. ":ls", ls)
+		redis.call("hincrby", key, "total:c", c)
+	end
+	if lm > tonumber(redis.call("hget", key, sec .. ":lm") or "0") then
+		redis.call("hset", key, sec .. ":lm", lm)
+	end
+end
+redis.call("expire", key, ARGV[2])
+return 1`)
+
+// AddExperiment stores an experiment and indexes it by start time.
+func (p *Dao) AddExperiment(c context.Context, item *model.Experiment) (err error) {
+	var data []byte
+	if data, err = jsoniter.Marshal(item); err != nil {
+		log.For(c).Errorf("dao.AddExperiment() error(%+v)", err)
+		return
+	}
+
+	var conn redis.Conn
+	if conn, err = p.redis.GetContext(c); err != nil {
+		log.For(c).Errorf("dao.AddExperiment() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	expired := time.Now().Add(-_experimentExpire).UnixMilli()
+	if err = conn.Send("SET", def.ExperimentKey(item.ID), data, "EX", int64(_experimentExpire/time.Second)); err != nil {
+		log.For(c).Errorf("dao.AddExperiment() SET error(%+v)", err)
+		return
+	}
+	if err = conn.Send("ZADD", def.ExperimentIndexKey, item.StartedAt, item.ID); err != nil {
+		log.For(c).Errorf("dao.AddExperiment() ZADD error(%+v)", err)
+		return
+	}
+	if err = conn.Send("ZREMRANGEBYSCORE", def.ExperimentIndexKey, "-inf", expired); err != nil {
+		log.For(c).Errorf("dao.AddExperiment() ZREMRANGEBYSCORE error(%+v)", err)
+		return
+	}
+	if err = conn.Flush(); err != nil {
+		log.For(c).Errorf("dao.AddExperiment() Flush error(%+v)", err)
+		return
+	}
+	for i := 0; i < 3; i++ {
+		if _, err = conn.Receive(); err != nil {
+			log.For(c).Errorf("dao.AddExperiment() Receive error(%+v)", err)
+			return
+		}
+	}
+	return
+}
+
+// UpdateExperiment overwrites a stored experiment, keeping its expiry.
+func (p *Dao) UpdateExperiment(c context.Context, item *model.Experiment) (err error) {
+	var data []byte
+	if data, err = jsoniter.Marshal(item); err != nil {
+		log.For(c).Errorf("dao.UpdateExperiment() error(%+v)", err)
+		return
+	}
+
+	var conn redis.Conn
+	if conn, err = p.redis.GetContext(c); err != nil {
+		log.For(c).Errorf("dao.UpdateExperiment() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err = conn.Do("SET", def.ExperimentKey(item.ID), data, "XX", "KEEPTTL"); err != nil {
+		log.For(c).Errorf("dao.UpdateExperiment() SET(%s) error(%+v)", item.ID, err)
+	}
+	return
+}
+
+// Experiments returns the stored experiments of ids, missing ones are
+// skipped.
+func (p *Dao) Experiments(c context.Context, ids []string) (items []*model.Experiment, err error) {
+	items = make([]*model.Experiment, 0, len(ids))
+	if len(ids) == 0 {
+		return
+	}
+
+	var conn redis.Conn
+	if conn, err = p.redis.GetContext(c); err != nil {
+		log.For(c).Errorf("dao.Experiments() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	args := redis.Args{}
+	for _, id := range ids {
+		args = args.Add(def.ExperimentKey(id))
+	}
+	var values [][]byte
+	if values, err = redis.ByteSlices(conn.Do("MGET", args...)); err != nil {
+		log.For(c).Errorf("dao.Experiments() MGET error(%+v)", err)
+		return
+	}
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		item := new(model.Experiment)
+		if err = jsoniter.Unmarshal(v, item); err != nil {
+			log.For(c).Errorf("dao.Experiments() Unmarshal error(%+v)", err)
+			return
+		}
+		items = append(items, item)
+	}
+	return
+}
+
+// ExperimentIDs returns the ids of the experiments, newest first.
+func (p *Dao) ExperimentIDs(c context.Context, offset, limit int) (ids []string, err error) {
+	var conn redis.Conn
+	if conn, err = p.redis.GetContext(c); err != nil {
+		log.For(c).Errorf("dao.ExperimentIDs() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	if ids, err = redis.Strings(conn.Do("ZREVRANGE", def.ExperimentIndexKey, offset, offset+limit-1)); err != nil {
+		log.For(c).Errorf("dao.ExperimentIDs() ZREVRANGE error(%+v)", err)
+	}
+	return
+}
+
+// SetActiveExperiment marks id as the running experiment for ttl.
+func (p *Dao) SetActiveExperiment(c context.Context, id string, ttl time.Duration) (err error) {
+	var conn redis.Conn
+	if conn, err = p.redis.GetContext(c); err != nil {
+		log.For(c).Errorf("dao.SetActiveExperiment() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err = conn.Do("SET", def.ExperimentActiveKey, id, "PX", ttl.Milliseconds()); err != nil {
+		log.For(c).Errorf("dao.SetActiveExperiment(%s) error(%+v)", id, err)
+	}
+	return
+}
+
+// ActiveExperiment returns the id of the running experiment, empty if none.
+func (p *Dao) ActiveExperiment(c context.Context) (id string, err error) {
+	var conn redis.Conn
+	if conn, err = p.redis.GetContext(c); err != nil {
+		log.For(c).Errorf("dao.ActiveExperiment() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	if id, err = redis.String(conn.Do("GET", def.ExperimentActiveKey)); err == redis.ErrNil {
+		err = nil
+	} else if err != nil {
+		log.For(c).Errorf("dao.ActiveExperiment() error(%+v)", err)
+	}
+	return
+}
+
+// AddExperimentSamples adds the samples of a replica, by unix second, to the
+// series of an experiment.
+func (p *Dao) AddExperimentSamples(c context.Context, id, replica string, samples map[int64]*model.ExperimentSample) (err error) {
+	var conn redis.Conn
+	if conn, err = p.redis.GetContext(c); err != nil {
+		log.For(c).Errorf("dao.AddExperimentSamples() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	args := redis.Args{}.Add(def.ExperimentSeriesKey(id), replica, int64(_experimentExpire/time.Second))
+	for sec, s := range samples {
+		args = args.Add(sec, s.Published, s.Consumed, s.LatencySumMs, s.LatencyMaxMs)
+	}
+	if _, err = luaExperimentSamples.Do(conn, args...); err != nil {
+		log.For(c).Errorf("dao.AddExperimentSamples(%s) error(%+v)", id, err)
+	}
+	return
+}
+
+// ExperimentTotals returns the messages published and consumed in an
+// experiment so far.
+func (p *Dao) ExperimentTotals(c context.Context, id string) (published, consumed int64, err error) {
+	var conn redis.Conn
+	if conn, err = p.redis.GetContext(c); err != nil {
+		log.For(c).Errorf("dao.ExperimentTotals() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	var vs []int64
+	if vs, err = redis.Int64s(conn.Do("HMGET", def.ExperimentSeriesKey(id), "total:p", "total:c")); err != nil {
+		log.For(c).Errorf("dao.ExperimentTotals(%s) error(%+v)", id, err)
+		return
+	}
+	return vs[0], vs[1], nil
+}
+
+// ExperimentSeries returns the series of an experiment, a point a second
+// from the first to the last recorded one.
+func (p *Dao) ExperimentSeries(c context.Context, id string) (points []*model.ExperimentPoint, err error) {
+	var conn redis.Conn
+	if conn, err = p.redis.GetContext(c); err != nil {
+		log.For(c).Errorf("dao.ExperimentSeries() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	var fields map[string]string
+	if fields, err = redis.StringMap(conn.Do("HGETALL", def.ExperimentSeriesKey(id))); err != nil {
+		log.For(c).Errorf("dao.ExperimentSeries(%s) error(%+v)", id, err)
+		return
+	}
+
+	var (
+		bySec   = make(map[int64]*model.ExperimentPoint)
+		latSums = make(map[int64]int64)
+	)
+	for k, v := range fields {
+		parts := strings.SplitN(k, ":", 3)
+		sec, e := strconv.ParseInt(parts[0], 10, 64)
+		if e != nil || len(parts) < 2 {
+			// totals
+			continue
+		}
+		pt, ok := bySec[sec]
+		if !ok {
+			pt = &model.ExperimentPoint{Time: sec}
+			bySec[sec] = pt
+		}
+		n, _ := strconv.ParseInt(v, 10, 64)
+		switch parts[1] {
+		case "p":
+			pt.PublishRate = n
+		case "c":
+			pt.ConsumeRate = n
+		case "ls":
+			latSums[sec] = n
+		case "lm":
+			pt.LatencyMaxMs = n
+		case "w":
+			pt.Workers++
+		}
+	}
+	if len(bySec) == 0 {
+		return make([]*model.ExperimentPoint, 0), nil
+	}
+
+	secs := make([]int64, 0, len(bySec))
+	for sec := range bySec {
+		secs = append(secs, sec)
+	}
+	sort.Slice(secs, func(i, j int) bool { return secs[i] < secs[j] })
+
+	var backlog int64
+	points = make([]*model.ExperimentPoint, 0, secs[len(secs)-1]-secs[0]+1)
+	for sec := secs[0]; sec <= secs[len(secs)-1]; sec++ {
+		pt, ok := bySec[sec]
+		if !ok {
+			pt = &model.ExperimentPoint{Time: sec}
+		}
+		if pt.ConsumeRate > 0 {
+			pt.LatencyAvgMs = float64(latSums[sec]) / float64(pt.ConsumeRate)
+		}
+		backlog += pt.PublishRate - pt.ConsumeRate
+		if pt.Backlog = backlog; pt.Backlog < 0 {
+			// consumed before the publish was recorded.
+			pt.Backlog = 0
+		}
+		points = append(points, pt)
+	}
+	return
+}
@@ -0,0 +1,288 @@
+package dao
+
+import (
+	"ascale/app/api/model"
+	"ascale/pkg/cache/redis"
+	"ascale/pkg/def"
+	"ascale/pkg/log"
+	"context"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// _jobRunExpire is how long job runs are kept.
+const _jobRunExpire = 30 * 24 * time.Hour
+
+// _jobControlPing is how often the job control subscription checks its
+// connection.
+const _jobControlPing = 30 * time.Second
+
+// AddJobRun stores a job run and indexes it by start time, globally and per
+// job.
+func (p *Dao) AddJobRun(c context.Context, item *model.JobRun) (err error) {
+	var data []byte
+	if data, err = jsoniter.Marshal(item); err != nil {
+		log.For(c).Errorf("dao.AddJobRun() error(%+v)", err)
+		return
+	}
+
+	var conn redis.Conn
+	if conn, err = p.redis.GetContext(c); err != nil {
+		log.For(c).Errorf("dao.AddJobRun() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	expired := time.Now().Add(-_jobRunExpire).Unix()
+	indexes := []string{def.JobRunIndexAllKey, def.JobRunIndexKey(item.Job)}
+	if err = conn.Send("SET", def.JobRunKey(item.ID), data, "EX", int64(_jobRunExpire/time.Second)); err != nil {
+		log.For(c).Errorf("dao.AddJobRun() SET error(%+v)", err)
+		return
+	}
+	for _, key := range indexes {
+		if err = conn.Send("ZADD", key, item.StartedAt, item.ID); err != nil {
+			log.For(c).Errorf("dao.AddJobRun() ZADD error(%+v)", err)
+			return
+		}
+		if err = conn.Send("ZREMRANGEBYSCORE", key, "-inf", expired); err != nil {
+			log.For(c).Errorf("dao.AddJobRun() ZREMRANGEBYSCORE error(%+v)", err)
+			return
+		}
+	}
+	if err = conn.Flush(); err != nil {
+		log.For(c).Errorf("dao.AddJobRun() Flush error(%+v)", err)
+		return
+	}
+	for i := 0; i < 1+2*len(indexes); i++ {
+		if _, err = conn.Receive(); err != nil {
+			log.For(c).Errorf("dao.AddJobRun() Receive error(%+v)", err)
+			return
+		}
+	}
+	return
+}
+
+// UpdateJobRun overwrites a stored job run, keeping its expiry.
+func (p *Dao) UpdateJobRun(c context.Context, item *model.JobRun) (err error) {
+	var data []byte
+	if data, err = jsoniter.Marshal(item); err != nil {
+		log.For(c).Errorf("dao.UpdateJobRun() error(%+v)", err)
+		return
+	}
+
+	var conn redis.Conn
+	if conn, err = p.redis.GetContext(c); err != nil {
+		log.For(c).Errorf("dao.UpdateJobRun() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err = conn.Do("SET", def.JobRunKey(item.ID), data, "XX", "KEEPTTL"); err != nil {
+		log.For(c).Errorf("dao.UpdateJobRun() SET(%s) error(%+v)", item.ID, err)
+	}
+	return
+}
+
+// JobRuns returns the stored job runs of ids with their progress, missing
+// ones are skipped.
+func (p *Dao) JobRuns(c context.Context, ids []string) (items []*model.JobRun, err error) {
+	items = make([]*model.JobRun, 0, len(ids))
+	if len(ids) == 0 {
+		return
+	}
+
+	var conn redis.Conn
+	if conn, err = p.redis.GetContext(c); err != nil {
+		log.For(c).Errorf("dao.JobRuns() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	args := redis.Args{}
+	for _, id := range ids {
+		args = args.Add(def.JobRunKey(id))
+	}
+	for _, id := range ids {
+		args = args.Add(def.JobRunProgressKey(id))
+	}
+	var values [][]byte
+	if values, err = redis.ByteSlices(conn.Do("MGET", args...)); err != nil {
+		log.For(c).Errorf("dao.JobRuns() MGET error(%+v)", err)
+		return
+	}
+	for i, v := range values[:len(ids)] {
+		if v == nil {
+			continue
+		}
+		item := new(model.JobRun)
+		if err = jsoniter.Unmarshal(v, item); err != nil {
+			log.For(c).Errorf("dao.JobRuns() Unmarshal error(%+v)", err)
+			return
+		}
+		if pv := values[len(ids)+i]; pv != nil {
+			item.Progress = new(model.JobProgress)
+			if err = jsoniter.Unmarshal(pv, item.Progress); err != nil {
+				log.For(c).Errorf("dao.JobRuns() Unmarshal progress error(%+v)", err)
+				return
+			}
+		}
+		items = append(items, item)
+	}
+	return
+}
+
+// SetJobRunProgress stores the progress of a job run.
+func (p *Dao) SetJobRunProgress(c context.Context, id string, item *model.JobProgress) (err error) {
+	var data []byte
+	if data, err = jsoniter.Marshal(item); err != nil {
+		log.For(c).Errorf("dao.SetJobRunProgress() error(%+v)", err)
+		return
+	}
+
+	var conn redis.Conn
+	if conn, err = p.redis.GetContext(c); err != nil {
+		log.For(c).Errorf("dao.SetJobRunProgress() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err = conn.Do("SET", def.JobRunProgressKey(id), data, "EX", int64(_jobRunExpire/time.Second)); err != nil {
+		log.For(c).Errorf("dao.SetJobRunProgress() SET(%s) error(%+v)", id, err)
+	}
+	return
+}
+
+// PublishJobControl sends msg to the worker replicas, n is the number of
+// replicas which received it.
+func (p *Dao) PublishJobControl(c context.Context, msg *model.JobControl) (n int, err error) {
+	var data []byte
+	if data, err = jsoniter.Marshal(msg); err != nil {
+		log.For(c).Errorf("dao.PublishJobControl() error(%+v)", err)
+		return
+	}
+
+	var conn redis.Conn
+	if conn, err = p.redis.GetContext(c); err != nil {
+		log.For(c).Errorf("dao.PublishJobControl() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	if n, err = redis.Int(conn.Do("PUBLISH", def.JobControlChannel, data)); err != nil {
+		log.For(c).Errorf("dao.PublishJobControl() PUBLISH error(%+v)", err)
+	}
+	return
+}
+
+// ReceiveJobControl calls fn with the job control messages until c is done,
+// when it returns nil, or the subscription fails.
+func (p *Dao) ReceiveJobControl(c context.Context, fn func(msg *model.JobControl)) (err error) {
+	var conn redis.Conn
+	if conn, err = p.redis.GetContext(c); err != nil {
+		log.For(c).Errorf("dao.ReceiveJobControl() error(%+v)", err)
+		return
+	}
+	psc := redis.PubSubConn{Conn: conn}
+	defer psc.Close()
+
+	if err = psc.Subscribe(def.JobControlChannel); err != nil {
+		log.For(c).Errorf("dao.ReceiveJobControl() SUBSCRIBE error(%+v)", err)
+		return
+	}
+
+	// the receive loop below is the only reader, pings and the final
+	// unsubscribe are written from here.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		t := time.NewTicker(_jobControlPing)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-c.Done():
+				psc.Unsubscribe()
+				return
+			case <-t.C:
+				if psc.Ping("") != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		switch v := psc.ReceiveWithTimeout(2 * _jobControlPing).(type) {
+		case redis.Message:
+			msg := new(model.JobControl)
+			if e := jsoniter.Unmarshal(v.Data, msg); e != nil {
+				log.For(c).Warnf("dao.ReceiveJobControl() Unmarshal(%s) error(%+v)", v.Data, e)
+				continue
+			}
+			fn(msg)
+		case redis.Subscription:
+			if v.Count == 0 {
+				return nil
+			}
+		case error:
+			if c.Err() != nil {
+				return nil
+			}
+			log.For(c).Errorf("dao.ReceiveJobControl() error(%+v)", v)
+			return v
+		}
+	}
+}
+
+// JobRunIDs returns the ids of the runs of job, newest first. An empty job
+// lists all jobs.
+func (p *Dao) JobRunIDs(c context.Context, job string, offset, limit int) (ids []string, err error) {
+	key := def.JobRunIndexAllKey
+	if job != "" {
+		key = def.JobRunIndexKey(job)
+	}
+
+	var conn redis.Conn
+	if conn, err = p.redis.GetContext(c); err != nil {
+		log.For(c).Errorf("dao.JobRunIDs() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	if ids, err = redis.Strings(conn.Do("ZREVRANGE", key, offset, offset+limit-1)); err != nil {
+		log.For(c).Errorf("dao.JobRunIDs() ZREVRANGE(%s) error(%+v)", key, err)
+	}
+	return
+}
+
+// SetJobLastSuccess records the last succeeded run of a job.
+func (p *Dao) SetJobLastSuccess(c context.Context, job, id string) (err error) {
+	var conn redis.Conn
+	if conn, err = p.redis.GetContext(c); err != nil {
+		log.For(c).Errorf("dao.SetJobLastSuccess() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err = conn.Do("HSET", def.JobRunLastSuccessKey, job, id); err != nil {
+		log.For(c).Errorf("dao.SetJobLastSuccess() HSET(%s) error(%+v)", job, err)
+	}
+	return
+}
+
+// JobLastSuccess returns the id of the last succeeded run per job.
+func (p *Dao) JobLastSuccess(c context.Context) (ret map[string]string, err error) {
+	var conn redis.Conn
+	if conn, err = p.redis.GetContext(c); err != nil {
+		log.For(c).Errorf("dao.JobLastSuccess() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	if ret, err = redis.StringMap(conn.Do("HGETALL", def.JobRunLastSuccessKey)); err != nil {
+		log.For(c).Errorf("dao.JobLastSuccess() HGETALL error(%+v)", err)
+	}
+	return
+}
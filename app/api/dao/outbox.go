@@ -0,0 +1,81 @@
+package dao
+
+import (
+	"ascale/app/api/model"
+	"ascale/pkg/database/sqalx"
+	"ascale/pkg/log"
+	"context"
+)
+
+// outbox_messages table, created by app/api/migrations:
+//
+//	CREATE TABLE `outbox_messages` (
+//	  `id` bigint NOT NULL,
+//	  `topic` varchar(255) NOT NULL,
+//	  `data` mediumtext NOT NULL,
+//	  `attributes` text NOT NULL,
+//	  `attempts` int NOT NULL DEFAULT 0,
+//	  `next_attempt_at` bigint NOT NULL DEFAULT 0,
+//	  `last_error` varchar(1024) NOT NULL DEFAULT '',
+//	  `sent_at` bigint NOT NULL DEFAULT 0,
+//	  `created_at` bigint NOT NULL,
+//	  PRIMARY KEY (`id`),
+//	  KEY `idx_sent_at` (`sent_at`, `id`),
+//	  KEY `idx_unsent` (`sent_at`, `attempts`, `next_attempt_at`)
+//	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+// AddOutboxMessage inserts an outbox message, node is expected to be the
+// transaction of the business rows.
+func (p *Dao) AddOutboxMessage(c context.Context, node sqalx.Node, item *model.OutboxMessage) (err error) {
+	sqlInsert := "INSERT INTO outbox_messages( id,topic,data,attributes,attempts,next_attempt_at,last_error,sent_at,created_at) VALUES ( ?,?,?,?,?,?,?,?,?)"
+
+	if _, err = node.ExecContext(c, sqlInsert, item.ID, item.Topic, item.Data, item.Attributes, item.Attempts, item.NextAttemptAt, item.LastError, item.SentAt, item.CreatedAt); err != nil {
+		log.For(c).Errorf("dao.AddOutboxMessage() error(%+v), item(%+v)", err, item)
+	}
+	return
+}
+
+// GetUnsentOutboxMessages returns the oldest unsent outbox messages due at
+// now, the ones failed maxAttempts times are parked and not returned.
+func (p *Dao) GetUnsentOutboxMessages(c context.Context, node sqalx.Node, now int64, maxAttempts, limit int) (items []*model.OutboxMessage, err error) {
+	items = make([]*model.OutboxMessage, 0)
+	sqlSelect := "SELECT a.id,a.topic,a.data,a.attributes,a.attempts,a.next_attempt_at,a.last_error,a.sent_at,a.created_at FROM outbox_messages a WHERE a.sent_at=0 AND a.attempts<? AND a.next_attempt_at<=? ORDER BY a.id LIMIT ?"
+
+	if err = node.SelectContext(sqalx.NewContext(c, true), &items, sqlSelect, maxAttempts, now, limit); err != nil {
+		log.For(c).Errorf("dao.GetUnsentOutboxMessages() error(%+v)", err)
+	}
+	return
+}
+
+// MarkOutboxMessageSent marks an outbox message as published.
+func (p *Dao) MarkOutboxMessageSent(c context.Context, node sqalx.Node, id int64, sentAt int64) (err error) {
+	sqlUpdate := "UPDATE outbox_messages SET attempts=attempts+1,last_error='',sent_at=? WHERE id=?"
+
+	if _, err = node.ExecContext(c, sqlUpdate, sentAt, id); err != nil {
+		log.For(c).Errorf("dao.MarkOutboxMessageSent() id(%d) error(%+v)", id, err)
+	}
+	return
+}
+
+// UpdateOutboxMessageError records a failed publish of an outbox message, it
+// is not retried before nextAttemptAt.
+func (p *Dao) UpdateOutboxMessageError(c context.Context, node sqalx.Node, id int64, lastError string, nextAttemptAt int64) (err error) {
+	sqlUpdate := "UPDATE outbox_messages SET attempts=attempts+1,next_attempt_at=?,last_error=? WHERE id=?"
+
+	if _, err = node.ExecContext(c, sqlUpdate, nextAttemptAt, lastError, id); err != nil {
+		log.For(c).Errorf("dao.UpdateOutboxMessageError() id(%d) error(%+v)", id, err)
+	}
+	return
+}
+
+// DelSentOutboxMessages deletes at most limit outbox messages sent before.
+func (p *Dao) DelSentOutboxMessages(c context.Context, node sqalx.Node, before int64, limit int) (affected int64, err error) {
+	sqlDelete := "DELETE FROM outbox_messages WHERE sent_at>0 AND sent_at<? LIMIT ?"
+
+	ret, err := node.ExecContext(c, sqlDelete, before, limit)
+	if err != nil {
+		log.For(c).Errorf("dao.DelSentOutboxMessages() error(%+v)", err)
+		return
+	}
+	return ret.RowsAffected()
+}
@@ -0,0 +1,120 @@
+package dao
+
+import (
+	"ascale/app/api/model"
+	"ascale/pkg/cache/redis"
+	"ascale/pkg/def"
+	"ascale/pkg/log"
+	"context"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	// _topicLoadExpire is how long the load of a topic is kept once no
+	// replica reports it.
+	_topicLoadExpire = time.Minute
+	// _topicCountExpire is how long the counts of an unused topic are kept.
+	_topicCountExpire = 7 * 24 * time.Hour
+)
+
+// SetTopicLoads stores the load of the topics on a replica and adds its
+// published and settled messages to the counts of the topics.
+func (p *Dao) SetTopicLoads(c context.Context, replica string, loads map[string]*model.TopicLoad) (err error) {
+	var conn redis.Conn
+	if conn, err = p.redis.GetContext(c); err != nil {
+		log.For(c).Errorf("dao.SetTopicLoads() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	n := 0
+	send := func(cmd string, args ...interface{}) bool {
+		if err = conn.Send(cmd, args...); err != nil {
+			log.For(c).Errorf("dao.SetTopicLoads() %s error(%+v)", cmd, err)
+			return false
+		}
+		n++
+		return true
+	}
+	for topic, l := range loads {
+		var data []byte
+		if data, err = jsoniter.Marshal(l); err != nil {
+			log.For(c).Errorf("dao.SetTopicLoads() error(%+v)", err)
+			return
+		}
+		key := def.TopicLoadKey(topic)
+		if !send("HSET", key, replica, data) || !send("EXPIRE", key, int64(_topicLoadExpire/time.Second)) {
+			return
+		}
+		if l.Published == 0 && l.Settled == 0 {
+			continue
+		}
+		key = def.TopicCountKey(topic)
+		if !send("HINCRBY", key, "published", l.Published) ||
+			!send("HINCRBY", key, "settled", l.Settled) ||
+			!send("EXPIRE", key, int64(_topicCountExpire/time.Second)) {
+			return
+		}
+	}
+	if err = conn.Flush(); err != nil {
+		log.For(c).Errorf("dao.SetTopicLoads() Flush error(%+v)", err)
+		return
+	}
+	for i := 0; i < n; i++ {
+		if _, err = conn.Receive(); err != nil {
+			log.For(c).Errorf("dao.SetTopicLoads() Receive error(%+v)", err)
+			return
+		}
+	}
+	return
+}
+
+// TopicLoads returns the load of a topic by replica and the counts of its
+// messages published and settled.
+func (p *Dao) TopicLoads(c context.Context, topic string) (loads map[string]*model.TopicLoad, published, settled int64, err error) {
+	var conn redis.Conn
+	if conn, err = p.redis.GetContext(c); err != nil {
+		log.For(c).Errorf("dao.TopicLoads() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	var replicas map[string]string
+	if replicas, err = redis.StringMap(conn.Do("HGETALL", def.TopicLoadKey(topic))); err != nil {
+		log.For(c).Errorf("dao.TopicLoads(%s) HGETALL error(%+v)", topic, err)
+		return
+	}
+	loads = make(map[string]*model.TopicLoad, len(replicas))
+	for replica, data := range replicas {
+		l := new(model.TopicLoad)
+		if e := jsoniter.UnmarshalFromString(data, l); e != nil {
+			log.For(c).Warnf("dao.TopicLoads(%s) replica(%s) Unmarshal error(%+v)", topic, replica, e)
+			continue
+		}
+		loads[replica] = l
+	}
+
+	var counts []int64
+	if counts, err = redis.Int64s(conn.Do("HMGET", def.TopicCountKey(topic), "published", "settled")); err != nil {
+		log.For(c).Errorf("dao.TopicLoads(%s) HMGET error(%+v)", topic, err)
+		return
+	}
+	return loads, counts[0], counts[1], nil
+}
+
+// DelTopicLoads removes the load of replicas which stopped reporting.
+func (p *Dao) DelTopicLoads(c context.Context, topic string, replicas ...string) (err error) {
+	var conn redis.Conn
+	if conn, err = p.redis.GetContext(c); err != nil {
+		log.For(c).Errorf("dao.DelTopicLoads() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err = conn.Do("HDEL", redis.Args{}.Add(def.TopicLoadKey(topic)).AddFlat(replicas)...); err != nil {
+		log.For(c).Errorf("dao.DelTopicLoads(%s) error(%+v)", topic, err)
+	}
+	return
+}
@@ -0,0 +1,40 @@
+package http
+
+import (
+	"ascale/app/api/model"
+	"ascale/pkg/ecode"
+	"ascale/pkg/log"
+	"ascale/pkg/net/http/vin"
+)
+
+func deadLetters(c *vin.Context) {
+	arg := new(model.ArgDeadLetterList)
+	if e := c.BindQuery(arg); e != nil {
+		return
+	}
+
+	if e := arg.Validate(); e != nil {
+		log.For(c).Warnf("arg.Validate() error(%+v)", e)
+		c.JSON(nil, ecode.RequestErr)
+		return
+	}
+	c.JSON(srv.ListDeadLetters(c, arg))
+}
+
+func getDeadLetter(c *vin.Context) {
+	c.JSON(srv.GetDeadLetter(c, c.Param("id")))
+}
+
+func replayDeadLetters(c *vin.Context) {
+	arg := new(model.ArgReplayDeadLetter)
+	if e := c.BindJSON(arg); e != nil {
+		return
+	}
+
+	if e := arg.Validate(); e != nil {
+		log.For(c).Warnf("arg.Validate() error(%+v)", e)
+		c.JSON(nil, ecode.RequestErr)
+		return
+	}
+	c.JSON(srv.ReplayDeadLetters(c, arg))
+}
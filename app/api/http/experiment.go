@@ -0,0 +1,58 @@
+package http
+
+import (
+	"ascale/app/api/model"
+	"ascale/pkg/ecode"
+	"ascale/pkg/log"
+	"ascale/pkg/net/http/vin"
+	"bytes"
+	"encoding/csv"
+	"net/http"
+	"strconv"
+)
+
+func experiments(c *vin.Context) {
+	arg := new(model.ArgExperimentList)
+	if e := c.BindQuery(arg); e != nil {
+		return
+	}
+
+	if e := arg.Validate(); e != nil {
+		log.For(c).Warnf("arg.Validate() error(%+v)", e)
+		c.JSON(nil, ecode.RequestErr)
+		return
+	}
+	c.JSON(srv.ListExperiments(c, arg))
+}
+
+func getExperiment(c *vin.Context) {
+	c.JSON(srv.GetExperiment(c, c.Param("id")))
+}
+
+// experimentReport returns the report as JSON, or its time series as CSV
+// with format=csv.
+func experimentReport(c *vin.Context) {
+	report, err := srv.ExperimentReport(c, c.Param("id"))
+	if err != nil || c.Query("format") != "csv" {
+		c.JSON(report, err)
+		return
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"time", "publish_rate", "consume_rate", "backlog", "latency_avg_ms", "latency_max_ms", "workers"})
+	for _, pt := range report.Points {
+		w.Write([]string{
+			strconv.FormatInt(pt.Time, 10),
+			strconv.FormatInt(pt.PublishRate, 10),
+			strconv.FormatInt(pt.ConsumeRate, 10),
+			strconv.FormatInt(pt.Backlog, 10),
+			strconv.FormatFloat(pt.LatencyAvgMs, 'f', 1, 64),
+			strconv.FormatInt(pt.LatencyMaxMs, 10),
+			strconv.Itoa(pt.Workers),
+		})
+	}
+	w.Flush()
+	c.Header("Content-Disposition", "attachment; filename=experiment-"+report.Experiment.ID+".csv")
+	c.Data(http.StatusOK, "text/csv", buf.Bytes())
+}
@@ -35,6 +35,23 @@ func setupRoute(e *vin.Engine) {
 	job := e.Group("/job")
 	{
 		job.POST("/trigger", triggerJob)
+		job.GET("/jobs", triggerJobs)
+		job.GET("/cron", cronStatus)
+		job.GET("/runs", jobRuns)
+		job.GET("/runs/:id", getJobRun)
+		job.POST("/runs/:id/cancel", cancelJobRun)
+		job.GET("/last_success", jobLastSuccess)
+		job.GET("/experiments", experiments)
+		job.GET("/experiments/:id", getExperiment)
+		job.GET("/experiments/:id/report", experimentReport)
+		job.GET("/dead_letters", deadLetters)
+		job.GET("/dead_letters/:id", getDeadLetter)
+		job.POST("/dead_letters/replay", replayDeadLetters)
+	}
+
+	mq := e.Group("/mq")
+	{
+		mq.GET("/drifts", mqDrifts)
 	}
 
 	base := e.Group("/")
@@ -46,7 +63,8 @@ func route(e *vin.RouterGroup) {
 	// e.GET("/system_info", getSystemInfo)
 }
 
-// ping check server ok.
+// ping check server ok, failing subscriptions are reported without failing
+// it as they are restarted in place.
 func ping(c *vin.Context) {
 	var err error
 	if err = srv.Ping(c); err != nil {
@@ -55,7 +73,12 @@ func ping(c *vin.Context) {
 		return
 	}
 
-	c.JSON(nil, nil)
+	c.JSON(srv.SubscriptionHealth(), nil)
+}
+
+// mqDrifts reports the subscriptions which drifted from their declaration.
+func mqDrifts(c *vin.Context) {
+	c.JSON(srv.Drifts(c))
 }
 
 // register support discovery.
@@ -0,0 +1,34 @@
+package http
+
+import (
+	"ascale/app/api/model"
+	"ascale/pkg/ecode"
+	"ascale/pkg/log"
+	"ascale/pkg/net/http/vin"
+)
+
+func jobRuns(c *vin.Context) {
+	arg := new(model.ArgJobRunList)
+	if e := c.BindQuery(arg); e != nil {
+		return
+	}
+
+	if e := arg.Validate(); e != nil {
+		log.For(c).Warnf("arg.Validate() error(%+v)", e)
+		c.JSON(nil, ecode.RequestErr)
+		return
+	}
+	c.JSON(srv.ListJobRuns(c, arg))
+}
+
+func getJobRun(c *vin.Context) {
+	c.JSON(srv.GetJobRun(c, c.Param("id")))
+}
+
+func cancelJobRun(c *vin.Context) {
+	c.JSON(srv.CancelJobRun(c, c.Param("id")))
+}
+
+func jobLastSuccess(c *vin.Context) {
+	c.JSON(srv.JobLastSuccess(c))
+}
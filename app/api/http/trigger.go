@@ -18,5 +18,13 @@ func triggerJob(c *vin.Context) {
 		c.JSON(nil, ecode.RequestErr)
 		return
 	}
-	c.JSON(nil, srv.TriggerJob(c, arg.Job))
+	c.JSON(nil, srv.TriggerJob(c, arg.Job, arg.Params))
+}
+
+func triggerJobs(c *vin.Context) {
+	c.JSON(srv.TriggerJobs(c))
+}
+
+func cronStatus(c *vin.Context) {
+	c.JSON(srv.CronStatus(c))
 }
@@ -0,0 +1,18 @@
+-- outbox messages are published by the outbox relay after the transaction
+-- of their business rows commits. Failed messages back off until
+-- next_attempt_at and are parked once out of attempts, set attempts=0 to
+-- relay a parked message again.
+CREATE TABLE IF NOT EXISTS `outbox_messages` (
+  `id` bigint NOT NULL,
+  `topic` varchar(255) NOT NULL,
+  `data` mediumtext NOT NULL,
+  `attributes` text NOT NULL,
+  `attempts` int NOT NULL DEFAULT 0,
+  `next_attempt_at` bigint NOT NULL DEFAULT 0,
+  `last_error` varchar(1024) NOT NULL DEFAULT '',
+  `sent_at` bigint NOT NULL DEFAULT 0,
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_sent_at` (`sent_at`, `id`),
+  KEY `idx_unsent` (`sent_at`, `attempts`, `next_attempt_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
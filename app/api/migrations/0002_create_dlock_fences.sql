@@ -0,0 +1,8 @@
+-- dlock fences hold the highest fencing token recorded per resource by
+-- dlock.CheckFenceTx, writes of a lock holder with an older token are
+-- rejected.
+CREATE TABLE IF NOT EXISTS `dlock_fences` (
+  `resource` varchar(255) NOT NULL,
+  `token` bigint NOT NULL,
+  PRIMARY KEY (`resource`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
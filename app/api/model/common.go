@@ -1,9 +1,15 @@
 package model
 
-import validation "github.com/go-ozzo/ozzo-validation"
+import (
+	"encoding/json"
+	"regexp"
+
+	validation "github.com/go-ozzo/ozzo-validation"
+)
 
 type ArgJob struct {
-	Job string `json:"job"`
+	Job    string          `json:"job"`
+	Params json.RawMessage `json:"params"`
 }
 
 func (p *ArgJob) Validate() error {
@@ -12,3 +18,44 @@ func (p *ArgJob) Validate() error {
 		validation.Field(&p.Job, validation.Required),
 	)
 }
+
+// ArgDeadLetterList lists a page of dead letters, Cursor is the one of the
+// previous page.
+type ArgDeadLetterList struct {
+	Topic  string `json:"topic" form:"topic"`
+	From   int64  `json:"from" form:"from"`
+	To     int64  `json:"to" form:"to"`
+	Cursor string `json:"cursor" form:"cursor"`
+	Limit  int    `json:"limit" form:"limit"`
+}
+
+var _deadLetterCursor = regexp.MustCompile(`^\d+:.+$`)
+
+func (p *ArgDeadLetterList) Validate() error {
+	return validation.ValidateStruct(
+		p,
+		validation.Field(&p.Cursor, validation.Match(_deadLetterCursor)),
+		validation.Field(&p.Limit, validation.Min(0), validation.Max(100)),
+	)
+}
+
+type ArgReplayDeadLetter struct {
+	IDs   []string `json:"ids"`
+	Topic string   `json:"topic"`
+	From  int64    `json:"from"`
+	To    int64    `json:"to"`
+}
+
+// Validate requires either IDs or a Topic to replay a time range of.
+func (p *ArgReplayDeadLetter) Validate() error {
+	if len(p.IDs) == 0 {
+		return validation.ValidateStruct(
+			p,
+			validation.Field(&p.Topic, validation.Required),
+		)
+	}
+	return validation.ValidateStruct(
+		p,
+		validation.Field(&p.IDs, validation.Length(1, 1000)),
+	)
+}
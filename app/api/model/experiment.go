@@ -0,0 +1,87 @@
+package model
+
+import (
+	"encoding/json"
+
+	validation "github.com/go-ozzo/ozzo-validation"
+)
+
+const (
+	ExperimentStatusRunning  = "running"
+	ExperimentStatusDraining = "draining"
+	ExperimentStatusFinished = "finished"
+	// ExperimentStatusAborted is an experiment whose load job was cut short
+	// or whose backlog did not drain in time.
+	ExperimentStatusAborted = "aborted"
+)
+
+// Experiment is an autoscaling experiment, the run of a load job and the
+// consumption of its messages.
+type Experiment struct {
+	ID     string          `json:"id"`
+	Job    string          `json:"job"`
+	Params json.RawMessage `json:"params"`
+	Status string          `json:"status"`
+	// StartedAt, LoadEndedAt and FinishedAt are unix ms, the load ends when
+	// the job stops publishing and the experiment once the backlog drained.
+	StartedAt   int64              `json:"started_at"`
+	LoadEndedAt int64              `json:"load_ended_at"`
+	FinishedAt  int64              `json:"finished_at"`
+	Summary     *ExperimentSummary `json:"summary,omitempty"`
+}
+
+// ExperimentSummary sums up a finished experiment.
+type ExperimentSummary struct {
+	Published int64 `json:"published"`
+	Consumed  int64 `json:"consumed"`
+	// PeakBacklog is the highest estimated backlog, published but not
+	// consumed messages, at PeakBacklogAt unix second.
+	PeakBacklog   int64 `json:"peak_backlog"`
+	PeakBacklogAt int64 `json:"peak_backlog_at"`
+	// TimeToDrainMs is from the end of the load to an empty backlog, -1 if
+	// it did not drain.
+	TimeToDrainMs   int64   `json:"time_to_drain_ms"`
+	PeakPublishRate int64   `json:"peak_publish_rate"`
+	PeakConsumeRate int64   `json:"peak_consume_rate"`
+	LatencyAvgMs    float64 `json:"latency_avg_ms"`
+	LatencyMaxMs    int64   `json:"latency_max_ms"`
+	MaxWorkers      int     `json:"max_workers"`
+}
+
+// ExperimentSample is what a replica recorded for an experiment in a second.
+type ExperimentSample struct {
+	Published    int64
+	Consumed     int64
+	LatencySumMs int64
+	LatencyMaxMs int64
+}
+
+// ExperimentPoint is a second of an experiment, rates are per second.
+type ExperimentPoint struct {
+	Time         int64   `json:"time"`
+	PublishRate  int64   `json:"publish_rate"`
+	ConsumeRate  int64   `json:"consume_rate"`
+	Backlog      int64   `json:"backlog"`
+	LatencyAvgMs float64 `json:"latency_avg_ms"`
+	LatencyMaxMs int64   `json:"latency_max_ms"`
+	Workers      int     `json:"workers"`
+}
+
+// ExperimentReport is an experiment with its time series.
+type ExperimentReport struct {
+	Experiment *Experiment        `json:"experiment"`
+	Points     []*ExperimentPoint `json:"points"`
+}
+
+type ArgExperimentList struct {
+	Offset int `json:"offset" form:"offset"`
+	Limit  int `json:"limit" form:"limit"`
+}
+
+func (p *ArgExperimentList) Validate() error {
+	return validation.ValidateStruct(
+		p,
+		validation.Field(&p.Offset, validation.Min(0)),
+		validation.Field(&p.Limit, validation.Min(0), validation.Max(100)),
+	)
+}
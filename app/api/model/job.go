@@ -0,0 +1,131 @@
+package model
+
+import (
+	"ascale/pkg/loadgen"
+	"ascale/pkg/xtime"
+	"errors"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation"
+)
+
+const (
+	JobRunStatusRunning   = "running"
+	JobRunStatusSucceeded = "succeeded"
+	JobRunStatusFailed    = "failed"
+	// JobRunStatusSkipped is a run which did not start because another run
+	// of the job held its lock.
+	JobRunStatusSkipped = "skipped"
+	// JobRunStatusCancelled is a run stopped early through the control API.
+	JobRunStatusCancelled = "cancelled"
+)
+
+const (
+	// JobControlCancel cancels a running job run.
+	JobControlCancel = "cancel"
+)
+
+// JobRun is a run of a trigger job.
+type JobRun struct {
+	ID          string `json:"id"`
+	Job         string `json:"job"`
+	TriggerTime int64  `json:"trigger_time"`
+	StartedAt   int64  `json:"started_at"`
+	FinishedAt  int64  `json:"finished_at"`
+	DurationMs  int64  `json:"duration_ms"`
+	Status      string `json:"status"`
+	Error       string `json:"error"`
+	Replica     string `json:"replica"`
+	// Progress is the last progress reported by the run, nil if none.
+	Progress *JobProgress `json:"progress,omitempty"`
+}
+
+// JobProgress is the progress reported by a job run.
+type JobProgress struct {
+	Done      int64  `json:"done"`
+	Total     int64  `json:"total"`
+	Message   string `json:"message"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+// JobControl is a control message sent to the replica running a job run.
+type JobControl struct {
+	Action string `json:"action"`
+	RunID  string `json:"run_id"`
+}
+
+type ArgJobRunList struct {
+	Job    string `json:"job" form:"job"`
+	Offset int    `json:"offset" form:"offset"`
+	Limit  int    `json:"limit" form:"limit"`
+}
+
+func (p *ArgJobRunList) Validate() error {
+	return validation.ValidateStruct(
+		p,
+		validation.Field(&p.Offset, validation.Min(0)),
+		validation.Field(&p.Limit, validation.Min(0), validation.Max(100)),
+	)
+}
+
+// TriggerJobInfo is a registered trigger job and its default params.
+type TriggerJobInfo struct {
+	Job    string      `json:"job"`
+	Params interface{} `json:"params"`
+}
+
+// SendLittleMessagesParams are the params of the send little messages job.
+type SendLittleMessagesParams struct {
+	// Interval between messages.
+	Interval xtime.Duration `json:"interval"`
+	// Duration the job sends for.
+	Duration xtime.Duration `json:"duration"`
+}
+
+func (p *SendLittleMessagesParams) Validate() error {
+	return validation.ValidateStruct(
+		p,
+		validation.Field(&p.Interval, validation.Required, validation.Min(xtime.Duration(time.Millisecond)).Error("must be at least 1ms"), validation.Max(xtime.Duration(time.Minute)).Error("must be at most 1m")),
+		validation.Field(&p.Duration, validation.Required, validation.Max(xtime.Duration(time.Hour)).Error("must be at most 1h")),
+	)
+}
+
+// SendHugeMessagesParams are the params of the send huge messages job.
+type SendHugeMessagesParams struct {
+	// Rate is the messages sent per second, 0 sends as fast as the flow
+	// control allows.
+	Rate int `json:"rate"`
+	// Duration the job sends for.
+	Duration xtime.Duration `json:"duration"`
+}
+
+func (p *SendHugeMessagesParams) Validate() error {
+	return validation.ValidateStruct(
+		p,
+		validation.Field(&p.Rate, validation.Min(0), validation.Max(100000)),
+		validation.Field(&p.Duration, validation.Required, validation.Max(xtime.Duration(time.Hour)).Error("must be at most 1h")),
+	)
+}
+
+// LoadProfileParams are the params of the load profile job.
+type LoadProfileParams struct {
+	Profile loadgen.Profile `json:"profile"`
+	// Cost is the simulated work of every task.
+	Cost loadgen.Cost `json:"cost"`
+	// DrainTimeout is how long the experiment waits for the backlog to drain
+	// after the load.
+	DrainTimeout xtime.Duration `json:"drain_timeout"`
+}
+
+func (p *LoadProfileParams) Validate() error {
+	if err := p.Profile.Validate(); err != nil {
+		return err
+	}
+	if p.Profile.Duration > xtime.Duration(time.Hour) {
+		return errors.New("profile.duration: must be at most 1h")
+	}
+	if p.DrainTimeout < 0 || p.DrainTimeout > xtime.Duration(time.Hour) {
+		return errors.New("drain_timeout: must be at most 1h")
+	}
+	return p.Cost.Validate()
+}
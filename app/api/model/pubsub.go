@@ -1,5 +1,10 @@
 package model
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type PublishMessage struct {
 	Topic   string
 	Message interface{}
@@ -8,9 +13,55 @@ type PublishMessage struct {
 type TriggerCommand struct {
 	Job         string
 	TriggerTime int64
+	// Params of the job, validated against the schema it registered. The
+	// defaults are used when empty.
+	Params json.RawMessage `json:",omitempty"`
 }
 
 type DoTaskCommand struct {
 	Name        string
 	TriggerTime int64
+	// WorkCost is the simulated work of the task, slept or burnt on CPU
+	// when WorkCPU is set.
+	WorkCost time.Duration `json:",omitempty"`
+	WorkCPU  bool          `json:",omitempty"`
+}
+
+type DeadLetter struct {
+	ID         string            `json:"id"`
+	Topic      string            `json:"topic"`
+	SourceID   string            `json:"source_id"`
+	Data       string            `json:"data"`
+	Attributes map[string]string `json:"attributes"`
+	Error      string            `json:"error"`
+	Attempt    int               `json:"attempt"`
+	CreatedAt  int64             `json:"created_at"`
+	ReplayedAt int64             `json:"replayed_at"`
+}
+
+// DeadLetterPage is a page of dead letters, Cursor lists the next one and is
+// empty after the last one.
+type DeadLetterPage struct {
+	Items  []*DeadLetter `json:"items"`
+	Cursor string        `json:"cursor"`
+}
+
+type ReplayResult struct {
+	Replayed int      `json:"replayed"`
+	Skipped  int      `json:"skipped"`
+	Failed   []string `json:"failed"`
+}
+
+// OutboxMessage is a message written in the transaction of the business rows
+// it belongs to, the outbox relay publishes it after commit.
+type OutboxMessage struct {
+	ID            int64  `db:"id" json:"id,string"`
+	Topic         string `db:"topic" json:"topic"`
+	Data          string `db:"data" json:"data"`
+	Attributes    string `db:"attributes" json:"attributes"`
+	Attempts      int    `db:"attempts" json:"attempts"`
+	NextAttemptAt int64  `db:"next_attempt_at" json:"next_attempt_at"`
+	LastError     string `db:"last_error" json:"last_error"`
+	SentAt        int64  `db:"sent_at" json:"sent_at"`
+	CreatedAt     int64  `db:"created_at" json:"created_at"`
 }
@@ -0,0 +1,17 @@
+package model
+
+// TopicLoad is the load of a topic on a replica, reported every second.
+type TopicLoad struct {
+	InFlight int64 `json:"in_flight"`
+	// Handled is the number of messages handled since the last report.
+	Handled int64 `json:"handled"`
+	// LatencyMs is the moving average of the time to handle a message.
+	LatencyMs float64 `json:"latency_ms"`
+	// UpdatedAt is unix ms.
+	UpdatedAt int64 `json:"updated_at"`
+
+	// Published and Settled are the messages published and acked since the
+	// last report, counted only for brokers which do not report a backlog.
+	Published int64 `json:"-"`
+	Settled   int64 `json:"-"`
+}
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"ascale/app/api/model"
+	"ascale/pkg/cron"
+	"ascale/pkg/def"
+	"ascale/pkg/log"
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// startCron schedules the configured trigger jobs, the elected replica
+// publishes them to the trigger topic like POST /job/trigger does.
+func (p *Service) startCron() {
+	cc := p.c.Cron
+	if cc == nil || !cc.Enabled {
+		return
+	}
+
+	p.cron = cron.New(p.d.Redis(), cc.Scheduler)
+	for _, v := range cc.Jobs {
+		var params json.RawMessage
+		if len(v.Params) > 0 {
+			var err error
+			if params, err = json.Marshal(v.Params); err != nil {
+				log.Fatalf("cron job(%s) params error(%+v)", v.Job, err)
+			}
+		}
+		if _, err := decodeJobParams(v.Job, params); err != nil {
+			log.Fatalf("cron job(%s) error(%+v)", v.Job, err)
+		}
+		job := v.Job
+		err := p.cron.Add(&cron.Job{
+			Name:    job,
+			Spec:    v.Spec,
+			CatchUp: v.CatchUp,
+			Run: func(c context.Context, at time.Time) error {
+				return p.Publish(c, def.Topics.Trigger, &model.TriggerCommand{Job: job, TriggerTime: at.Unix(), Params: params})
+			},
+		})
+		if err != nil {
+			log.Fatalf("cron.Add(%s) error(%+v)", job, err)
+		}
+	}
+	p.cron.Start()
+}
+
+// CronStatus returns the schedule state of the cron jobs.
+func (p *Service) CronStatus(c context.Context) (ret []*cron.Status, err error) {
+	if p.cron == nil {
+		return make([]*cron.Status, 0), nil
+	}
+	return p.cron.Status(c)
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"ascale/app/api/model"
+	"ascale/pkg/ecode"
+	"ascale/pkg/log"
+	"ascale/pkg/mq"
+	"ascale/pkg/xtime"
+	"context"
+	"strconv"
+)
+
+// logDeadLetter keeps dead letters for inspection and replay.
+func (p *Service) logDeadLetter(c context.Context, msg mq.Message) (err error) {
+	log.For(c).Errorf("DeadLetter, data(%s) attributes(%+v)", string(msg.Data()), msg.Attributes())
+
+	attrs := msg.Attributes()
+	item := &model.DeadLetter{
+		ID:         msg.ID(),
+		Topic:      attrs[mq.AttrSourceTopic],
+		SourceID:   attrs[mq.AttrSourceID],
+		Data:       string(msg.Data()),
+		Attributes: attrs,
+		Error:      attrs[mq.AttrError],
+		CreatedAt:  msg.PublishTime().Unix(),
+	}
+	item.Attempt, _ = strconv.Atoi(attrs[mq.AttrAttempt])
+	if msg.PublishTime().IsZero() {
+		item.CreatedAt = xtime.NowUnix()
+	}
+
+	return p.d.AddDeadLetter(c, item)
+}
+
+func (p *Service) GetDeadLetter(c context.Context, id string) (item *model.DeadLetter, err error) {
+	var items []*model.DeadLetter
+	if items, err = p.d.DeadLetters(c, []string{id}); err != nil {
+		return
+	}
+	if len(items) == 0 {
+		err = ecode.NothingFound
+		return
+	}
+	return items[0], nil
+}
+
+func (p *Service) ListDeadLetters(c context.Context, arg *model.ArgDeadLetterList) (page *model.DeadLetterPage, err error) {
+	limit := arg.Limit
+	if limit == 0 {
+		limit = 20
+	}
+	page = new(model.DeadLetterPage)
+	var ids []string
+	if ids, page.Cursor, err = p.d.DeadLetterIDs(c, arg.Topic, arg.From, arg.To, arg.Cursor, limit); err != nil {
+		return
+	}
+	// expired dead letters are missing, a short page is not the last one.
+	page.Items, err = p.d.DeadLetters(c, ids)
+	return
+}
+
+// ReplayDeadLetters publishes dead letters back to their source topic, either
+// the given IDs or every dead letter of Topic created in [From, To] which has
+// not been replayed yet. To defaults to now, the replays which fail again are
+// not replayed twice.
+func (p *Service) ReplayDeadLetters(c context.Context, arg *model.ArgReplayDeadLetter) (ret *model.ReplayResult, err error) {
+	ret = &model.ReplayResult{Failed: make([]string, 0)}
+	if len(arg.IDs) > 0 {
+		var items []*model.DeadLetter
+		if items, err = p.d.DeadLetters(c, arg.IDs); err != nil {
+			return
+		}
+		ret.Skipped = len(arg.IDs) - len(items)
+		for _, v := range items {
+			p.replayDeadLetter(c, v, ret)
+		}
+		return
+	}
+
+	const pageSize = 100
+	to := arg.To
+	if to == 0 {
+		to = xtime.NowUnix()
+	}
+	var cursor string
+	for {
+		var ids []string
+		if ids, cursor, err = p.d.DeadLetterIDs(c, arg.Topic, arg.From, to, cursor, pageSize); err != nil {
+			return
+		}
+		if len(ids) == 0 {
+			return
+		}
+		var items []*model.DeadLetter
+		if items, err = p.d.DeadLetters(c, ids); err != nil {
+			return
+		}
+		for _, v := range items {
+			if v.ReplayedAt > 0 {
+				ret.Skipped++
+				continue
+			}
+			p.replayDeadLetter(c, v, ret)
+		}
+	}
+}
+
+func (p *Service) replayDeadLetter(c context.Context, item *model.DeadLetter, ret *model.ReplayResult) {
+	if item.Topic == "" {
+		log.For(c).Warnf("replayDeadLetter(%s) unknown source topic", item.ID)
+		ret.Failed = append(ret.Failed, item.ID)
+		return
+	}
+
+	attrs := make(map[string]string, len(item.Attributes))
+	for k, v := range item.Attributes {
+		switch k {
+		case mq.AttrSourceTopic, mq.AttrSourceID, mq.AttrError, mq.AttrAttempt:
+			continue
+		}
+		attrs[k] = v
+	}
+
+	env := &mq.Envelope{Data: []byte(item.Data), Attributes: attrs}
+	if _, err := p.mq.Publish(c, item.Topic, env); err != nil {
+		log.For(c).Errorf("replayDeadLetter(%s) topic(%s) error(%+v)", item.ID, item.Topic, err)
+		ret.Failed = append(ret.Failed, item.ID)
+		return
+	}
+	ret.Replayed++
+
+	item.ReplayedAt = xtime.NowUnix()
+	if err := p.d.UpdateDeadLetter(c, item); err != nil {
+		log.For(c).Errorf("replayDeadLetter(%s) mark replayed error(%+v)", item.ID, err)
+	}
+}
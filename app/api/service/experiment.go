@@ -0,0 +1,278 @@
+package service
+
+import (
+	"ascale/app/api/model"
+	"ascale/pkg/conf/env"
+	"ascale/pkg/ecode"
+	"ascale/pkg/gid"
+	"ascale/pkg/log"
+	"ascale/pkg/mq"
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	// attrExperiment carries the experiment id on the messages of load jobs.
+	attrExperiment = "x-experiment"
+
+	_experimentFlush     = time.Second
+	_experimentActiveTTL = 10 * time.Second
+)
+
+// experimentRecorder sums the samples of this replica until they are
+// flushed, by experiment and unix second.
+type experimentRecorder struct {
+	mu      sync.Mutex
+	samples map[string]map[int64]*model.ExperimentSample
+}
+
+func newExperimentRecorder() *experimentRecorder {
+	return &experimentRecorder{samples: make(map[string]map[int64]*model.ExperimentSample)}
+}
+
+func (r *experimentRecorder) add(id string, at time.Time, fn func(s *model.ExperimentSample)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	secs, ok := r.samples[id]
+	if !ok {
+		secs = make(map[int64]*model.ExperimentSample)
+		r.samples[id] = secs
+	}
+	s, ok := secs[at.Unix()]
+	if !ok {
+		s = new(model.ExperimentSample)
+		secs[at.Unix()] = s
+	}
+	fn(s)
+}
+
+func (r *experimentRecorder) take() (samples map[string]map[int64]*model.ExperimentSample) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	samples, r.samples = r.samples, make(map[string]map[int64]*model.ExperimentSample)
+	return
+}
+
+// published records n messages published in experiment id, n is negative
+// for failed ones.
+func (r *experimentRecorder) published(id string, n int64) {
+	r.add(id, time.Now(), func(s *model.ExperimentSample) { s.Published += n })
+}
+
+// consumed records a message of experiment id handled latency after it
+// was published.
+func (r *experimentRecorder) consumed(id string, latency time.Duration) {
+	ms := latency.Milliseconds()
+	r.add(id, time.Now(), func(s *model.ExperimentSample) {
+		s.Consumed++
+		s.LatencySumMs += ms
+		if ms > s.LatencyMaxMs {
+			s.LatencyMaxMs = ms
+		}
+	})
+}
+
+// experimentMiddleware records the messages of experiments handled
+// successfully, from their publish time.
+func (p *Service) experimentMiddleware(cfg *mq.SubscriptionConfig, next mq.HandlerFunc) mq.HandlerFunc {
+	return func(c context.Context, msg mq.Message) (err error) {
+		if err = next(c, msg); err != nil {
+			return
+		}
+		if id := msg.Attributes()[attrExperiment]; id != "" {
+			p.exp.consumed(id, time.Since(msg.PublishTime()))
+		}
+		return
+	}
+}
+
+// experimentproc flushes the recorded samples every second until Close, the
+// replica reports itself active in the running experiment meanwhile.
+func (p *Service) experimentproc() {
+	ticker := time.NewTicker(_experimentFlush)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closing:
+			p.flushExperiments(context.Background())
+			return
+		case <-ticker.C:
+		}
+
+		c := context.Background()
+		if id, err := p.d.ActiveExperiment(c); err == nil && id != "" {
+			p.exp.add(id, time.Now(), func(*model.ExperimentSample) {})
+		}
+		p.flushExperiments(c)
+	}
+}
+
+func (p *Service) flushExperiments(c context.Context) {
+	for id, samples := range p.exp.take() {
+		p.d.AddExperimentSamples(c, id, env.Hostname, samples)
+	}
+}
+
+// startExperiment records an experiment of the job run of c and keeps it
+// active until stop, messages of the experiment carry attrs.
+func (p *Service) startExperiment(c context.Context, job string, params interface{}) (e *model.Experiment, attrs map[string]string, stop func()) {
+	e = &model.Experiment{
+		ID:        jobRunID(c),
+		Job:       job,
+		Status:    model.ExperimentStatusRunning,
+		StartedAt: time.Now().UnixMilli(),
+	}
+	if e.ID == "" {
+		e.ID = strconv.FormatInt(gid.NewID(), 10)
+	}
+	e.Params, _ = jsoniter.Marshal(params)
+	p.d.AddExperiment(c, e)
+
+	ctx, cancel := context.WithCancel(context.WithoutCancel(c))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(_experimentActiveTTL / 3)
+		defer t.Stop()
+		for {
+			p.d.SetActiveExperiment(ctx, e.ID, _experimentActiveTTL)
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+	return e, map[string]string{attrExperiment: e.ID}, func() {
+		cancel()
+		<-done
+	}
+}
+
+// finishExperiment waits up to drainTimeout for the backlog of e to drain,
+// then records its summary.
+func (p *Service) finishExperiment(c context.Context, e *model.Experiment, drainTimeout time.Duration) {
+	e.LoadEndedAt = time.Now().UnixMilli()
+	e.Status = model.ExperimentStatusDraining
+	p.d.UpdateExperiment(c, e)
+	// the publishes of this replica are in the totals before they are read.
+	p.flushExperiments(c)
+
+	drained := false
+	deadline := time.Now().Add(drainTimeout)
+	ticker := time.NewTicker(_experimentFlush)
+	defer ticker.Stop()
+	for c.Err() == nil && time.Now().Before(deadline) {
+		published, consumed, err := p.d.ExperimentTotals(c, e.ID)
+		if err == nil {
+			if consumed >= published {
+				drained = true
+				break
+			}
+			p.reportJobProgress(c, consumed, published, fmt.Sprintf("draining backlog(%d)", published-consumed))
+		}
+		select {
+		case <-c.Done():
+		case <-ticker.C:
+		}
+	}
+
+	// the last consumes of other replicas are flushed within a second.
+	time.Sleep(_experimentFlush)
+	c = context.WithoutCancel(c)
+	e.FinishedAt = time.Now().UnixMilli()
+	e.Status = model.ExperimentStatusFinished
+	if !drained {
+		e.Status = model.ExperimentStatusAborted
+	}
+	points, err := p.d.ExperimentSeries(c, e.ID)
+	if err == nil {
+		e.Summary = summarizeExperiment(e, points, drained)
+	}
+	p.d.UpdateExperiment(c, e)
+	log.For(c).Infof("experiment(%s) job(%s) %s summary(%+v)", e.ID, e.Job, e.Status, e.Summary)
+}
+
+func summarizeExperiment(e *model.Experiment, points []*model.ExperimentPoint, drained bool) (s *model.ExperimentSummary) {
+	s = &model.ExperimentSummary{TimeToDrainMs: -1}
+	var latSum float64
+	for _, pt := range points {
+		s.Published += pt.PublishRate
+		s.Consumed += pt.ConsumeRate
+		latSum += pt.LatencyAvgMs * float64(pt.ConsumeRate)
+		if pt.Backlog > s.PeakBacklog {
+			s.PeakBacklog, s.PeakBacklogAt = pt.Backlog, pt.Time
+		}
+		if pt.PublishRate > s.PeakPublishRate {
+			s.PeakPublishRate = pt.PublishRate
+		}
+		if pt.ConsumeRate > s.PeakConsumeRate {
+			s.PeakConsumeRate = pt.ConsumeRate
+		}
+		if pt.LatencyMaxMs > s.LatencyMaxMs {
+			s.LatencyMaxMs = pt.LatencyMaxMs
+		}
+		if pt.Workers > s.MaxWorkers {
+			s.MaxWorkers = pt.Workers
+		}
+	}
+	if s.Consumed > 0 {
+		s.LatencyAvgMs = latSum / float64(s.Consumed)
+	}
+	if !drained {
+		return
+	}
+
+	// the backlog drained with the last consume.
+	drainedAt := e.LoadEndedAt
+	for _, pt := range points {
+		if pt.ConsumeRate > 0 && (pt.Time+1)*1000 > drainedAt {
+			drainedAt = (pt.Time + 1) * 1000
+		}
+	}
+	if drainedAt > e.FinishedAt {
+		drainedAt = e.FinishedAt
+	}
+	s.TimeToDrainMs = drainedAt - e.LoadEndedAt
+	return
+}
+
+func (p *Service) ListExperiments(c context.Context, arg *model.ArgExperimentList) (items []*model.Experiment, err error) {
+	limit := arg.Limit
+	if limit == 0 {
+		limit = 20
+	}
+	var ids []string
+	if ids, err = p.d.ExperimentIDs(c, arg.Offset, limit); err != nil {
+		return
+	}
+	return p.d.Experiments(c, ids)
+}
+
+func (p *Service) GetExperiment(c context.Context, id string) (item *model.Experiment, err error) {
+	var items []*model.Experiment
+	if items, err = p.d.Experiments(c, []string{id}); err != nil {
+		return
+	}
+	if len(items) == 0 {
+		err = ecode.NothingFound
+		return
+	}
+	return items[0], nil
+}
+
+// ExperimentReport returns an experiment with its time series, it grows
+// while the experiment runs.
+func (p *Service) ExperimentReport(c context.Context, id string) (ret *model.ExperimentReport, err error) {
+	ret = new(model.ExperimentReport)
+	if ret.Experiment, err = p.GetExperiment(c, id); err != nil {
+		return
+	}
+	ret.Points, err = p.d.ExperimentSeries(c, id)
+	return
+}
@@ -0,0 +1,151 @@
+package service
+
+import (
+	"ascale/app/api/model"
+	"ascale/pkg/ecode"
+	"ascale/pkg/log"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// _jobProgressInterval throttles the progress writes of a run.
+	_jobProgressInterval = time.Second
+	// _jobControlBackoff is the max wait before resubscribing to job control
+	// messages.
+	_jobControlBackoff = 30 * time.Second
+)
+
+// errJobCancelled is the cause of the context of a job run cancelled
+// through the control API.
+var errJobCancelled = errors.New("job run cancelled")
+
+// runningJob is a job run of this replica.
+type runningJob struct {
+	run    *model.JobRun
+	cancel context.CancelCauseFunc
+
+	mu       sync.Mutex
+	reported time.Time
+}
+
+type runningJobKey struct{}
+
+// trackJobRun returns the context of run, it is cancelled by the control API
+// until untrack is called.
+func (p *Service) trackJobRun(c context.Context, run *model.JobRun) (ctx context.Context, untrack func()) {
+	ctx, cancel := context.WithCancelCause(c)
+	rj := &runningJob{run: run, cancel: cancel}
+	ctx = context.WithValue(ctx, runningJobKey{}, rj)
+
+	p.runsMu.Lock()
+	p.runs[run.ID] = rj
+	p.runsMu.Unlock()
+	return ctx, func() {
+		p.runsMu.Lock()
+		delete(p.runs, run.ID)
+		p.runsMu.Unlock()
+		cancel(nil)
+	}
+}
+
+// jobRunID returns the id of the job run of c, empty outside of job runs.
+func jobRunID(c context.Context) string {
+	if rj, ok := c.Value(runningJobKey{}).(*runningJob); ok {
+		return rj.run.ID
+	}
+	return ""
+}
+
+// reportJobProgress records the progress of the job run of c, jobs call it as
+// they go. total is 0 when unknown. Writes are throttled, the one reaching
+// total always goes through.
+func (p *Service) reportJobProgress(c context.Context, done, total int64, msg string) {
+	rj, ok := c.Value(runningJobKey{}).(*runningJob)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	rj.mu.Lock()
+	if now.Sub(rj.reported) < _jobProgressInterval && (total == 0 || done < total) {
+		rj.mu.Unlock()
+		return
+	}
+	rj.reported = now
+	rj.mu.Unlock()
+
+	// the last progress is written while the run is being cancelled.
+	p.d.SetJobRunProgress(context.WithoutCancel(c), rj.run.ID, &model.JobProgress{
+		Done:      done,
+		Total:     total,
+		Message:   msg,
+		UpdatedAt: now.Unix(),
+	})
+}
+
+// CancelJobRun asks the replica running the run to cancel it, the run is
+// recorded as cancelled once the job returns.
+func (p *Service) CancelJobRun(c context.Context, id string) (item *model.JobRun, err error) {
+	if item, err = p.GetJobRun(c, id); err != nil {
+		return
+	}
+	if item.Status != model.JobRunStatusRunning {
+		err = ecode.Conflict
+		return
+	}
+
+	var n int
+	if n, err = p.d.PublishJobControl(c, &model.JobControl{Action: model.JobControlCancel, RunID: id}); err != nil {
+		return
+	}
+	log.For(c).Infof("CancelJobRun(%s) job(%s) sent to (%d) replicas", id, item.Job, n)
+	return
+}
+
+// jobcontrolproc receives the job control messages until Close.
+func (p *Service) jobcontrolproc() {
+	c, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-p.closing
+		cancel()
+	}()
+
+	backoff := time.Second
+	for c.Err() == nil {
+		start := time.Now()
+		if err := p.d.ReceiveJobControl(c, p.handleJobControl); err == nil {
+			continue
+		}
+		// a subscription which lived a while starts over.
+		if time.Since(start) > _jobControlBackoff {
+			backoff = time.Second
+		}
+		select {
+		case <-c.Done():
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > _jobControlBackoff {
+			backoff = _jobControlBackoff
+		}
+	}
+}
+
+func (p *Service) handleJobControl(msg *model.JobControl) {
+	switch msg.Action {
+	case model.JobControlCancel:
+		p.runsMu.Lock()
+		rj, ok := p.runs[msg.RunID]
+		p.runsMu.Unlock()
+		if !ok {
+			// the run is on another replica.
+			return
+		}
+		log.Infof("handleJobControl() cancel job(%s) run(%s)", rj.run.Job, msg.RunID)
+		rj.cancel(errJobCancelled)
+	default:
+		log.Warnf("handleJobControl() unknown action(%s) run(%s)", msg.Action, msg.RunID)
+	}
+}
@@ -2,35 +2,13 @@ package service
 
 import (
 	"ascale/app/api/model"
-	"ascale/pkg/def"
+	"ascale/pkg/loadgen"
 	"ascale/pkg/log"
-	"ascale/pkg/stat/prom"
-	"ascale/pkg/xtime"
 	"context"
-	"fmt"
-	"time"
-
-	"cloud.google.com/go/pubsub"
-	jsoniter "github.com/json-iterator/go"
 )
 
-func (p *Service) jobDoTask(c context.Context, msg *pubsub.Message) {
-	now := xtime.Now()
-	var err error
-	defer func() {
-		msg.Ack()
-		prom.Consumer.Timing(
-			fmt.Sprintf("consumer:%s", def.Topics.DoTask),
-			int64(time.Since(now)/time.Millisecond),
-		)
-		prom.Consumer.Incr(fmt.Sprintf("consumer:%s", def.Topics.DoTask))
-	}()
-
-	cmd := new(model.DoTaskCommand)
-	if err = jsoniter.Unmarshal(msg.Data, cmd); err != nil {
-		log.For(c).Errorf("jobSendMail error(%+v)", err)
-		return
-	}
-
+func (p *Service) jobDoTask(c context.Context, cmd *model.DoTaskCommand) (err error) {
 	log.For(c).Info("Do some small task")
+	loadgen.Work(c, cmd.WorkCost, cmd.WorkCPU)
+	return
 }
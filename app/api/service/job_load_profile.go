@@ -0,0 +1,61 @@
+package service
+
+import (
+	"ascale/app/api/model"
+	"ascale/pkg/def"
+	"ascale/pkg/loadgen"
+	"ascale/pkg/log"
+	"ascale/pkg/mq"
+	"context"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// triggerLoadProfile publishes do task messages following a load profile,
+// every task carries a simulated work cost drawn from params.Cost. The run is
+// recorded as an experiment, the job returns once its backlog drained.
+func (p *Service) triggerLoadProfile(c context.Context, params *model.LoadProfileParams) (err error) {
+	exp, attrs, stop := p.startExperiment(c, def.TriggerJob.LoadProfile, params)
+	defer stop()
+
+	var bc mq.BatchConfig
+	if p.c.MQ != nil && p.c.MQ.Batch != nil {
+		bc = *p.c.MQ.Batch
+	}
+	var failed int64
+	bc.OnError = func(env *mq.Envelope, err error) {
+		p.exp.published(exp.ID, -1)
+		if atomic.AddInt64(&failed, 1)%1000 == 1 {
+			log.For(c).Errorf("triggerLoadProfile() error(%+v)", err)
+		}
+	}
+
+	var (
+		b        = mq.NewBatcher(p.mq, def.Topics.DoTask, &bc)
+		rnd      = rand.New(rand.NewSource(time.Now().UnixNano()))
+		expected = params.Profile.Expected()
+		cmd      = &model.DoTaskCommand{Name: "do task", TriggerTime: time.Now().Unix(), WorkCPU: params.Cost.CPU}
+		sent     int64
+	)
+	loadgen.New(&params.Profile).Run(c, func() {
+		cmd.WorkCost = params.Cost.Sample(rnd)
+		data, e := jsoniter.Marshal(cmd)
+		if e != nil {
+			return
+		}
+		b.Publish(c, &mq.Envelope{Data: data, Attributes: attrs})
+		p.exp.published(exp.ID, 1)
+		sent++
+		p.reportJobProgress(c, sent, expected, "messages queued")
+	})
+	b.Stop()
+	p.reportJobProgress(c, sent, sent, fmt.Sprintf("messages sent, failed(%d)", atomic.LoadInt64(&failed)))
+
+	log.For(c).Infof("triggerLoadProfile() profile(%s) sent(%d) expected(%d) failed(%d)", params.Profile.Shape, sent, expected, atomic.LoadInt64(&failed))
+	p.finishExperiment(c, exp, time.Duration(params.DrainTimeout))
+	return
+}
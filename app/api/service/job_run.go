@@ -0,0 +1,81 @@
+package service
+
+import (
+	"ascale/app/api/model"
+	"ascale/pkg/conf/env"
+	"ascale/pkg/ecode"
+	"ascale/pkg/gid"
+	"context"
+	"strconv"
+	"time"
+)
+
+// startJobRun records a run of cmd as running, history errors never fail
+// the job.
+func (p *Service) startJobRun(c context.Context, cmd *model.TriggerCommand) (run *model.JobRun) {
+	run = &model.JobRun{
+		ID:          strconv.FormatInt(gid.NewID(), 10),
+		Job:         cmd.Job,
+		TriggerTime: cmd.TriggerTime,
+		StartedAt:   time.Now().Unix(),
+		Status:      model.JobRunStatusRunning,
+		Replica:     env.Hostname,
+	}
+	p.d.AddJobRun(c, run)
+	return
+}
+
+// finishJobRun records the result of run, a run still running succeeded
+// when err is nil.
+func (p *Service) finishJobRun(c context.Context, run *model.JobRun, err error) {
+	now := time.Now()
+	run.FinishedAt = now.Unix()
+	run.DurationMs = now.Sub(time.Unix(run.StartedAt, 0)).Milliseconds()
+	if err != nil {
+		run.Status = model.JobRunStatusFailed
+		run.Error = err.Error()
+	} else if run.Status == model.JobRunStatusRunning {
+		run.Status = model.JobRunStatusSucceeded
+	}
+
+	if p.d.UpdateJobRun(c, run) == nil && run.Status == model.JobRunStatusSucceeded {
+		p.d.SetJobLastSuccess(c, run.Job, run.ID)
+	}
+}
+
+func (p *Service) ListJobRuns(c context.Context, arg *model.ArgJobRunList) (items []*model.JobRun, err error) {
+	limit := arg.Limit
+	if limit == 0 {
+		limit = 20
+	}
+	var ids []string
+	if ids, err = p.d.JobRunIDs(c, arg.Job, arg.Offset, limit); err != nil {
+		return
+	}
+	return p.d.JobRuns(c, ids)
+}
+
+func (p *Service) GetJobRun(c context.Context, id string) (item *model.JobRun, err error) {
+	var items []*model.JobRun
+	if items, err = p.d.JobRuns(c, []string{id}); err != nil {
+		return
+	}
+	if len(items) == 0 {
+		err = ecode.NothingFound
+		return
+	}
+	return items[0], nil
+}
+
+// JobLastSuccess returns the last succeeded run of every job which has one.
+func (p *Service) JobLastSuccess(c context.Context) (items []*model.JobRun, err error) {
+	var m map[string]string
+	if m, err = p.d.JobLastSuccess(c); err != nil {
+		return
+	}
+	ids := make([]string, 0, len(m))
+	for _, id := range m {
+		ids = append(ids, id)
+	}
+	return p.d.JobRuns(c, ids)
+}
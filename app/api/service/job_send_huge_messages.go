@@ -3,29 +3,56 @@ package service
 import (
 	"ascale/app/api/model"
 	"ascale/pkg/def"
+	"ascale/pkg/log"
+	"ascale/pkg/mq"
 	"context"
+	"fmt"
+	"sync/atomic"
 	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"golang.org/x/time/rate"
 )
 
-func (p *Service) triggerSendHugeAmountMessages(c context.Context) (err error) {
-	ctx, cancel := context.WithTimeout(c, 10*time.Minute)
+func (p *Service) triggerSendHugeAmountMessages(c context.Context, params *model.SendHugeMessagesParams) (err error) {
+	ctx, cancel := context.WithTimeout(c, time.Duration(params.Duration))
 	defer cancel()
 
-	// Send a message every 10 millsecond, exit after 10 minutes
-	every := 10 * time.Millisecond
-	t := time.NewTicker(every)
-	defer t.Stop()
+	var bc mq.BatchConfig
+	if p.c.MQ != nil && p.c.MQ.Batch != nil {
+		bc = *p.c.MQ.Batch
+	}
+	var failed int64
+	bc.OnError = func(env *mq.Envelope, err error) {
+		if atomic.AddInt64(&failed, 1)%1000 == 1 {
+			log.For(c).Errorf("triggerSendHugeAmountMessages() error(%+v)", err)
+		}
+	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-time.After(every):
-			p.Publish(
-				context.Background(),
-				def.Topics.DoTask,
-				&model.DoTaskCommand{Name: "do task"},
-			)
+	// Send messages at rate, or as fast as the flow control allows, exit
+	// after duration
+	var limiter *rate.Limiter
+	if params.Rate > 0 {
+		// bursts of a hundredth of a second keep the batches full.
+		limiter = rate.NewLimiter(rate.Limit(params.Rate), params.Rate/100+1)
+	}
+	b := mq.NewBatcher(p.mq, def.Topics.DoTask, &bc)
+	var data []byte
+	if data, err = jsoniter.Marshal(&model.DoTaskCommand{Name: "do task"}); err != nil {
+		return
+	}
+	var sent int64
+	for ctx.Err() == nil {
+		if limiter != nil && limiter.Wait(ctx) != nil {
+			break
 		}
+		b.Publish(ctx, &mq.Envelope{Data: data})
+		sent++
+		p.reportJobProgress(c, sent, 0, "messages queued")
 	}
+	b.Stop()
+	p.reportJobProgress(c, sent, sent, fmt.Sprintf("messages sent, failed(%d)", atomic.LoadInt64(&failed)))
+
+	log.For(c).Infof("triggerSendHugeAmountMessages() sent(%d) failed(%d)", sent, atomic.LoadInt64(&failed))
+	return
 }
@@ -4,36 +4,113 @@ import (
 	"ascale/app/api/model"
 	"ascale/pkg/def"
 	"ascale/pkg/dlock"
+	"ascale/pkg/loadgen"
 	"ascale/pkg/log"
+	"ascale/pkg/mq"
 	"ascale/pkg/stat/prom"
 	"ascale/pkg/xtime"
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
-
-	"cloud.google.com/go/pubsub"
-	jsoniter "github.com/json-iterator/go"
 )
 
-type cronJobFunc func(c context.Context) error
+type cronJobFunc func(c context.Context, params interface{}) error
+
+// jobParams are the params of a trigger job, Validate is their schema.
+type jobParams interface {
+	Validate() error
+}
+
+// triggerJob is a registered trigger job.
+type triggerJob struct {
+	// defaults returns the params used when a trigger has none.
+	defaults func() interface{}
+	// decode returns the params of data, validated.
+	decode func(data []byte) (interface{}, error)
+	run    cronJobFunc
+}
 
 var (
 	doOnce   sync.Once
-	cronJobs map[string]cronJobFunc = make(map[string]cronJobFunc)
+	cronJobs map[string]*triggerJob = make(map[string]*triggerJob)
 )
 
-func registerTriggerJob(job string, fn cronJobFunc) {
-	cronJobs[job] = fn
+// registerTriggerJob registers fn, its params are decoded on top of the
+// defaults and validated, unknown fields are rejected.
+func registerTriggerJob[P jobParams](job string, defaults func() P, fn func(c context.Context, params P) error) {
+	cronJobs[job] = &triggerJob{
+		defaults: func() interface{} { return defaults() },
+		decode: func(data []byte) (interface{}, error) {
+			params := defaults()
+			if len(data) > 0 && string(data) != "null" {
+				dec := json.NewDecoder(bytes.NewReader(data))
+				dec.DisallowUnknownFields()
+				if err := dec.Decode(params); err != nil {
+					return nil, err
+				}
+			}
+			if err := params.Validate(); err != nil {
+				return nil, err
+			}
+			return params, nil
+		},
+		run: func(c context.Context, params interface{}) error {
+			return fn(c, params.(P))
+		},
+	}
 }
 
 func (p *Service) initialTriggerJob() {
 	doOnce.Do(func() {
-		registerTriggerJob(def.TriggerJob.CronSendLittleMessage, p.cronSendLittleMessages)
-		registerTriggerJob(def.TriggerJob.SendHugeMessage, p.triggerSendHugeAmountMessages)
+		registerTriggerJob(def.TriggerJob.CronSendLittleMessage, func() *model.SendLittleMessagesParams {
+			return &model.SendLittleMessagesParams{
+				Interval: xtime.Duration(100 * time.Millisecond),
+				Duration: xtime.Duration(time.Minute),
+			}
+		}, p.cronSendLittleMessages)
+		registerTriggerJob(def.TriggerJob.SendHugeMessage, func() *model.SendHugeMessagesParams {
+			return &model.SendHugeMessagesParams{Duration: xtime.Duration(10 * time.Minute)}
+		}, p.triggerSendHugeAmountMessages)
+		registerTriggerJob(def.TriggerJob.LoadProfile, func() *model.LoadProfileParams {
+			return &model.LoadProfileParams{
+				Profile: loadgen.Profile{
+					Shape:    loadgen.ShapeRamp,
+					Rate:     100,
+					Duration: xtime.Duration(5 * time.Minute),
+				},
+				DrainTimeout: xtime.Duration(30 * time.Minute),
+			}
+		}, p.triggerLoadProfile)
 	})
 }
 
+// decodeJobParams returns the validated params of a trigger of job.
+func decodeJobParams(job string, data []byte) (params interface{}, err error) {
+	tj, ok := cronJobs[job]
+	if !ok {
+		return nil, fmt.Errorf("job(%s) not found", job)
+	}
+	if params, err = tj.decode(data); err != nil {
+		return nil, fmt.Errorf("job(%s) params: %w", job, err)
+	}
+	return
+}
+
+// TriggerJobs returns the registered trigger jobs with their default params.
+func (p *Service) TriggerJobs(c context.Context) (items []*model.TriggerJobInfo, err error) {
+	items = make([]*model.TriggerJobInfo, 0, len(cronJobs))
+	for job, tj := range cronJobs {
+		items = append(items, &model.TriggerJobInfo{Job: job, Params: tj.defaults()})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Job < items[j].Job })
+	return
+}
+
 func (p *Service) doPublishConcurrently(
 	ctx context.Context,
 	ids []int64,
@@ -66,22 +143,18 @@ func (p *Service) doPublishConcurrently(
 	wg.Wait()
 }
 
-func (p *Service) jobTrigger(c context.Context, msg *pubsub.Message) {
-	var err error
-	cmd := new(model.TriggerCommand)
-	if err = jsoniter.Unmarshal(msg.Data, cmd); err != nil {
-		log.For(c).Errorf("jobTrigger error(%+v)", err)
-		msg.Ack()
-		return
-	}
-	log.For(c).Infof("jobTrigger.start job(%+v), trigger(%d)", cmd.Job, cmd.TriggerTime)
-	fn, ok := cronJobs[cmd.Job]
-	if !ok {
-		log.For(c).Errorf("p.jobTrigger(%s) not found.", cmd.Job)
-		msg.Ack()
-		return
+func (p *Service) jobTrigger(c context.Context, cmd *model.TriggerCommand) (err error) {
+	log.For(c).Infof("jobTrigger.start job(%+v), trigger(%d) params(%s)", cmd.Job, cmd.TriggerTime, cmd.Params)
+	run := p.startJobRun(c, cmd)
+	defer func() { p.finishJobRun(c, run, err) }()
+
+	params, err := decodeJobParams(cmd.Job, cmd.Params)
+	if err != nil {
+		// retrying will not fix the job or its params, send it to the dead
+		// letter topic.
+		return mq.Permanent(fmt.Errorf("p.jobTrigger: %w", err))
 	}
-	msg.Ack()
+	fn := cronJobs[cmd.Job].run
 
 	now := time.Now()
 	beginFun := xtime.NowUnix()
@@ -100,21 +173,50 @@ func (p *Service) jobTrigger(c context.Context, msg *pubsub.Message) {
 
 	var lock *dlock.Lock
 	if lock, err = p.dlock.Obtain(c, def.CronJobLock(cmd.Job), 30*time.Second, &dlock.Options{Context: c}); err != nil {
-		log.For(c).Errorf("obtain jobTrigger  lock failed,job (%+v) error(%+v) ", cmd.Job, err)
+		if !errors.Is(err, dlock.ErrNotObtained) {
+			// e.g. redis is down, the trigger is retried.
+			log.For(c).Errorf("obtain jobTrigger lock failed,job (%+v) error(%+v) ", cmd.Job, err)
+			return
+		}
+		// another replica runs the job.
+		log.For(c).Infof("obtain jobTrigger lock skipped,job (%+v) error(%+v) ", cmd.Job, err)
+		run.Status = model.JobRunStatusSkipped
 		err = nil
 		return
 	}
 	defer lock.Release(c)
 
-	if err = fn(c); err != nil {
+	// jobs run for minutes, keep the lock until they return. jc is cancelled
+	// if the lock is lost, another replica may run the job then.
+	jc := lock.KeepAlive(c, 30*time.Second)
+	jc, untrack := p.trackJobRun(jc, run)
+	defer untrack()
+
+	// a failed job is redelivered with backoff until it goes to the dead
+	// letter topic.
+	err = fn(jc, params)
+	switch context.Cause(jc) {
+	case errJobCancelled:
+		// cancelled on purpose, it is not retried.
+		log.For(c).Infof("p.jobTrigger(%s) run(%s) cancelled error(%v)", cmd.Job, run.ID, err)
+		run.Status = model.JobRunStatusCancelled
+		err = nil
+		return
+	case mq.ErrDrained:
+		// the replica shut down before the job was done, the message was
+		// nacked for another replica.
+		err = fmt.Errorf("%w: %v", mq.ErrDrained, err)
+	case dlock.ErrLockLost:
+		// the run was cut short, the retry is skipped if another replica
+		// runs the job meanwhile.
+		err = fmt.Errorf("%w: %v", dlock.ErrLockLost, err)
+	}
+	if err != nil {
 		log.For(c).Errorf("p.jobTrigger(%s) error(%+v)", cmd.Job, err)
-		msg.Ack()
 		return
 	}
 
 	log.For(c).Infof("jobTrigger.Ack job(%+v), trigger(%d)", cmd.Job, cmd.TriggerTime)
 
-	msg.Ack()
-
 	return
 }
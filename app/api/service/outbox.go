@@ -0,0 +1,143 @@
+package service
+
+import (
+	"ascale/app/api/model"
+	"ascale/pkg/database/sqalx"
+	"ascale/pkg/def"
+	"ascale/pkg/dlock"
+	"ascale/pkg/gid"
+	"ascale/pkg/log"
+	"ascale/pkg/mq"
+	netutil "ascale/pkg/net"
+	"ascale/pkg/xtime"
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	_outboxInterval  = time.Second
+	_outboxBatchSize = 100
+	_outboxLockTTL   = 30 * time.Second
+	// sent messages are kept a while for troubleshooting.
+	_outboxRetention = 7 * 24 * time.Hour
+	// messages failing as many times are parked until their attempts are
+	// reset by hand.
+	_outboxMaxAttempts = 50
+	// _outboxMaxErrorLen is the size of outbox_messages.last_error.
+	_outboxMaxErrorLen = 1024
+)
+
+// PublishTx writes msg to the outbox in the transaction node, it is
+// published by the outbox relay once the transaction is committed and
+// dropped with it on rollback.
+func (p *Service) PublishTx(c context.Context, node sqalx.Node, topic string, msg interface{}) (err error) {
+	return p.PublishEnvelopeTx(c, node, topic, msg, nil)
+}
+
+// PublishEnvelopeTx is PublishTx with message attributes.
+func (p *Service) PublishEnvelopeTx(c context.Context, node sqalx.Node, topic string, msg interface{}, attrs map[string]string) (err error) {
+	item := &model.OutboxMessage{
+		ID:         gid.NewID(),
+		Topic:      topic,
+		Attributes: "{}",
+		CreatedAt:  xtime.NowUnix(),
+	}
+	if item.Data, err = jsoniter.MarshalToString(msg); err != nil {
+		log.For(c).Errorf("PublishTx() error(%+v)", err)
+		return
+	}
+	if len(attrs) > 0 {
+		if item.Attributes, err = jsoniter.MarshalToString(attrs); err != nil {
+			log.For(c).Errorf("PublishTx() error(%+v)", err)
+			return
+		}
+	}
+
+	return p.d.AddOutboxMessage(c, node, item)
+}
+
+// outboxproc relays committed outbox messages to the broker. Every replica
+// runs it, the dlock keeps a single one draining at a time.
+func (p *Service) outboxproc() {
+	ticker := time.NewTicker(_outboxInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closing:
+			return
+		case <-ticker.C:
+		}
+		p.relayOutbox(context.Background())
+	}
+}
+
+func (p *Service) relayOutbox(c context.Context) {
+	lock, err := p.dlock.Obtain(c, def.OutboxRelayLock, _outboxLockTTL, nil)
+	if err != nil {
+		if err != dlock.ErrNotObtained {
+			log.For(c).Errorf("relayOutbox() obtain lock error(%+v)", err)
+		}
+		return
+	}
+	defer lock.Release(c)
+	// lc is cancelled once the lock is lost, another relay may be sending
+	// the same messages then.
+	lc := lock.KeepAlive(c, _outboxLockTTL)
+
+	for {
+		var items []*model.OutboxMessage
+		if items, err = p.d.GetUnsentOutboxMessages(lc, p.d.DB(), xtime.NowUnix(), _outboxMaxAttempts, _outboxBatchSize); err != nil {
+			return
+		}
+		// failed messages back off, they are not selected again right away.
+		for _, v := range items {
+			if lc.Err() != nil {
+				log.For(c).Warnf("relayOutbox() lock lost error(%+v)", context.Cause(lc))
+				return
+			}
+			p.relayOutboxMessage(lc, v)
+		}
+		if len(items) < _outboxBatchSize {
+			break
+		}
+	}
+
+	before := time.Now().Add(-_outboxRetention).Unix()
+	p.d.DelSentOutboxMessages(c, p.d.DB(), before, _outboxBatchSize*10)
+}
+
+func (p *Service) relayOutboxMessage(c context.Context, item *model.OutboxMessage) {
+	env := &mq.Envelope{Data: []byte(item.Data)}
+	if err := jsoniter.UnmarshalFromString(item.Attributes, &env.Attributes); err != nil {
+		log.For(c).Errorf("relayOutboxMessage(%d) attributes(%s) error(%+v)", item.ID, item.Attributes, err)
+	}
+	if env.Attributes == nil {
+		env.Attributes = make(map[string]string, 1)
+	}
+	if _, ok := env.Attributes[mq.AttrIdempotencyKey]; !ok {
+		env.Attributes[mq.AttrIdempotencyKey] = strconv.FormatInt(item.ID, 10)
+	}
+
+	if _, err := p.mq.Publish(c, item.Topic, env); err != nil {
+		attempts := item.Attempts + 1
+		log.For(c).Errorf("relayOutboxMessage(%d) topic(%s) attempts(%d) error(%+v)", item.ID, item.Topic, attempts, err)
+		if attempts >= _outboxMaxAttempts {
+			log.For(c).Errorf("relayOutboxMessage(%d) topic(%s) parked after %d attempts", item.ID, item.Topic, attempts)
+		}
+		next := time.Now().Add(netutil.DefaultBackoffConfig.Backoff(item.Attempts)).Unix()
+		lastError := err.Error()
+		if len(lastError) > _outboxMaxErrorLen {
+			lastError = strings.ToValidUTF8(lastError[:_outboxMaxErrorLen], "")
+		}
+		p.d.UpdateOutboxMessageError(c, p.d.DB(), item.ID, lastError, next)
+		return
+	}
+
+	// the message is published again when the update fails, consumers using
+	// mq.Dedup skip it by the idempotency key.
+	p.d.MarkOutboxMessageSent(c, p.d.DB(), item.ID, xtime.NowUnix())
+}
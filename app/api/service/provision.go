@@ -0,0 +1,118 @@
+package service
+
+import (
+	"ascale/pkg/def"
+	"ascale/pkg/log"
+	"ascale/pkg/mq"
+	netutil "ascale/pkg/net"
+	"context"
+	"sort"
+	"time"
+)
+
+// declaredTopics returns the topics declared in the config.
+func (p *Service) declaredTopics() (topics []string) {
+	if p.c.MQ == nil {
+		return
+	}
+	for _, name := range p.c.MQ.Topics {
+		topics = append(topics, def.TopicName(name))
+	}
+	return
+}
+
+// declaredSubscriptions returns the subscriptions declared in the config by
+// topic, new configs on every call.
+func (p *Service) declaredSubscriptions() map[string]*mq.SubscriptionConfig {
+	cfgs := make(map[string]*mq.SubscriptionConfig)
+	if p.c.MQ == nil {
+		return cfgs
+	}
+	for _, s := range p.c.MQ.Subscriptions {
+		cfg := &mq.SubscriptionConfig{
+			Topic:                  def.TopicName(s.Topic),
+			Name:                   s.Name,
+			AckDeadline:            time.Duration(s.AckDeadline),
+			Retention:              time.Duration(s.Retention),
+			Filter:                 s.Filter,
+			MaxOutstandingMessages: s.MaxOutstandingMessages,
+			Ordered:                s.Ordered,
+		}
+		if s.DeadLetterTopic != "" {
+			cfg.DeadLetterPolicy = &mq.DeadLetterPolicy{
+				Topic:               def.TopicName(s.DeadLetterTopic),
+				MaxDeliveryAttempts: s.MaxDeliveryAttempts,
+			}
+		}
+		if rp := s.RetryPolicy; rp != nil {
+			cfg.RetryPolicy = &mq.RetryPolicy{
+				MinimumBackoff: time.Duration(rp.MinimumBackoff),
+				MaximumBackoff: time.Duration(rp.MaximumBackoff),
+			}
+		}
+		cfgs[cfg.Topic] = cfg
+	}
+	return cfgs
+}
+
+// subscriptionConfig returns the declared subscription of topic, the broker
+// defaults are used for undeclared ones.
+func (p *Service) subscriptionConfig(cfgs map[string]*mq.SubscriptionConfig, topic string) *mq.SubscriptionConfig {
+	if cfg, ok := cfgs[topic]; ok {
+		return cfg
+	}
+	log.Warnf("subscription topic(%s) not declared, broker defaults used", topic)
+	return &mq.SubscriptionConfig{Topic: topic}
+}
+
+// provisionproc creates the declared topics and subscriptions, corrects the
+// drift of the existing ones or reports it, it retries with backoff until it
+// succeeds or Close.
+func (p *Service) provisionproc() {
+	backoff := netutil.DefaultBackoffConfig
+	for retries := 0; ; retries++ {
+		if err := p.provision(context.Background()); err == nil {
+			return
+		}
+		select {
+		case <-p.closing:
+			return
+		case <-time.After(backoff.Backoff(retries)):
+		}
+	}
+}
+
+func (p *Service) provision(c context.Context) (err error) {
+	var cfgs []*mq.SubscriptionConfig
+	for _, cfg := range p.declaredSubscriptions() {
+		cfgs = append(cfgs, cfg)
+	}
+	sort.Slice(cfgs, func(i, j int) bool { return cfgs[i].Topic < cfgs[j].Topic })
+	var drifts []*mq.Drift
+	if drifts, err = mq.Provision(c, p.mq, p.declaredTopics(), cfgs); err != nil {
+		log.For(c).Errorf("provision() error(%+v)", err)
+		return
+	}
+	for _, d := range drifts {
+		if d.Corrected {
+			log.For(c).Infof("provision() drift %s", d)
+			continue
+		}
+		log.For(c).Warnf("provision() drift %s", d)
+	}
+	p.driftMu.Lock()
+	p.drifts = drifts
+	p.driftMu.Unlock()
+	return
+}
+
+// Drifts returns how the subscriptions drifted from their declaration when
+// they were provisioned.
+func (p *Service) Drifts(c context.Context) (drifts []*mq.Drift, err error) {
+	p.driftMu.Lock()
+	defer p.driftMu.Unlock()
+	if drifts = p.drifts; drifts == nil {
+		drifts = make([]*mq.Drift, 0)
+	}
+	return
+}
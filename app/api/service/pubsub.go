@@ -3,58 +3,37 @@ package service
 import (
 	"ascale/pkg/def"
 	"ascale/pkg/log"
-	"ascale/pkg/stat/prom"
-	"ascale/pkg/xtime"
+	"ascale/pkg/mq"
+	mqredis "ascale/pkg/mq/redis"
+	netutil "ascale/pkg/net"
+	"ascale/pkg/stat/sys/cpu"
 	"context"
-	"fmt"
-	"reflect"
-	"time"
 
-	"cloud.google.com/go/pubsub"
 	jsoniter "github.com/json-iterator/go"
 )
 
-func (p *Service) EnsureTopic(ctx context.Context, topic string) (*pubsub.Topic, error) {
-	ret := p.pubsub.Topic(topic)
-	exists, err := ret.Exists(ctx)
-	if err != nil {
-		return nil, err
-	}
-	if !exists {
-		return p.pubsub.CreateTopic(ctx, topic)
-	}
-	return ret, nil
+// _maxDeliveryAttempts is the minimum pubsub accepts for dead letter policies.
+const _maxDeliveryAttempts = 5
+
+func (p *Service) EnsureTopic(ctx context.Context, topic string) error {
+	return p.mq.EnsureTopic(ctx, topic)
 }
 
 func (p *Service) EnsureSubscription(
 	ctx context.Context,
 	topic string,
-	deadleterPolicy *pubsub.DeadLetterPolicy,
-) (*pubsub.Subscription, error) {
-	// hostname := env.GetHostname()
-
-	subID := fmt.Sprintf("%s.sub.%s", topic, "ascale")
-	ret := p.pubsub.Subscription(subID)
-	exists, err := ret.Exists(ctx)
-	if err != nil {
-		return nil, err
-	}
-	if !exists {
-		cfg := pubsub.SubscriptionConfig{
-			Topic: p.pubsub.Topic(topic),
-		}
-		if deadleterPolicy != nil {
-			cfg.DeadLetterPolicy = deadleterPolicy
-		}
-		return p.pubsub.CreateSubscription(ctx, subID, cfg)
-	}
-	return ret, nil
+	deadleterPolicy *mq.DeadLetterPolicy,
+) error {
+	return p.mq.EnsureSubscription(ctx, &mq.SubscriptionConfig{
+		Topic:            topic,
+		DeadLetterPolicy: deadleterPolicy,
+	})
 }
 
 // CleanupTopic deletes a topic with all subscriptions and logs any
 // error. Useful for defer.
-func (p *Service) CleanupTopic(ctx context.Context, project, topic string) {
-	if err := p.pubsub.Topic(topic).Delete(ctx); err != nil {
+func (p *Service) CleanupTopic(ctx context.Context, topic string) {
+	if err := p.mq.DeleteTopic(ctx, topic); err != nil {
 		log.For(ctx).Errorf("Failed to delete topic %v: %v", topic, err)
 	}
 }
@@ -62,103 +41,90 @@ func (p *Service) CleanupTopic(ctx context.Context, project, topic string) {
 // Publish is a simple utility for publishing a set of string messages
 // serially to a pubsub topic. Small scale use only.
 func (p *Service) Publish(ctx context.Context, topic string, msg interface{}) (err error) {
-	// t, err := p.EnsureTopic(ctx, topic)
-	// if err != nil {
-	// 	log.For(ctx).Errorf("Publish() error(%+v)", err)
-	// 	return err
-	// }
+	return p.publish(ctx, topic, msg, nil)
+}
+
+// PublishOrdered publishes msg with an ordering key, subscriptions with
+// Ordered set handle the messages of a key one at a time in order, e.g. keyed
+// by doctor id. msg is not ordered when key is empty.
+func (p *Service) PublishOrdered(ctx context.Context, topic, key string, msg interface{}) (err error) {
+	if key == "" {
+		return p.publish(ctx, topic, msg, nil)
+	}
+	return p.publish(ctx, topic, msg, map[string]string{mq.AttrOrderingKey: key})
+}
+
+func (p *Service) publish(ctx context.Context, topic string, msg interface{}, attrs map[string]string) (err error) {
 	var data []byte
 	if data, err = jsoniter.Marshal(msg); err != nil {
 		log.For(ctx).Errorf("Publish() error(%+v)", err)
 		return
 	}
 
-	_, err = p.pubsub.Topic(topic).Publish(ctx, &pubsub.Message{
-		Data: data,
-	}).Get(ctx)
-
-	if err != nil {
+	if _, err = p.mq.Publish(ctx, topic, &mq.Envelope{Data: data, Attributes: attrs}); err != nil {
 		log.For(ctx).Errorf("Publish() topic(%s) msg(%+v) error(%+v)", topic, msg, err)
 		return
 	}
 	return
 }
 
-func (p *Service) getAllTopics() []string {
-	t := reflect.ValueOf(def.Topics)
-	names := make([]string, t.NumField())
-	for i := range names {
-		names[i] = t.Field(i).String()
-	}
-
-	return names
-}
-
 func (p *Service) subscriptions() {
-	ctx := context.Background()
-	var err error
-
-	topics := p.getAllTopics()
-
-	for _, v := range topics {
-		if _, err = p.EnsureTopic(ctx, v); err != nil {
-			log.Fatalf("subscription topic(%s)  error(%+v)", v, err)
-		}
-	}
-
-	createSubscription := func(c context.Context, topic string, maxOutstandingMessages int, deadPolicy *pubsub.DeadLetterPolicy, task func(ctx context.Context, msg *pubsub.Message)) {
-		go func() {
-			sub, err := p.EnsureSubscription(c, topic, deadPolicy)
-			if err != nil {
-				log.Fatalf("subscription topic(%s)  error(%+v)", topic, err)
-			}
-
-			sub.ReceiveSettings.Synchronous = true
-			sub.ReceiveSettings.MaxOutstandingMessages = maxOutstandingMessages
-			sub.ReceiveSettings.MaxOutstandingBytes = 1e10
-
-			i := 0
-			for {
-				time.Sleep(time.Second * 2)
-				if err = sub.Receive(c, task); err != nil {
-					log.For(c).Errorf("subscription topic Receive (%s) error(%+v)", topic, err)
-					i++
-					if i > 10 {
-						log.Fatalf("subscription topic(%s) Receive  error(%+v)", topic, err)
-					}
-				}
-			}
-		}()
+	// the broker counts delivery attempts only with a dead letter policy,
+	// the router dead letters at the attempt of the policy with the failure
+	// attached. Permanent failures of the others go to DeadLetter.
+	cfgs := p.declaredSubscriptions()
+	backoff := netutil.DefaultBackoffConfig
+	r := mq.NewRouter(p.mq, &mq.RouterConfig{
+		DeadLetter:          def.Topics.DeadLetter,
+		MaxDeliveryAttempts: _maxDeliveryAttempts,
+		Backoff:             &backoff,
+	})
+
+	mq.Handle(r, p.subscriptionConfig(cfgs, def.Topics.Trigger), p.jobTrigger, p.loadMiddleware)
+
+	// tasks redelivered after they were done, e.g. acks lost on scale down,
+	// are skipped. Tasks of load experiments are recorded once handled. The
+	// load of every subscription is measured for the scaler.
+	dedup := mq.Dedup(&mq.DedupConfig{Store: mqredis.NewDedupStore(p.d.Redis(), "")})
+	taskCfg := p.subscriptionConfig(cfgs, def.Topics.DoTask)
+	mq.Handle(r, taskCfg, p.jobDoTask, p.loadMiddleware, dedup, p.experimentMiddleware)
+
+	// tasks without an ordering key are handled concurrently, as many as the
+	// worker handles without slowing them down or overloading its cpu.
+	var adaptive *mq.Adaptive
+	if p.c.MQ != nil && p.c.MQ.Concurrency != nil {
+		adaptive = mq.NewAdaptive(taskCfg, p.c.MQ.Concurrency, cpuUsage)
+		p.goproc(func() {
+			<-p.closing
+			adaptive.Close()
+		})
 	}
 
-	// deadPolicy := &pubsub.DeadLetterPolicy{
-	// 	DeadLetterTopic: fmt.Sprintf(
-	// 		"projects/%s/topics/%s",
-	// 		env.ProjectID,
-	// 		def.Topics.DeadLetter,
-	// 	),
-	// 	MaxDeliveryAttempts: 5,
-	// }
-
-	createSubscription(ctx, def.Topics.Trigger, 1, nil, p.jobTrigger)
-
-	createSubscription(ctx, def.Topics.DoTask, 1, nil, p.jobDoTask)
-
 	// DeadLetter
-	createSubscription(ctx, def.Topics.DeadLetter, 1, nil, p.logDeadLetter)
+	r.HandleRaw(p.subscriptionConfig(cfgs, def.Topics.DeadLetter), p.logDeadLetter, p.loadMiddleware)
+
+	// receiving stops once Close starts draining, the handlers in flight
+	// are waited for. Failing subscriptions are restarted with backoff.
+	rc := p.drain.Context()
+	for _, rt := range r.Routes() {
+		task := p.drain.Wrap(rt.Config, rt.Handler)
+		// the drivers pull tasks only while the limit has a free slot, the
+		// handling time of the tasks moves the limit.
+		if rt.Config == taskCfg && adaptive != nil {
+			task = adaptive.Wrap(task)
+		}
+		p.sup.Go(rc, rt.Config, task)
+	}
 }
 
-func (p *Service) logDeadLetter(c context.Context, msg *pubsub.Message) {
-	now := xtime.Now()
-
-	defer func() {
-		prom.Consumer.Timing(
-			fmt.Sprintf("consumer:%s", def.Topics.DeadLetter),
-			int64(time.Since(now)/time.Millisecond),
-		)
-		prom.Consumer.Incr(fmt.Sprintf("consumer:%s", def.Topics.DeadLetter))
-	}()
+// SubscriptionHealth returns the health of the subscriptions of a worker.
+func (p *Service) SubscriptionHealth() []*mq.SubscriptionHealth {
+	return p.sup.Health()
+}
 
-	log.For(c).Errorf("DeadLetter, data(%s)", string(msg.Data))
-	msg.Ack()
+// cpuUsage returns the cpu usage of the worker in per mille of its quota.
+func cpuUsage() uint64 {
+	var stat cpu.Stat
+	cpu.ReadStat(&stat)
+	return stat.Usage
 }
@@ -0,0 +1,252 @@
+package service
+
+import (
+	"ascale/app/api/model"
+	"ascale/pkg/conf/env"
+	"ascale/pkg/keda"
+	"ascale/pkg/log"
+	"ascale/pkg/mq"
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	_topicLoadFlush = time.Second
+	// _topicLoadStale drops the load of replicas which stopped reporting.
+	_topicLoadStale = 10 * time.Second
+	// _latencyWeight is the weight of a message in the latency average.
+	_latencyWeight = 0.1
+)
+
+// topicMeter is the load of a topic on this replica, handled, published and
+// settled are counted since the last flush.
+type topicMeter struct {
+	inflight  int64
+	handled   int64
+	latencyMs float64
+	published int64
+	settled   int64
+}
+
+// loadMeter measures the load of the topics on this replica, the scaler sums
+// it over the replicas. Messages published and settled are counted only
+// when the broker does not report the backlog.
+type loadMeter struct {
+	counted bool
+
+	mu     sync.Mutex
+	topics map[string]*topicMeter
+}
+
+func newLoadMeter(counted bool) *loadMeter {
+	return &loadMeter{counted: counted, topics: make(map[string]*topicMeter)}
+}
+
+func (m *loadMeter) topic(name string) *topicMeter {
+	t, ok := m.topics[name]
+	if !ok {
+		t = new(topicMeter)
+		m.topics[name] = t
+	}
+	return t
+}
+
+func (m *loadMeter) published(topic string, n int64) {
+	if !m.counted || n == 0 {
+		return
+	}
+	m.mu.Lock()
+	m.topic(topic).published += n
+	m.mu.Unlock()
+}
+
+func (m *loadMeter) start(topic string) {
+	m.mu.Lock()
+	m.topic(topic).inflight++
+	m.mu.Unlock()
+}
+
+func (m *loadMeter) done(topic string, d time.Duration, settled bool) {
+	ms := float64(d) / float64(time.Millisecond)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := m.topic(topic)
+	t.inflight--
+	t.handled++
+	if t.latencyMs == 0 {
+		t.latencyMs = ms
+	} else {
+		t.latencyMs += _latencyWeight * (ms - t.latencyMs)
+	}
+	if settled && m.counted {
+		t.settled++
+	}
+}
+
+// take returns the load of every topic seen so far and resets the counts.
+func (m *loadMeter) take(now time.Time) map[string]*model.TopicLoad {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	loads := make(map[string]*model.TopicLoad, len(m.topics))
+	for name, t := range m.topics {
+		loads[name] = &model.TopicLoad{
+			InFlight:  t.inflight,
+			Handled:   t.handled,
+			LatencyMs: t.latencyMs,
+			UpdatedAt: now.UnixMilli(),
+			Published: t.published,
+			Settled:   t.settled,
+		}
+		t.handled, t.published, t.settled = 0, 0, 0
+	}
+	return loads
+}
+
+// meteredBroker counts the messages published through it.
+type meteredBroker struct {
+	mq.Broker
+	m *loadMeter
+}
+
+var _ mq.BatchPublisher = (*meteredBroker)(nil)
+
+func (b *meteredBroker) Publish(c context.Context, topic string, env *mq.Envelope) (id string, err error) {
+	if id, err = b.Broker.Publish(c, topic, env); err == nil {
+		b.m.published(topic, 1)
+	}
+	return
+}
+
+func (b *meteredBroker) PublishBatch(c context.Context, topic string, envs []*mq.Envelope) (ids []string, errs []error) {
+	if bp, ok := b.Broker.(mq.BatchPublisher); ok {
+		ids, errs = bp.PublishBatch(c, topic, envs)
+	} else {
+		ids, errs = make([]string, len(envs)), make([]error, len(envs))
+		for i, env := range envs {
+			ids[i], errs[i] = b.Broker.Publish(c, topic, env)
+		}
+	}
+	var n int64
+	for _, err := range errs {
+		if err == nil {
+			n++
+		}
+	}
+	b.m.published(topic, n)
+	return
+}
+
+// loadMiddleware measures the messages in flight and the time to handle
+// them. Messages are settled when the router acks them, on success and when
+// they are dead lettered.
+func (p *Service) loadMiddleware(cfg *mq.SubscriptionConfig, next mq.HandlerFunc) mq.HandlerFunc {
+	maxAttempts := _maxDeliveryAttempts
+	if dp := cfg.DeadLetterPolicy; dp != nil {
+		maxAttempts = dp.MaxDeliveryAttempts
+	}
+	return func(c context.Context, msg mq.Message) (err error) {
+		start := time.Now()
+		p.load.start(cfg.Topic)
+		defer func() {
+			settled := err == nil || mq.IsPermanent(err) || (maxAttempts > 0 && msg.DeliveryAttempt() >= maxAttempts)
+			p.load.done(cfg.Topic, time.Since(start), settled)
+		}()
+		return next(c, msg)
+	}
+}
+
+// loadproc reports the load of this replica every second until Close.
+func (p *Service) loadproc() {
+	ticker := time.NewTicker(_topicLoadFlush)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closing:
+			p.flushLoad(context.Background())
+			return
+		case <-ticker.C:
+		}
+		p.flushLoad(context.Background())
+	}
+}
+
+func (p *Service) flushLoad(c context.Context) {
+	if loads := p.load.take(time.Now()); len(loads) > 0 {
+		p.d.SetTopicLoads(c, env.Hostname, loads)
+	}
+}
+
+// TopicLoad returns the load of a topic over the replicas. The backlog is
+// the one of the broker, or the messages published and not settled yet for
+// brokers which do not report it.
+func (p *Service) TopicLoad(c context.Context, topic string) (l *keda.Load, err error) {
+	var (
+		loads              map[string]*model.TopicLoad
+		published, settled int64
+	)
+	if loads, published, settled, err = p.d.TopicLoads(c, topic); err != nil {
+		return
+	}
+
+	l = new(keda.Load)
+	var (
+		now              = time.Now()
+		stale            []string
+		weighted, weight float64
+		idle             float64
+	)
+	for replica, rl := range loads {
+		if now.Sub(time.UnixMilli(rl.UpdatedAt)) > _topicLoadStale {
+			stale = append(stale, replica)
+			continue
+		}
+		l.InFlight += rl.InFlight
+		if rl.Handled > 0 {
+			weighted += rl.LatencyMs * float64(rl.Handled)
+			weight += float64(rl.Handled)
+		} else if rl.LatencyMs > idle {
+			idle = rl.LatencyMs
+		}
+	}
+	if len(stale) > 0 {
+		p.d.DelTopicLoads(c, topic, stale...)
+	}
+	// replicas which handled nothing lately keep their last latency.
+	latency := idle
+	if weight > 0 {
+		latency = weighted / weight
+	}
+	l.Latency = time.Duration(latency * float64(time.Millisecond))
+
+	if bl, ok := p.mq.(mq.Backlogger); ok {
+		// the subscription the route of topic receives from, declared ones
+		// may be named.
+		cfg, ok := p.declaredSubscriptions()[topic]
+		if !ok {
+			cfg = &mq.SubscriptionConfig{Topic: topic}
+		}
+		if l.Backlog, err = bl.Backlog(c, cfg); err != nil {
+			log.For(c).Errorf("TopicLoad(%s) Backlog error(%+v)", topic, err)
+			return nil, err
+		}
+	} else {
+		l.Backlog = published - settled
+	}
+	// backlogs count the messages in flight too.
+	if l.Backlog -= l.InFlight; l.Backlog < 0 {
+		l.Backlog = 0
+	}
+	return
+}
+
+// startScaler serves the KEDA external scaler of the topic loads.
+func (p *Service) startScaler() {
+	if p.c.Scaler == nil || !p.c.Scaler.Enabled {
+		return
+	}
+	p.scaler = keda.New(p.c.Scaler, p)
+	if err := p.scaler.Start(); err != nil {
+		log.Fatalf("startScaler() error(%+v)", err)
+	}
+}
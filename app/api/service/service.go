@@ -4,65 +4,193 @@ import (
 	"ascale/app/api/conf"
 	"ascale/app/api/dao"
 	"ascale/pkg/conf/env"
+	"ascale/pkg/cron"
 	"ascale/pkg/dlock"
+	"ascale/pkg/keda"
 	"ascale/pkg/log"
+	"ascale/pkg/mq"
+	"ascale/pkg/mq/memory"
+	"ascale/pkg/mq/pubsub"
+	mqredis "ascale/pkg/mq/redis"
 	"context"
+	"fmt"
 	"runtime"
-
-	"cloud.google.com/go/pubsub"
-	"google.golang.org/api/option"
-	"google.golang.org/grpc"
+	"sync"
+	"time"
 )
 
+// _drainTimeout is the default wait for the messages in flight on Close.
+const _drainTimeout = 20 * time.Second
+
 // Service struct of service
 type Service struct {
 	c      *conf.Config
 	d      *dao.Dao
 	missch chan func()
 	dlock  *dlock.Client
-	pubsub *pubsub.Client
+	mq     mq.Broker
+	drain  *mq.Drainer
+	sup    *mq.Supervisor
+	cron   *cron.Scheduler
+	load   *loadMeter
+	scaler *keda.Server
+
+	// runs are the job runs of this replica by id.
+	runsMu sync.Mutex
+	runs   map[string]*runningJob
+	exp    *experimentRecorder
+
+	// drifts of the subscriptions from their declaration.
+	driftMu sync.Mutex
+	drifts  []*mq.Drift
+
+	closing chan struct{}
+	// procs are the background loops which stop on closing.
+	procs sync.WaitGroup
 }
 
 // New create new service
 func New(c *conf.Config) (s *Service) {
 	s = &Service{
-		c:      c,
-		d:      dao.New(c),
-		missch: make(chan func(), 1024*4),
+		c:       c,
+		d:       dao.New(c),
+		missch:  make(chan func(), 1024*4),
+		runs:    make(map[string]*runningJob),
+		exp:     newExperimentRecorder(),
+		drain:   mq.NewDrainer(),
+		closing: make(chan struct{}),
 	}
-	s.dlock = dlock.New(s.d.Redis())
-	var err error
-	if env.DeployEnv != env.DeployEnvDev && env.PubsubEndpoint == "" {
-		if s.pubsub, err = pubsub.NewClient(context.Background(), env.ProjectID); err != nil {
-			log.Fatalf("pubsub.NewClient error(%+v)", err)
-		}
+	if pools := s.d.Redlock(); len(pools) > 0 {
+		s.dlock = dlock.NewRedlock(pools...)
 	} else {
-		options := []option.ClientOption{
-			option.WithEndpoint("localhost:8080"),
-			option.WithoutAuthentication(),
-			option.WithGRPCDialOption(grpc.WithInsecure()),
-		}
-
-		if s.pubsub, err = pubsub.NewClient(context.Background(), env.ProjectID, options...); err != nil {
-			log.Fatalf("pubsub.NewClient error(%+v)", err)
-		}
+		s.dlock = dlock.New(s.d.Redis())
 	}
+	var err error
+	if s.mq, err = s.newBroker(); err != nil {
+		log.Fatalf("newBroker() error(%+v)", err)
+	}
+	// the backlog of brokers which do not report it is counted.
+	_, backlog := s.mq.(mq.Backlogger)
+	s.load = newLoadMeter(!backlog)
+	if !backlog {
+		s.mq = &meteredBroker{Broker: s.mq, m: s.load}
+	}
+	var sc *mq.SupervisorConfig
+	if s.c.MQ != nil {
+		sc = s.c.MQ.Supervisor
+	}
+	s.sup = mq.NewSupervisor(s.mq, sc)
 
+	s.goproc(s.provisionproc)
 	s.startSubscriptions()
 	s.initialTriggerJob()
+	s.startCron()
 	go s.cacheproc()
+	s.goproc(s.outboxproc)
+	s.goproc(s.loadproc)
 	return
 }
 
+// NewTool creates a service with only the dao and the broker for the
+// command line tools, no background loop is started. The memory driver is
+// refused, its messages would be lost when the tool exits.
+func NewTool(c *conf.Config) (s *Service, err error) {
+	s = &Service{
+		c:       c,
+		d:       dao.New(c),
+		drain:   mq.NewDrainer(),
+		closing: make(chan struct{}),
+	}
+	if c.MQ != nil && c.MQ.Driver == "memory" {
+		err = fmt.Errorf("mq driver(%s) does not outlive the tool", c.MQ.Driver)
+	} else {
+		s.mq, err = s.newBroker()
+	}
+	if err != nil {
+		s.d.Close(context.Background())
+		return nil, err
+	}
+	s.sup = mq.NewSupervisor(s.mq, nil)
+	return
+}
+
+// goproc runs fn in the background, Close waits for it after closing.
+func (s *Service) goproc(fn func()) {
+	s.procs.Add(1)
+	go func() {
+		defer s.procs.Done()
+		fn()
+	}()
+}
+
+func (s *Service) newBroker() (b mq.Broker, err error) {
+	mc := s.c.MQ
+	if mc == nil {
+		mc = &conf.MQ{}
+	}
+
+	switch mc.Driver {
+	case "redis":
+		return mqredis.New(s.d.Redis(), mc.Redis), nil
+	case "memory":
+		return memory.New(), nil
+	case "", "pubsub":
+		psc := &pubsub.Config{ProjectID: env.ProjectID, Endpoint: env.PubsubEndpoint}
+		if env.DeployEnv == env.DeployEnvDev && psc.Endpoint == "" {
+			psc.Endpoint = "localhost:8080"
+		}
+		if b, err = pubsub.New(context.Background(), psc); err != nil {
+			err = fmt.Errorf("pubsub.New: %w", err)
+		}
+		return
+	default:
+		return nil, fmt.Errorf("unknown mq driver(%s)", mc.Driver)
+	}
+}
+
 // Ping check server ok.
 func (s *Service) Ping(c context.Context) (err error) {
 	return s.d.Ping(c)
 }
 
-// Close dao.
+// Close shuts the service down in order: no more jobs are scheduled and no
+// more messages received, the messages in flight are waited for up to the
+// drain timeout and nacked after it, the subscriptions are waited for up to
+// the same deadline, then the background loops, the broker and the dao are
+// closed.
 func (s *Service) Close(ctx context.Context) {
+	if s.scaler != nil {
+		s.scaler.Close()
+	}
+	if s.cron != nil {
+		s.cron.Close()
+	}
+
+	timeout := _drainTimeout
+	if s.c.MQ != nil && s.c.MQ.DrainTimeout > 0 {
+		timeout = time.Duration(s.c.MQ.DrainTimeout)
+	}
+	dc, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	drained, abandoned := s.drain.Drain(dc)
+	log.Infof("Close() drained(%d) abandoned(%d) messages", drained, abandoned)
+	// drivers wait for their handlers before Receive returns, a stuck
+	// handler must not hang shutdown.
+	stopped := make(chan struct{})
+	go func() {
+		s.sup.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-dc.Done():
+		log.Errorf("Close() subscriptions not stopped after drain timeout(%s)", timeout)
+	}
+
+	close(s.closing)
+	s.procs.Wait()
+	s.mq.Close()
 	s.d.Close(ctx)
-	s.pubsub.Close()
 }
 
 func (s *Service) addCache(f func()) {
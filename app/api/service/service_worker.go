@@ -5,4 +5,7 @@ package service
 
 func (s *Service) startSubscriptions() {
 	go s.subscriptions()
+	s.goproc(s.jobcontrolproc)
+	s.goproc(s.experimentproc)
+	s.startScaler()
 }
@@ -3,38 +3,54 @@ package service
 import (
 	"ascale/app/api/model"
 	"ascale/pkg/def"
+	"ascale/pkg/ecode"
+	"ascale/pkg/log"
 	"ascale/pkg/xtime"
 	"context"
+	"encoding/json"
 	"time"
 )
 
-func (p *Service) cronSendLittleMessages(c context.Context) (err error) {
-	ctx, cancel := context.WithTimeout(c, 1*time.Minute)
+func (p *Service) cronSendLittleMessages(c context.Context, params *model.SendLittleMessagesParams) (err error) {
+	duration := time.Duration(params.Duration)
+	ctx, cancel := context.WithTimeout(c, duration)
 	defer cancel()
 
-	// Send a message every 100 millsecond, exit after 1 minutes
-	every := 100 * time.Millisecond
+	// Send a message every interval, exit after duration
+	every := time.Duration(params.Interval)
 	t := time.NewTicker(every)
 	defer t.Stop()
 
-	for {
+	// load tasks have no ordering key, they are handled as concurrently as
+	// the workers may.
+	total := int64(duration / every)
+	for sent := int64(0); ; {
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(every):
+		case <-t.C:
 			p.Publish(
-				context.Background(),
+				c,
 				def.Topics.DoTask,
 				&model.DoTaskCommand{Name: "do task"},
 			)
+			sent++
+			p.reportJobProgress(c, sent, total, "messages sent")
 		}
 	}
 }
 
-func (p *Service) TriggerJob(c context.Context, job string) (err error) {
+// TriggerJob publishes a trigger of job, params are checked against the
+// schema of the job before.
+func (p *Service) TriggerJob(c context.Context, job string, params json.RawMessage) (err error) {
+	if _, err = decodeJobParams(job, params); err != nil {
+		log.For(c).Warnf("TriggerJob() error(%+v)", err)
+		return ecode.NewCustomMessageCode(ecode.RequestErr, err.Error())
+	}
+
 	return p.Publish(
 		c,
 		def.Topics.Trigger,
-		&model.TriggerCommand{Job: job, TriggerTime: xtime.Now().Unix()},
+		&model.TriggerCommand{Job: job, TriggerTime: xtime.Now().Unix(), Params: params},
 	)
 }
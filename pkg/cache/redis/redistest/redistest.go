@@ -0,0 +1,89 @@
+// Package redistest provides the redis-server of tests, an in-process
+// miniredis unless an address is given with -redistest-address, e.g. the
+// redis service of the CI.
+package redistest
+
+import (
+	"ascale/pkg/cache/redis"
+	"ascale/pkg/xtime"
+	"flag"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// _tick is how often the clock of miniredis follows the wall clock.
+const _tick = 10 * time.Millisecond
+
+var addr = flag.String("redistest-address", "", "address of the redis-server used by the tests, miniredis when empty")
+
+var (
+	mu      sync.Mutex
+	servers = make(map[testing.TB]string)
+)
+
+// NewPool returns a pool of database db of the redis-server of t, closed with
+// t. The pools of a test share one server, their databases are independent.
+func NewPool(t testing.TB, db uint) *redis.Pool {
+	t.Helper()
+	pool := redis.NewPool(&redis.Config{
+		Proto:        "tcp",
+		Addr:         server(t),
+		MaxIdle:      10,
+		MaxActive:    10,
+		DialTimeout:  xtime.Duration(time.Second),
+		ReadTimeout:  xtime.Duration(time.Second),
+		WriteTimeout: xtime.Duration(time.Second),
+		Database:     db,
+	})
+	conn := pool.Get()
+	_, err := conn.Do("PING")
+	conn.Close()
+	if err != nil {
+		pool.Close()
+		t.Fatalf("redis-server(%s) not available: %v", server(t), err)
+	}
+	t.Cleanup(func() { pool.Close() })
+	return pool
+}
+
+// server returns the address of the redis-server of t, a miniredis is
+// started on the first call of a test.
+func server(t testing.TB) string {
+	if *addr != "" {
+		return *addr
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if a, ok := servers[t]; ok {
+		return a
+	}
+
+	s := miniredis.RunT(t)
+	// miniredis only expires keys when its clock is moved.
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(_tick)
+		defer ticker.Stop()
+		last := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				s.FastForward(now.Sub(last))
+				last = now
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		close(done)
+		mu.Lock()
+		delete(servers, t)
+		mu.Unlock()
+	})
+	servers[t] = s.Addr()
+	return s.Addr()
+}
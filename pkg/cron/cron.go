@@ -0,0 +1,366 @@
+// Package cron is a cron scheduler for replicated services. Every replica
+// runs a Scheduler, the one holding the leader dlock fires the jobs.
+//
+// The time of the last fired run of every job is kept in redis and advanced
+// with compare and set before the job runs, so a run is fired by one replica
+// even across leader changes. Runs which were due while no replica led are
+// missed and handled by the CatchUp policy of the job.
+package cron
+
+import (
+	"ascale/pkg/cache/redis"
+	"ascale/pkg/dlock"
+	"ascale/pkg/log"
+	"ascale/pkg/stat/prom"
+	"ascale/pkg/xtime"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	rcron "github.com/robfig/cron/v3"
+)
+
+// CatchUp is what the scheduler does with missed runs.
+type CatchUp string
+
+const (
+	// CatchUpSkip drops missed runs, the default.
+	CatchUpSkip CatchUp = "skip"
+	// CatchUpOnce fires the latest missed run.
+	CatchUpOnce CatchUp = "once"
+	// CatchUpAll fires every missed run, up to Config.MaxCatchUp.
+	CatchUpAll CatchUp = "all"
+)
+
+var (
+	luaAdvance = redis.NewScript(1, `if (redis.call("hget", KEYS[1], "last") or "") == ARGV[1] then redis.call("hset", KEYS[1], "last", ARGV[2]) return redis.call("hincrby", KEYS[1], "missed", ARGV[3]) else return -1 end`)
+)
+
+// ErrDuplicateJob is returned when adding a job name twice.
+var ErrDuplicateJob = errors.New("cron: duplicate job")
+
+// Job is a scheduled job.
+type Job struct {
+	// Name identifies the job state, it must be stable across deploys.
+	Name string
+	// Spec is a standard 5 field cron expression or a descriptor like
+	// @hourly, in the local time zone unless prefixed by CRON_TZ=.
+	Spec string
+	// CatchUp policy of missed runs, default CatchUpSkip.
+	CatchUp CatchUp
+	// Run fires the run scheduled at at. It should hand the work off, e.g.
+	// publish a message, long runs delay the other jobs.
+	Run func(c context.Context, at time.Time) error
+}
+
+// Config scheduler config.
+type Config struct {
+	// Prefix of the redis keys, default "cron:".
+	Prefix string
+	// LeaderTTL of the leader lock, it is refreshed every third of it.
+	// Default 30s.
+	LeaderTTL xtime.Duration
+	// StartingDeadline is how late a run may fire before it is missed,
+	// default 1m.
+	StartingDeadline xtime.Duration
+	// MaxCatchUp is the most missed runs CatchUpAll fires, default 10.
+	MaxCatchUp int
+}
+
+type entry struct {
+	job   *Job
+	sched rcron.Schedule
+}
+
+// Scheduler fires jobs on the elected replica.
+type Scheduler struct {
+	c      *Config
+	pool   *redis.Pool
+	locker *dlock.Client
+
+	mu     sync.Mutex
+	jobs   []*entry
+	leader int32
+
+	closing chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// New creates a scheduler, the pool is not closed by Close.
+func New(pool *redis.Pool, c *Config) *Scheduler {
+	cc := Config{}
+	if c != nil {
+		cc = *c
+	}
+	if cc.Prefix == "" {
+		cc.Prefix = "cron:"
+	}
+	if cc.LeaderTTL <= 0 {
+		cc.LeaderTTL = xtime.Duration(30 * time.Second)
+	}
+	if cc.StartingDeadline <= 0 {
+		cc.StartingDeadline = xtime.Duration(time.Minute)
+	}
+	if cc.MaxCatchUp <= 0 {
+		cc.MaxCatchUp = 10
+	}
+	return &Scheduler{
+		c:       &cc,
+		pool:    pool,
+		locker:  dlock.New(pool),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Add adds a job, it returns an error when the spec is invalid.
+func (s *Scheduler) Add(j *Job) (err error) {
+	e := &entry{job: j}
+	if e.sched, err = rcron.ParseStandard(j.Spec); err != nil {
+		return fmt.Errorf("cron: job(%s) spec(%s): %w", j.Name, j.Spec, err)
+	}
+	switch j.CatchUp {
+	case "":
+		j.CatchUp = CatchUpSkip
+	case CatchUpSkip, CatchUpOnce, CatchUpAll:
+	default:
+		return fmt.Errorf("cron: job(%s) unknown catch up policy(%s)", j.Name, j.CatchUp)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range s.jobs {
+		if v.job.Name == j.Name {
+			return ErrDuplicateJob
+		}
+	}
+	s.jobs = append(s.jobs, e)
+	return
+}
+
+// Start runs the scheduler until Close.
+func (s *Scheduler) Start() {
+	go s.run()
+}
+
+// IsLeader reports whether this replica fires the jobs.
+func (s *Scheduler) IsLeader() bool {
+	return atomic.LoadInt32(&s.leader) == 1
+}
+
+// Close stops the scheduler and gives up leadership.
+func (s *Scheduler) Close() {
+	s.once.Do(func() { close(s.closing) })
+	<-s.done
+}
+
+func (s *Scheduler) run() {
+	defer close(s.done)
+
+	var (
+		lock      *dlock.Lock
+		refreshed time.Time
+		ttl       = time.Duration(s.c.LeaderTTL)
+		key       = s.c.Prefix + "leader"
+	)
+	defer func() {
+		if lock != nil {
+			lock.Release(context.Background())
+		}
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+		}
+
+		c := context.Background()
+		var err error
+		if lock == nil {
+			if lock, err = s.locker.Obtain(c, key, ttl, nil); err != nil {
+				if err != dlock.ErrNotObtained {
+					log.For(c).Errorf("cron.Obtain(%s) error(%+v)", key, err)
+				}
+				continue
+			}
+			log.For(c).Infof("cron leader elected")
+			atomic.StoreInt32(&s.leader, 1)
+			refreshed = time.Now()
+		} else if time.Since(refreshed) > ttl/3 {
+			if err = lock.Refresh(c, ttl, nil); err != nil {
+				log.For(c).Warnf("cron leadership lost error(%+v)", err)
+				atomic.StoreInt32(&s.leader, 0)
+				lock = nil
+				continue
+			}
+			refreshed = time.Now()
+		}
+
+		s.mu.Lock()
+		jobs := s.jobs
+		s.mu.Unlock()
+		now := time.Now()
+		for _, e := range jobs {
+			s.tick(c, e, now)
+		}
+	}
+}
+
+func (s *Scheduler) key(name string) string {
+	return s.c.Prefix + "job:" + name
+}
+
+// tick fires the runs of e due at now.
+func (s *Scheduler) tick(c context.Context, e *entry, now time.Time) {
+	name := e.job.Name
+	last, ok, err := s.last(c, name)
+	if err != nil {
+		return
+	}
+	if !ok {
+		// a new job starts now, nothing was missed.
+		s.advance(c, name, "", now, 0)
+		return
+	}
+
+	var (
+		deadline = now.Add(-time.Duration(s.c.StartingDeadline))
+		missed   []time.Time
+		onTime   []time.Time
+		nMissed  int
+		latest   time.Time
+	)
+	for t := e.sched.Next(last); !t.IsZero() && !t.After(now); t = e.sched.Next(t) {
+		latest = t
+		if t.Before(deadline) {
+			nMissed++
+			if missed = append(missed, t); len(missed) > s.c.MaxCatchUp {
+				missed = missed[1:]
+			}
+			continue
+		}
+		onTime = append(onTime, t)
+	}
+	if latest.IsZero() {
+		return
+	}
+
+	var runs []time.Time
+	switch e.job.CatchUp {
+	case CatchUpOnce:
+		if len(missed) > 0 {
+			runs = append(runs, missed[len(missed)-1])
+		}
+	case CatchUpAll:
+		runs = append(runs, missed...)
+	}
+	runs = append(runs, onTime...)
+
+	if !s.advance(c, name, fmt.Sprint(last.Unix()), latest, nMissed) {
+		// another replica fired them.
+		return
+	}
+	if nMissed > 0 {
+		log.For(c).Warnf("cron job(%s) missed(%d) runs since(%s) catch up(%s)", name, nMissed, last, e.job.CatchUp)
+		prom.BusinessInfoCount.Add(fmt.Sprintf("cron_missed:%s", name), int64(nMissed))
+	}
+	for _, t := range runs {
+		if err = e.job.Run(c, t); err != nil {
+			log.For(c).Errorf("cron job(%s) run(%s) error(%+v)", name, t, err)
+			prom.BusinessErrCount.Incr(fmt.Sprintf("cron:%s", name))
+			continue
+		}
+		prom.BusinessInfoCount.Incr(fmt.Sprintf("cron:%s", name))
+	}
+}
+
+// last returns the time of the last fired run of a job, ok is false for new
+// jobs.
+func (s *Scheduler) last(c context.Context, name string) (last time.Time, ok bool, err error) {
+	var conn redis.Conn
+	if conn, err = s.pool.GetContext(c); err != nil {
+		log.For(c).Errorf("cron.last(%s) error(%+v)", name, err)
+		return
+	}
+	defer conn.Close()
+
+	var v int64
+	if v, err = redis.Int64(conn.Do("HGET", s.key(name), "last")); err != nil {
+		if err == redis.ErrNil {
+			err = nil
+			return
+		}
+		log.For(c).Errorf("cron.last(%s) HGET error(%+v)", name, err)
+		return
+	}
+	return time.Unix(v, 0), true, nil
+}
+
+// advance sets the last run of a job to to if it still is from, it reports
+// whether it was set.
+func (s *Scheduler) advance(c context.Context, name, from string, to time.Time, missed int) bool {
+	conn, err := s.pool.GetContext(c)
+	if err != nil {
+		log.For(c).Errorf("cron.advance(%s) error(%+v)", name, err)
+		return false
+	}
+	defer conn.Close()
+
+	ret, err := redis.Int64(luaAdvance.Do(conn, s.key(name), from, to.Unix(), missed))
+	if err != nil {
+		log.For(c).Errorf("cron.advance(%s) error(%+v)", name, err)
+		return false
+	}
+	return ret >= 0
+}
+
+// Status is the state of a job.
+type Status struct {
+	Name    string    `json:"name"`
+	Spec    string    `json:"spec"`
+	Last    time.Time `json:"last"`
+	Next    time.Time `json:"next"`
+	Missed  int64     `json:"missed"`
+	CatchUp CatchUp   `json:"catch_up"`
+}
+
+// Status returns the state of every job.
+func (s *Scheduler) Status(c context.Context) (ret []*Status, err error) {
+	s.mu.Lock()
+	jobs := s.jobs
+	s.mu.Unlock()
+
+	var conn redis.Conn
+	if conn, err = s.pool.GetContext(c); err != nil {
+		log.For(c).Errorf("cron.Status() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	ret = make([]*Status, 0, len(jobs))
+	for _, e := range jobs {
+		st := &Status{Name: e.job.Name, Spec: e.job.Spec, CatchUp: e.job.CatchUp}
+		var vs []int64
+		if vs, err = redis.Int64s(conn.Do("HMGET", s.key(e.job.Name), "last", "missed")); err != nil {
+			log.For(c).Errorf("cron.Status(%s) HMGET error(%+v)", e.job.Name, err)
+			return
+		}
+		last := time.Now()
+		if vs[0] > 0 {
+			st.Last = time.Unix(vs[0], 0)
+			last = st.Last
+		}
+		st.Missed = vs[1]
+		st.Next = e.sched.Next(last)
+		ret = append(ret, st)
+	}
+	return
+}
@@ -0,0 +1,74 @@
+package cron
+
+import (
+	"ascale/pkg/cache/redis/redistest"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestScheduler(t *testing.T) *Scheduler {
+	return New(redistest.NewPool(t, 0), &Config{Prefix: fmt.Sprintf("crontest:%d:", time.Now().UnixNano())})
+}
+
+func TestTickCatchUp(t *testing.T) {
+	now := time.Date(2024, 1, 2, 10, 30, 30, 0, time.Local)
+	for policy, want := range map[CatchUp]int{
+		CatchUpSkip: 1,
+		CatchUpOnce: 2,
+		CatchUpAll:  11,
+	} {
+		t.Run(string(policy), func(t *testing.T) {
+			s := newTestScheduler(t)
+			c := context.Background()
+			var runs []time.Time
+			job := &Job{Name: "job", Spec: "* * * * *", CatchUp: policy, Run: func(c context.Context, at time.Time) error {
+				runs = append(runs, at)
+				return nil
+			}}
+			assert.NoError(t, s.Add(job))
+			e := s.jobs[0]
+
+			// a new job starts without runs.
+			s.tick(c, e, now.Add(-20*time.Minute))
+			assert.Empty(t, runs)
+
+			// 20 runs are due, the one of 10:30 is on time.
+			s.tick(c, e, now)
+			assert.Len(t, runs, want)
+			assert.Equal(t, now.Truncate(time.Minute), runs[len(runs)-1])
+
+			// runs fire once.
+			s.tick(c, e, now)
+			assert.Len(t, runs, want)
+
+			st, err := s.Status(c)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(19), st[0].Missed)
+			assert.Equal(t, now.Truncate(time.Minute), st[0].Last)
+		})
+	}
+}
+
+func TestAdd(t *testing.T) {
+	s := New(nil, nil)
+	assert.NoError(t, s.Add(&Job{Name: "job", Spec: "@hourly"}))
+	assert.Equal(t, ErrDuplicateJob, s.Add(&Job{Name: "job", Spec: "@hourly"}))
+	assert.Error(t, s.Add(&Job{Name: "bad", Spec: "* *"}))
+	assert.Error(t, s.Add(&Job{Name: "policy", Spec: "@hourly", CatchUp: "never"}))
+}
+
+func TestLeaderElection(t *testing.T) {
+	a := newTestScheduler(t)
+	b := New(a.pool, a.c)
+	a.Start()
+	b.Start()
+	defer a.Close()
+	defer b.Close()
+
+	time.Sleep(1500 * time.Millisecond)
+	assert.True(t, a.IsLeader() != b.IsLeader(), "one leader expected")
+}
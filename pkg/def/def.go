@@ -153,3 +153,58 @@ const VerifiableProviderKey = "verifiable_provider_key"
 const ZoomWaitingRoomKey = "zoom_waiting_room_key"
 
 const ZoomServerToServerToken = "zoom_server_to_server_token"
+
+func DeadLetterKey(id string) string {
+	return fmt.Sprintf("dead_letter:%s", id)
+}
+
+func DeadLetterIndexKey(topic string) string {
+	return fmt.Sprintf("dead_letter_index:%s", topic)
+}
+
+const DeadLetterIndexAllKey = "dead_letter_index"
+
+func JobRunKey(id string) string {
+	return fmt.Sprintf("job_run:%s", id)
+}
+
+func JobRunIndexKey(job string) string {
+	return fmt.Sprintf("job_run_index:%s", job)
+}
+
+const JobRunIndexAllKey = "job_run_index"
+
+const JobRunLastSuccessKey = "job_run_last_success"
+
+func JobRunProgressKey(id string) string {
+	return fmt.Sprintf("job_run_progress:%s", id)
+}
+
+// JobControlChannel is the redis pub/sub channel of job run control
+// messages, every worker replica subscribes to it.
+const JobControlChannel = "job_control"
+
+func ExperimentKey(id string) string {
+	return fmt.Sprintf("experiment:%s", id)
+}
+
+func ExperimentSeriesKey(id string) string {
+	return fmt.Sprintf("experiment_series:%s", id)
+}
+
+const ExperimentIndexKey = "experiment_index"
+
+// ExperimentActiveKey holds the id of the running experiment, worker
+// replicas report themselves active in it.
+const ExperimentActiveKey = "experiment_active"
+
+// TopicLoadKey is a hash of the load of a topic by replica.
+func TopicLoadKey(topic string) string {
+	return fmt.Sprintf("topic_load:%s", topic)
+}
+
+// TopicCountKey is a hash of the messages of a topic published and settled,
+// the backlog of brokers which do not report it.
+func TopicCountKey(topic string) string {
+	return fmt.Sprintf("topic_count:%s", topic)
+}
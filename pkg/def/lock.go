@@ -11,3 +11,5 @@ func OrderLock(orderID int64) string {
 func CronJobLock(jobName string) string {
 	return fmt.Sprintf("lock_cron_job_%s", jobName)
 }
+
+const OutboxRelayLock = "lock_outbox_relay"
@@ -8,9 +8,11 @@ import (
 var TriggerJob = struct {
 	CronSendLittleMessage string
 	SendHugeMessage       string
+	LoadProfile           string
 }{
 	CronSendLittleMessage: "CronSendLittleMessage",
 	SendHugeMessage:       "SendHugeMessage",
+	LoadProfile:           "LoadProfile",
 }
 
 var Topics = struct {
@@ -18,7 +20,13 @@ var Topics = struct {
 	DoTask     string
 	DeadLetter string
 }{
-	Trigger:    fmt.Sprintf(`%s-trigger`, env.DeployEnv),
-	DoTask:     fmt.Sprintf(`%s-do-task`, env.DeployEnv),
-	DeadLetter: fmt.Sprintf(`%s-deadletter`, env.DeployEnv),
+	Trigger:    TopicName("trigger"),
+	DoTask:     TopicName("do-task"),
+	DeadLetter: TopicName("deadletter"),
+}
+
+// TopicName returns the name of a topic in the deploy env, e.g. do-task is
+// uat-do-task.
+func TopicName(name string) string {
+	return fmt.Sprintf("%s-%s", env.DeployEnv, name)
 }
@@ -8,6 +8,7 @@ import (
 	"encoding/base64"
 	"errors"
 	"io"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -17,6 +18,8 @@ var (
 	luaRefresh = redis.NewScript(1, `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`)
 	luaRelease = redis.NewScript(1, `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`)
 	luaPTTL    = redis.NewScript(1, `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pttl", KEYS[1]) else return -3 end`)
+	luaObtain  = redis.NewScript(2, `if redis.call("set", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then return redis.call("incr", KEYS[2]) else return 0 end`)
+	luaRaise   = redis.NewScript(1, `if tonumber(redis.call("get", KEYS[1]) or "0") < tonumber(ARGV[1]) then redis.call("set", KEYS[1], ARGV[1]) end return 1`)
 )
 
 var (
@@ -25,19 +28,49 @@ var (
 
 	// ErrLockNotHeld is returned when trying to release an inactive lock.
 	ErrLockNotHeld = errors.New("redislock: lock not held")
+
+	// ErrLockLost is the cause of a KeepAlive context cancelled because the
+	// lock expired or was taken over.
+	ErrLockLost = errors.New("redislock: lock lost")
 )
 
+// Client obtains locks on one redis, or on a quorum of independent redis
+// nodes in redlock mode.
 type Client struct {
-	client *redis.Pool
+	pools  []*redis.Pool
+	quorum int
 	tmp    []byte
 	tmpMu  sync.Mutex
 }
 
 func New(pool *redis.Pool) *Client {
-	return &Client{client: pool}
+	return &Client{pools: []*redis.Pool{pool}, quorum: 1}
+}
+
+// NewRedlock creates a client which holds a lock while it is set on a
+// majority of the pools, so losing a minority of nodes, e.g. a failover
+// which dropped the key, does not hand the lock to a second holder. The
+// pools must be independent masters, not replicas of each other.
+//
+// Fencing tokens are counted per node, Fence is the highest of the quorum
+// and is written back to the quorum before the lock is handed out. Any later
+// quorum shares a node with it, so the tokens of a key still increase.
+func NewRedlock(pools ...*redis.Pool) *Client {
+	return &Client{pools: pools, quorum: len(pools)/2 + 1}
 }
 
 func (c *Client) Obtain(ctx context.Context, key string, ttl time.Duration, opt *Options) (*Lock, error) {
+	return c.acquire(ctx, mutexKind, key, ttl, opt, func(conn redis.Conn, value string) (int64, error) {
+		return redis.Int64(luaObtain.Do(conn, key, FenceKey(key), value, int64(ttl/time.Millisecond)))
+	})
+}
+
+// obtainFunc tries to take a lock on a node, it returns 0 when the lock is
+// held by someone else and the fencing token, or 1 for shared locks, else.
+type obtainFunc func(conn redis.Conn, value string) (int64, error)
+
+// acquire obtains a lock of kind with fn, retrying as opt says.
+func (c *Client) acquire(ctx context.Context, kind *lockKind, key string, ttl time.Duration, opt *Options, fn obtainFunc) (*Lock, error) {
 	// Create a random token
 	token, err := c.randomToken()
 	if err != nil {
@@ -55,11 +88,15 @@ func (c *Client) Obtain(ctx context.Context, key string, ttl time.Duration, opt
 
 	var timer *time.Timer
 	for {
-		ok, err := c.obtain(ctx, key, value, ttl)
+		fence, err := c.obtain(ctx, kind, key, value, ttl, fn)
 		if err != nil {
 			return nil, err
-		} else if ok {
-			return &Lock{client: c, key: key, value: value}, nil
+		} else if fence > 0 {
+			l := &Lock{client: c, kind: kind, key: key, value: value}
+			if kind.fenced {
+				l.fence = fence
+			}
+			return l, nil
 		}
 
 		backoff := retry.NextBackoff()
@@ -82,29 +119,141 @@ func (c *Client) Obtain(ctx context.Context, key string, ttl time.Duration, opt
 	}
 }
 
-func (c *Client) obtain(ctx context.Context, key, value string, ttl time.Duration) (ret bool, err error) {
-	var conn redis.Conn
-	if conn, err = c.client.GetContext(ctx); err != nil {
-		log.For(ctx).Errorf("dlock.obtain(),  err(%+v)", err)
-		return
+// obtain runs fn on the nodes, fence is 0 when the lock is held by someone
+// else. In redlock mode fence is 0 unless a quorum was taken before the ttl,
+// less the clock drift, ran out, the partially taken nodes are released then.
+func (c *Client) obtain(ctx context.Context, kind *lockKind, key, value string, ttl time.Duration, fn obtainFunc) (fence int64, err error) {
+	start := time.Now()
+	res := c.do(ctx, "obtain", func(conn redis.Conn) (int64, error) {
+		return fn(conn, value)
+	})
+
+	var n int
+	held := make([]bool, len(res))
+	for i, r := range res {
+		if r.err == nil && r.val > 0 {
+			n++
+			held[i] = true
+			if r.val > fence {
+				fence = r.val
+			}
+		}
+	}
+	if n >= c.quorum && c.validity(start, ttl) > 0 {
+		if !kind.fenced || len(c.pools) == 1 {
+			return
+		}
+		if c.raise(ctx, held, key, fence) && c.validity(start, ttl) > 0 {
+			return
+		}
+	}
+	fence = 0
+	if len(c.pools) > 1 && n > 0 {
+		c.doOn(ctx, "obtain", held, func(conn redis.Conn) (int64, error) {
+			return redis.Int64(kind.release.Do(conn, kind.key(key), value))
+		})
 	}
-	defer conn.Close()
+	err = c.quorumErr(res)
+	return
+}
 
-	var result string
-	if result, err = redis.String(conn.Do("SET", key, value, "NX", "EX", int64(ttl.Seconds()))); err != nil {
-		if err == redis.ErrNil {
-			err = nil
-		} else {
-			log.For(ctx).Errorf("dlock.obtain() SETNX(%s) error(%v)", key, err)
+// raise sets the fencing token counter of key on the held nodes to fence
+// unless it is higher already, it reports whether a quorum was raised.
+func (c *Client) raise(ctx context.Context, held []bool, key string, fence int64) bool {
+	res := c.doOn(ctx, "raise", held, func(conn redis.Conn) (int64, error) {
+		return redis.Int64(luaRaise.Do(conn, FenceKey(key), fence))
+	})
+	var n int
+	for _, r := range res {
+		if r.err == nil && r.val == 1 {
+			n++
+		}
+	}
+	return n >= c.quorum
+}
+
+// drift is the clock drift allowed between redlock nodes holding a lock for
+// ttl.
+func (c *Client) drift(ttl time.Duration) time.Duration {
+	if len(c.pools) == 1 {
+		return 0
+	}
+	return ttl/100 + 2*time.Millisecond
+}
+
+// validity is how long a lock set for ttl since start is still held.
+func (c *Client) validity(start time.Time, ttl time.Duration) time.Duration {
+	if len(c.pools) == 1 {
+		return ttl
+	}
+	return ttl - time.Since(start) - c.drift(ttl)
+}
+
+type nodeResult struct {
+	val int64
+	err error
+}
+
+// do runs fn on every node concurrently.
+func (c *Client) do(ctx context.Context, op string, fn func(conn redis.Conn) (int64, error)) []nodeResult {
+	return c.doOn(ctx, op, nil, fn)
+}
+
+// doOn runs fn concurrently on the nodes set in nodes, or on every node when
+// it is nil. The results of the others are ErrNil.
+func (c *Client) doOn(ctx context.Context, op string, nodes []bool, fn func(conn redis.Conn) (int64, error)) []nodeResult {
+	res := make([]nodeResult, len(c.pools))
+	run := func(i int) {
+		if nodes != nil && !nodes[i] {
+			res[i].err = redis.ErrNil
 			return
 		}
+		conn, err := c.pools[i].GetContext(ctx)
+		if err != nil {
+			log.For(ctx).Errorf("dlock.%s(),  err(%+v)", op, err)
+			res[i].err = err
+			return
+		}
+		defer conn.Close()
+		if res[i].val, res[i].err = fn(conn); res[i].err != nil && res[i].err != redis.ErrNil {
+			log.For(ctx).Errorf("dlock.%s() node(%d) error(%v)", op, i, res[i].err)
+		}
+	}
+	if len(c.pools) == 1 {
+		run(0)
+		return res
 	}
 
-	if result == "OK" {
-		ret = true
+	var wg sync.WaitGroup
+	for i := range c.pools {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			run(i)
+		}(i)
 	}
+	wg.Wait()
+	return res
+}
 
-	return
+// quorumErr returns the first node error when errors alone prevent a quorum,
+// so callers tell an unreachable redis from a lock held by someone else.
+func (c *Client) quorumErr(res []nodeResult) error {
+	var (
+		n     int
+		first error
+	)
+	for _, r := range res {
+		if r.err != nil && r.err != redis.ErrNil {
+			if n++; first == nil {
+				first = r.err
+			}
+		}
+	}
+	if n > len(res)-c.quorum {
+		return first
+	}
+	return nil
 }
 
 func (c *Client) randomToken() (string, error) {
@@ -123,11 +272,34 @@ func (c *Client) randomToken() (string, error) {
 
 // --------------------------------------------------------------------
 
+// lockKind is how a kind of lock is held in redis.
+type lockKind struct {
+	// key returns the redis key holding the lock named key.
+	key func(key string) string
+	// fenced locks are exclusive and count fencing tokens.
+	fenced bool
+
+	refresh, pttl, release *redis.Script
+}
+
+var mutexKind = &lockKind{
+	key:     func(key string) string { return key },
+	fenced:  true,
+	refresh: luaRefresh,
+	pttl:    luaPTTL,
+	release: luaRelease,
+}
+
 // Lock represents an obtained, distributed lock.
 type Lock struct {
 	client *Client
+	kind   *lockKind
 	key    string
 	value  string
+	fence  int64
+
+	mu   sync.Mutex
+	stop context.CancelCauseFunc
 }
 
 // Obtain is a short-cut for New(...).Obtain(...).
@@ -135,7 +307,7 @@ func Obtain(c context.Context, client *redis.Pool, key string, ttl time.Duration
 	return New(client).Obtain(c, key, ttl, opt)
 }
 
-// Key returns the redis key used by the lock.
+// Key returns the name of the lock, the redis key of exclusive locks.
 func (l *Lock) Key() string {
 	return l.key
 }
@@ -145,75 +317,140 @@ func (l *Lock) Token() string {
 	return l.value[:22]
 }
 
+// Fence returns the fencing token of the lock. Tokens of a key increase with
+// every Obtain, so writes guarded by FencedDo or CheckFenceTx reject holders
+// whose lock was taken over meanwhile. It is 0 for read and semaphore locks.
+func (l *Lock) Fence() int64 {
+	return l.fence
+}
+
 // Metadata returns the metadata of the lock.
 func (l *Lock) Metadata() string {
 	return l.value[22:]
 }
 
 // TTL returns the remaining time-to-live. Returns 0 if the lock has expired.
+// In redlock mode it is the time the quorum still holds the lock, less the
+// clock drift.
 func (l *Lock) TTL(c context.Context) (dt time.Duration, err error) {
-	var conn redis.Conn
-	if conn, err = l.client.client.GetContext(c); err != nil {
-		log.For(c).Errorf("dlock.TTL(),  err(%+v)", err)
+	res := l.client.do(c, "TTL", func(conn redis.Conn) (int64, error) {
+		return redis.Int64(l.kind.pttl.Do(conn, l.kind.key(l.key), l.value))
+	})
+	if err = l.client.quorumErr(res); err != nil {
 		return
 	}
-	defer conn.Close()
 
-	res, err := redis.Int64(luaPTTL.Do(conn, l.key, l.value))
-	if err == redis.ErrNil {
+	ttls := make([]time.Duration, 0, len(res))
+	for _, r := range res {
+		if r.err == nil && r.val > 0 {
+			ttls = append(ttls, time.Duration(r.val)*time.Millisecond)
+		}
+	}
+	if len(ttls) < l.client.quorum {
 		return 0, nil
-	} else if err != nil {
-		return 0, err
 	}
-
-	if res > 0 {
-		return time.Duration(res) * time.Millisecond, nil
+	sort.Slice(ttls, func(i, j int) bool { return ttls[i] > ttls[j] })
+	if dt = ttls[l.client.quorum-1] - l.client.drift(ttls[0]); dt < 0 {
+		dt = 0
 	}
-	return 0, nil
+	return
 }
 
 // Refresh extends the lock with a new TTL.
 // May return ErrNotObtained if refresh is unsuccessful.
 func (l *Lock) Refresh(c context.Context, ttl time.Duration, opt *Options) (err error) {
-	var conn redis.Conn
-	if conn, err = l.client.client.GetContext(c); err != nil {
-		log.For(c).Errorf("dlock.Refresh(),  err(%+v)", err)
+	start := time.Now()
+	ttlVal := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	res := l.client.do(c, "Refresh", func(conn redis.Conn) (int64, error) {
+		return redis.Int64(l.kind.refresh.Do(conn, l.kind.key(l.key), l.value, ttlVal))
+	})
+	if err = l.client.quorumErr(res); err != nil {
 		return
 	}
-	defer conn.Close()
 
-	ttlVal := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
-
-	status, err := redis.Int64(luaRefresh.Do(conn, l.key, l.value, ttlVal))
-	if err != nil {
-		return err
-	} else if status == int64(1) {
+	var n int
+	for _, r := range res {
+		if r.err == nil && r.val == 1 {
+			n++
+		}
+	}
+	if n >= l.client.quorum && l.client.validity(start, ttl) > 0 {
 		return nil
 	}
 	return ErrNotObtained
 }
 
-// Release manually releases the lock.
+// KeepAlive refreshes the lock with ttl every third of ttl until c is done
+// or the lock is released. The returned context is cancelled when that
+// happens, or with cause ErrLockLost once the lock can not be refreshed
+// before it expires, holders should stop touching the guarded resource then.
+func (l *Lock) KeepAlive(c context.Context, ttl time.Duration) context.Context {
+	ctx, cancel := context.WithCancelCause(c)
+	l.mu.Lock()
+	if l.stop != nil {
+		l.stop(nil)
+	}
+	l.stop = cancel
+	l.mu.Unlock()
+
+	go func() {
+		t := time.NewTicker(ttl / 3)
+		defer t.Stop()
+		refreshed := time.Now()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+
+			err := l.Refresh(ctx, ttl, nil)
+			switch {
+			case err == nil:
+				refreshed = time.Now()
+				continue
+			case ctx.Err() != nil:
+				return
+			case err != ErrNotObtained && time.Since(refreshed) < ttl:
+				// redis may be back before the lock expires.
+				log.For(ctx).Warnf("dlock.KeepAlive(%s) refresh error(%+v)", l.key, err)
+				continue
+			}
+			log.For(ctx).Errorf("dlock.KeepAlive(%s) lock lost error(%+v)", l.key, err)
+			cancel(ErrLockLost)
+			return
+		}
+	}()
+	return ctx
+}
+
+// Release manually releases the lock on every node and stops KeepAlive.
 // May return ErrLockNotHeld.
 func (l *Lock) Release(c context.Context) (err error) {
-	var conn redis.Conn
-	if conn, err = l.client.client.GetContext(c); err != nil {
-		log.For(c).Errorf("dlock.Release(),  err(%+v)", err)
-		return
+	l.mu.Lock()
+	if l.stop != nil {
+		l.stop(nil)
+		l.stop = nil
 	}
-	defer conn.Close()
+	l.mu.Unlock()
 
-	res, err := redis.Int64(luaRelease.Do(conn, l.key, l.value))
-	if err == redis.ErrNil {
-		return ErrLockNotHeld
-	} else if err != nil {
-		return err
+	res := l.client.do(c, "Release", func(conn redis.Conn) (int64, error) {
+		return redis.Int64(l.kind.release.Do(conn, l.kind.key(l.key), l.value))
+	})
+	if err = l.client.quorumErr(res); err != nil {
+		return
 	}
 
-	if res != 1 {
+	// a minority of released keys means the lock had expired already.
+	var n int
+	for _, r := range res {
+		if r.err == nil && r.val == 1 {
+			n++
+		}
+	}
+	if n < l.client.quorum {
 		return ErrLockNotHeld
 	}
-
 	return nil
 }
 
@@ -0,0 +1,293 @@
+package dlock
+
+import (
+	"ascale/pkg/cache/redis"
+	"ascale/pkg/cache/redis/redistest"
+	"ascale/pkg/xtime"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPool(t *testing.T) *redis.Pool {
+	return redistest.NewPool(t, 0)
+}
+
+// newTestPoolDB returns a pool of another database, used as an independent
+// redlock node.
+func newTestPoolDB(t *testing.T, db uint) *redis.Pool {
+	return redistest.NewPool(t, db)
+}
+
+func testKey(t *testing.T) string {
+	return fmt.Sprintf("dlocktest:%s:%d", t.Name(), time.Now().UnixNano())
+}
+
+func TestObtainRelease(t *testing.T) {
+	client := New(newTestPool(t))
+	c := context.Background()
+	key := testKey(t)
+
+	lock, err := client.Obtain(c, key, time.Second, nil)
+	assert.NoError(t, err)
+	_, err = client.Obtain(c, key, time.Second, nil)
+	assert.Equal(t, ErrNotObtained, err)
+
+	assert.NoError(t, lock.Release(c))
+	assert.Equal(t, ErrLockNotHeld, lock.Release(c))
+}
+
+func TestKeepAlive(t *testing.T) {
+	client := New(newTestPool(t))
+	c := context.Background()
+	key := testKey(t)
+
+	lock, err := client.Obtain(c, key, time.Second, nil)
+	assert.NoError(t, err)
+	ctx := lock.KeepAlive(c, time.Second)
+
+	// held beyond its ttl.
+	time.Sleep(1500 * time.Millisecond)
+	assert.NoError(t, ctx.Err())
+	ttl, err := lock.TTL(c)
+	assert.NoError(t, err)
+	assert.True(t, ttl > 0)
+
+	assert.NoError(t, lock.Release(c))
+	<-ctx.Done()
+	assert.Equal(t, context.Canceled, context.Cause(ctx))
+}
+
+func TestKeepAliveLost(t *testing.T) {
+	pool := newTestPool(t)
+	client := New(pool)
+	c := context.Background()
+	key := testKey(t)
+
+	lock, err := client.Obtain(c, key, time.Second, nil)
+	assert.NoError(t, err)
+	ctx := lock.KeepAlive(c, time.Second)
+
+	conn := pool.Get()
+	_, err = conn.Do("DEL", key)
+	conn.Close()
+	assert.NoError(t, err)
+
+	select {
+	case <-ctx.Done():
+		assert.Equal(t, ErrLockLost, context.Cause(ctx))
+	case <-time.After(2 * time.Second):
+		t.Fatal("lost lock not detected")
+	}
+}
+
+func TestFence(t *testing.T) {
+	pool := newTestPool(t)
+	client := New(pool)
+	c := context.Background()
+	key := testKey(t)
+
+	first, err := client.Obtain(c, key, time.Second, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, first.Release(c))
+	second, err := client.Obtain(c, key, time.Second, nil)
+	assert.NoError(t, err)
+	defer second.Release(c)
+	assert.True(t, second.Fence() > first.Fence())
+
+	conn := pool.Get()
+	defer conn.Close()
+	resource, data := key+":resource", key+":data"
+	_, err = FencedDo(conn, resource, second.Fence(), "SET", []string{data}, "second")
+	assert.NoError(t, err)
+	_, err = FencedDo(conn, resource, first.Fence(), "SET", []string{data}, "first")
+	assert.Equal(t, ErrStaleFence, err)
+
+	v, err := redis.String(conn.Do("GET", data))
+	assert.NoError(t, err)
+	assert.Equal(t, "second", v)
+}
+
+func TestRedlock(t *testing.T) {
+	pools := []*redis.Pool{newTestPoolDB(t, 1), newTestPoolDB(t, 2), newTestPoolDB(t, 3)}
+	client := NewRedlock(pools...)
+	c := context.Background()
+	key := testKey(t)
+
+	lock, err := client.Obtain(c, key, time.Second, nil)
+	assert.NoError(t, err)
+	_, err = client.Obtain(c, key, time.Second, nil)
+	assert.Equal(t, ErrNotObtained, err)
+
+	ttl, err := lock.TTL(c)
+	assert.NoError(t, err)
+	assert.True(t, ttl > 0 && ttl < time.Second, "ttl %s", ttl)
+	assert.NoError(t, lock.Refresh(c, 2*time.Second, nil))
+
+	assert.NoError(t, lock.Release(c))
+	assert.Equal(t, ErrLockNotHeld, lock.Release(c))
+}
+
+func TestRedlockMinority(t *testing.T) {
+	pools := []*redis.Pool{newTestPoolDB(t, 1), newTestPoolDB(t, 2), newTestPoolDB(t, 3)}
+	c := context.Background()
+	key := testKey(t)
+
+	// a minority holding the key does not block the others.
+	other, err := New(pools[0]).Obtain(c, key, time.Second, nil)
+	assert.NoError(t, err)
+	lock, err := NewRedlock(pools...).Obtain(c, key, time.Second, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, lock.Release(c))
+	assert.NoError(t, other.Release(c))
+
+	// a majority holding it does, and the keys set meanwhile are released.
+	for _, pool := range pools[1:] {
+		_, err = New(pool).Obtain(c, key, time.Second, nil)
+		assert.NoError(t, err)
+	}
+	_, err = NewRedlock(pools...).Obtain(c, key, time.Second, nil)
+	assert.Equal(t, ErrNotObtained, err)
+	conn := pools[0].Get()
+	defer conn.Close()
+	n, err := redis.Int(conn.Do("EXISTS", key))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestRedlockFence(t *testing.T) {
+	pools := []*redis.Pool{newTestPoolDB(t, 1), newTestPoolDB(t, 2), newTestPoolDB(t, 3)}
+	client := NewRedlock(pools...)
+	c := context.Background()
+	key := testKey(t)
+
+	// the counters of the nodes are out of step.
+	conn := pools[0].Get()
+	_, err := conn.Do("SET", FenceKey(key), 5)
+	conn.Close()
+	assert.NoError(t, err)
+
+	first, err := client.Obtain(c, key, time.Second, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), first.Fence())
+	assert.NoError(t, first.Release(c))
+
+	// the next quorum misses the node with the highest counter.
+	other, err := New(pools[0]).Obtain(c, key, time.Second, nil)
+	assert.NoError(t, err)
+	defer other.Release(c)
+	second, err := client.Obtain(c, key, time.Second, nil)
+	assert.NoError(t, err)
+	defer second.Release(c)
+	assert.True(t, second.Fence() > first.Fence(), "fence %d after %d", second.Fence(), first.Fence())
+}
+
+func TestRedlockNodeDown(t *testing.T) {
+	down := redis.NewPool(&redis.Config{
+		Proto:       "tcp",
+		Addr:        "127.0.0.1:1",
+		MaxIdle:     1,
+		MaxActive:   1,
+		DialTimeout: xtime.Duration(100 * time.Millisecond),
+	})
+	defer down.Close()
+	c := context.Background()
+	key := testKey(t)
+
+	lock, err := NewRedlock(newTestPoolDB(t, 1), newTestPoolDB(t, 2), down).Obtain(c, key, time.Second, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, lock.Refresh(c, time.Second, nil))
+	assert.NoError(t, lock.Release(c))
+
+	_, err = NewRedlock(newTestPoolDB(t, 1), down, down).Obtain(c, key, time.Second, nil)
+	assert.Error(t, err)
+	assert.NotEqual(t, ErrNotObtained, err)
+}
+
+func TestRWLock(t *testing.T) {
+	client := New(newTestPool(t))
+	c := context.Background()
+	key := testKey(t)
+
+	r1, err := client.ObtainRead(c, key, time.Second, nil)
+	assert.NoError(t, err)
+	r2, err := client.ObtainRead(c, key, time.Second, nil)
+	assert.NoError(t, err)
+	_, err = client.ObtainWrite(c, key, time.Second, nil)
+	assert.Equal(t, ErrNotObtained, err)
+
+	ttl, err := r1.TTL(c)
+	assert.NoError(t, err)
+	assert.True(t, ttl > 0 && ttl <= time.Second, "ttl %s", ttl)
+	assert.NoError(t, r1.Refresh(c, time.Second, nil))
+	assert.NoError(t, r1.Release(c))
+	assert.Equal(t, ErrLockNotHeld, r1.Release(c))
+	assert.NoError(t, r2.Release(c))
+
+	w, err := client.ObtainWrite(c, key, time.Second, nil)
+	assert.NoError(t, err)
+	assert.True(t, w.Fence() > 0)
+	_, err = client.ObtainRead(c, key, time.Second, nil)
+	assert.Equal(t, ErrNotObtained, err)
+	_, err = client.Obtain(c, key, time.Second, nil)
+	assert.Equal(t, ErrNotObtained, err)
+	assert.NoError(t, w.Release(c))
+
+	_, err = client.ObtainRead(c, key, time.Second, nil)
+	assert.NoError(t, err)
+}
+
+func TestRWLockReaderExpires(t *testing.T) {
+	client := New(newTestPool(t))
+	c := context.Background()
+	key := testKey(t)
+
+	r, err := client.ObtainRead(c, key, 200*time.Millisecond, nil)
+	assert.NoError(t, err)
+	w, err := client.ObtainWrite(c, key, time.Second, &Options{RetryStrategy: LinearBackoff(50 * time.Millisecond)})
+	assert.NoError(t, err)
+	assert.NoError(t, w.Release(c))
+	assert.Equal(t, ErrLockNotHeld, r.Release(c))
+}
+
+func TestSemaphore(t *testing.T) {
+	client := New(newTestPool(t))
+	c := context.Background()
+	key := testKey(t)
+
+	var slots []*Lock
+	for i := 0; i < 3; i++ {
+		l, err := client.ObtainSemaphore(c, key, 3, time.Second, &Options{Metadata: fmt.Sprint(i)})
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprint(i), l.Metadata())
+		slots = append(slots, l)
+	}
+	_, err := client.ObtainSemaphore(c, key, 3, time.Second, nil)
+	assert.Equal(t, ErrNotObtained, err)
+	n, err := client.Holders(c, key)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	assert.NoError(t, slots[0].Release(c))
+	l, err := client.ObtainSemaphore(c, key, 3, time.Second, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, l.Release(c))
+}
+
+func TestRedlockSemaphore(t *testing.T) {
+	client := NewRedlock(newTestPoolDB(t, 1), newTestPoolDB(t, 2), newTestPoolDB(t, 3))
+	c := context.Background()
+	key := testKey(t)
+
+	l1, err := client.ObtainSemaphore(c, key, 2, time.Second, nil)
+	assert.NoError(t, err)
+	l2, err := client.ObtainSemaphore(c, key, 2, time.Second, nil)
+	assert.NoError(t, err)
+	_, err = client.ObtainSemaphore(c, key, 2, time.Second, nil)
+	assert.Equal(t, ErrNotObtained, err)
+	assert.NoError(t, l1.Release(c))
+	assert.NoError(t, l2.Release(c))
+}
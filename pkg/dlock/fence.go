@@ -0,0 +1,89 @@
+package dlock
+
+import (
+	"ascale/pkg/cache/redis"
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+// luaFenced runs a command if ARGV[1] is not older than the fencing token
+// stored at KEYS[1], which is raised to it. The command is ARGV[2] with the
+// other keys followed by the other args.
+var luaFenced = redis.NewScript(-1, `
+local cur = tonumber(redis.call("get", KEYS[1]) or "0")
+local fence = tonumber(ARGV[1])
+if fence < cur then return redis.error_reply("STALE_FENCE") end
+if fence > cur then redis.call("set", KEYS[1], ARGV[1]) end
+local cmd = {ARGV[2]}
+for i = 2, #KEYS do cmd[#cmd + 1] = KEYS[i] end
+for i = 3, #ARGV do cmd[#cmd + 1] = ARGV[i] end
+return redis.call(unpack(cmd))`)
+
+// ErrStaleFence is returned by fenced writes of a holder whose fencing token
+// is older than the last one seen by the resource.
+var ErrStaleFence = errors.New("redislock: stale fencing token")
+
+// FenceKey returns the key of the fencing token counter of a lock key.
+func FenceKey(key string) string {
+	return key + ":fence"
+}
+
+// FencedDo runs cmd on keys with args only if fence is not older than the
+// last token written to resource, e.g.
+//
+//	FencedDo(conn, "fence:order:1", lock.Fence(), "HSET", []string{"order:1"}, "status", "paid")
+//
+// resource is a redis key holding the highest token seen, it is shared by
+// every writer of the guarded keys. Commands taking their keys first are
+// supported, keys must be in the same slot on a cluster.
+func FencedDo(conn redis.Conn, resource string, fence int64, cmd string, keys []string, args ...interface{}) (reply interface{}, err error) {
+	keysAndArgs := make([]interface{}, 0, 3+len(keys)+len(args))
+	keysAndArgs = append(keysAndArgs, 1+len(keys), resource)
+	for _, k := range keys {
+		keysAndArgs = append(keysAndArgs, k)
+	}
+	keysAndArgs = append(keysAndArgs, fence, cmd)
+	keysAndArgs = append(keysAndArgs, args...)
+
+	reply, err = luaFenced.Do(conn, keysAndArgs...)
+	if e, ok := err.(redis.Error); ok && strings.HasSuffix(e.Error(), "STALE_FENCE") {
+		err = ErrStaleFence
+	}
+	return
+}
+
+// SQLNode is the part of sqalx.Node CheckFenceTx needs.
+type SQLNode interface {
+	ExecContext(c context.Context, query string, args ...interface{}) (sql.Result, error)
+	GetContext(c context.Context, dest interface{}, query string, args ...interface{}) error
+}
+
+// CheckFenceTx records fence for resource in the dlock_fences table and
+// returns ErrStaleFence when a newer token was recorded already. tx must be
+// the transaction of the guarded writes, the fence row stays locked until it
+// commits so competing holders are serialized. The table is created by
+// app/api/migrations:
+//
+//	CREATE TABLE `dlock_fences` (
+//	  `resource` varchar(255) NOT NULL,
+//	  `token` bigint NOT NULL,
+//	  PRIMARY KEY (`resource`)
+//	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+func CheckFenceTx(c context.Context, tx SQLNode, resource string, fence int64) (err error) {
+	sqlUpsert := "INSERT INTO dlock_fences( resource,token) VALUES ( ?,?) ON DUPLICATE KEY UPDATE token=GREATEST(token,VALUES(token))"
+	if _, err = tx.ExecContext(c, sqlUpsert, resource, fence); err != nil {
+		return
+	}
+
+	var token int64
+	sqlSelect := "SELECT a.token FROM dlock_fences a WHERE a.resource=?"
+	if err = tx.GetContext(c, &token, sqlSelect, resource); err != nil {
+		return
+	}
+	if token != fence {
+		return ErrStaleFence
+	}
+	return
+}
@@ -0,0 +1,51 @@
+package dlock
+
+import (
+	"ascale/pkg/cache/redis"
+	"context"
+	"time"
+)
+
+var (
+	luaReadObtain = redis.NewScript(2, luaNow+`
+if redis.call("exists", KEYS[1]) == 1 then return 0 end
+redis.call("zremrangebyscore", KEYS[2], "-inf", now)
+redis.call("zadd", KEYS[2], now + ARGV[2], ARGV[1])
+if redis.call("pttl", KEYS[2]) < tonumber(ARGV[2]) then redis.call("pexpire", KEYS[2], ARGV[2]) end
+return 1`)
+	luaWriteObtain = redis.NewScript(3, luaNow+`
+redis.call("zremrangebyscore", KEYS[2], "-inf", now)
+if redis.call("zcard", KEYS[2]) > 0 then return 0 end
+if redis.call("set", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then return redis.call("incr", KEYS[3]) end
+return 0`)
+)
+
+var readKind = &lockKind{
+	key:     readersKey,
+	refresh: luaSharedRefresh,
+	pttl:    luaSharedPTTL,
+	release: luaSharedRelease,
+}
+
+// readersKey returns the key of the read holders of the lock key.
+func readersKey(key string) string {
+	return key + ":readers"
+}
+
+// ObtainRead obtains a read lock on key, it is shared with other readers and
+// excludes writers. Readers are not blocked by waiting writers, so a steady
+// flow of readers starves them.
+func (c *Client) ObtainRead(ctx context.Context, key string, ttl time.Duration, opt *Options) (*Lock, error) {
+	return c.acquire(ctx, readKind, key, ttl, opt, func(conn redis.Conn, value string) (int64, error) {
+		return redis.Int64(luaReadObtain.Do(conn, key, readersKey(key), value, int64(ttl/time.Millisecond)))
+	})
+}
+
+// ObtainWrite obtains a write lock on key, it excludes readers and other
+// writers. It is the exclusive lock Obtain takes once the readers are gone,
+// so writers and Obtain exclude each other and share fencing tokens.
+func (c *Client) ObtainWrite(ctx context.Context, key string, ttl time.Duration, opt *Options) (*Lock, error) {
+	return c.acquire(ctx, mutexKind, key, ttl, opt, func(conn redis.Conn, value string) (int64, error) {
+		return redis.Int64(luaWriteObtain.Do(conn, key, readersKey(key), FenceKey(key), value, int64(ttl/time.Millisecond)))
+	})
+}
@@ -0,0 +1,83 @@
+package dlock
+
+import (
+	"ascale/pkg/cache/redis"
+	"ascale/pkg/log"
+	"context"
+	"strconv"
+	"time"
+)
+
+// Shared locks, read locks and semaphore slots, are members of a sorted set
+// scored by the redis time in ms they expire at. Expired members are dropped
+// by the next obtain, the set itself expires with its last member. Scripts
+// call TIME so they need redis 5 or newer.
+const luaNow = `local t = redis.call("time")
+local now = t[1] * 1000 + math.floor(t[2] / 1000)
+`
+
+// luaExtend makes the set KEYS[1] live at least ARGV[2] ms.
+const luaExtend = `
+if redis.call("pttl", KEYS[1]) < tonumber(ARGV[2]) then redis.call("pexpire", KEYS[1], ARGV[2]) end
+`
+
+var (
+	luaSemaObtain = redis.NewScript(1, luaNow+`
+redis.call("zremrangebyscore", KEYS[1], "-inf", now)
+if redis.call("zcard", KEYS[1]) >= tonumber(ARGV[3]) then return 0 end
+redis.call("zadd", KEYS[1], now + ARGV[2], ARGV[1])`+luaExtend+`
+return 1`)
+	luaSharedRefresh = redis.NewScript(1, luaNow+`
+local s = redis.call("zscore", KEYS[1], ARGV[1])
+if not s or tonumber(s) <= now then return 0 end
+redis.call("zadd", KEYS[1], now + ARGV[2], ARGV[1])`+luaExtend+`
+return 1`)
+	luaSharedPTTL = redis.NewScript(1, luaNow+`
+local s = redis.call("zscore", KEYS[1], ARGV[1])
+if not s or tonumber(s) <= now then return -3 end
+return tonumber(s) - now`)
+	luaSharedRelease = redis.NewScript(1, luaNow+`
+local s = redis.call("zscore", KEYS[1], ARGV[1])
+redis.call("zrem", KEYS[1], ARGV[1])
+if not s or tonumber(s) <= now then return 0 end
+return 1`)
+)
+
+var semaKind = &lockKind{
+	key:     func(key string) string { return key },
+	refresh: luaSharedRefresh,
+	pttl:    luaSharedPTTL,
+	release: luaSharedRelease,
+}
+
+// ObtainSemaphore obtains one of limit slots of the semaphore key, e.g. to
+// cap the workers calling an external API. Every holder of key must use the
+// same limit. The returned Lock holds the slot, it is refreshed and released
+// like an exclusive lock.
+func (c *Client) ObtainSemaphore(ctx context.Context, key string, limit int, ttl time.Duration, opt *Options) (*Lock, error) {
+	return c.acquire(ctx, semaKind, key, ttl, opt, func(conn redis.Conn, value string) (int64, error) {
+		return redis.Int64(luaSemaObtain.Do(conn, key, value, int64(ttl/time.Millisecond), limit))
+	})
+}
+
+// Holders returns the number of unexpired holders of the semaphore key, on
+// the first node in redlock mode.
+func (c *Client) Holders(ctx context.Context, key string) (n int, err error) {
+	var conn redis.Conn
+	if conn, err = c.pools[0].GetContext(ctx); err != nil {
+		log.For(ctx).Errorf("dlock.Holders(),  err(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	var t []int64
+	if t, err = redis.Int64s(conn.Do("TIME")); err != nil {
+		log.For(ctx).Errorf("dlock.Holders() TIME error(%v)", err)
+		return
+	}
+	now := t[0]*1000 + t[1]/1000
+	if n, err = redis.Int(conn.Do("ZCOUNT", key, "("+strconv.FormatInt(now, 10), "+inf")); err != nil {
+		log.For(ctx).Errorf("dlock.Holders() ZCOUNT(%s) error(%v)", key, err)
+	}
+	return
+}
@@ -0,0 +1,5 @@
+// Package externalscaler is the KEDA external scaler protocol, generated
+// from externalscaler.proto of github.com/kedacore/keda.
+package externalscaler
+
+//go:generate protoc --go_out=paths=source_relative:. --go-grpc_out=paths=source_relative:. externalscaler.proto
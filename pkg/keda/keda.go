@@ -0,0 +1,286 @@
+// Package keda implements the KEDA external scaler gRPC protocol. Workers
+// are scaled on the load of a topic, the messages in flight and the backlog
+// weighted by the time it takes to handle them, so the replicas follow the
+// cost of the messages rather than their count.
+//
+// A ScaledObject points its external trigger at the workers:
+//
+//	triggers:
+//	  - type: external
+//	    metadata:
+//	      scalerAddress: ascale-worker.uat:9000
+//	      topic: uat-do-task
+//	      targetSlots: "1"
+//	      drainWindow: 30s
+package keda
+
+import (
+	"ascale/pkg/conf/env"
+	"ascale/pkg/keda/externalscaler"
+	"ascale/pkg/log"
+	"ascale/pkg/xtime"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Metadata keys of the scaled object trigger.
+const (
+	// MetaTopic is the topic whose load scales the target, required.
+	MetaTopic = "topic"
+	// MetaTargetSlots is the number of messages a replica handles
+	// concurrently, default 1.
+	MetaTargetSlots = "targetSlots"
+	// MetaDrainWindow overrides Config.DrainWindow, e.g. "1m".
+	MetaDrainWindow = "drainWindow"
+)
+
+// Load is the load of a topic over all replicas.
+type Load struct {
+	// Backlog is the number of messages waiting to be delivered.
+	Backlog int64
+	// InFlight is the number of messages being handled.
+	InFlight int64
+	// Latency is the mean time to handle a message, 0 if unknown.
+	Latency time.Duration
+}
+
+// Active reports whether the topic has messages to handle.
+func (l *Load) Active() bool {
+	return l.Backlog > 0 || l.InFlight > 0
+}
+
+// Slots returns the messages to handle concurrently so that the backlog is
+// worked off within window while the messages in flight go on.
+func (l *Load) Slots(window time.Duration) float64 {
+	return float64(l.InFlight) + float64(l.Backlog)*l.Latency.Seconds()/window.Seconds()
+}
+
+// Source returns the load of a topic.
+type Source interface {
+	TopicLoad(c context.Context, topic string) (*Load, error)
+}
+
+// Config scaler config.
+type Config struct {
+	// Enabled serves the scaler on the workers.
+	Enabled bool
+	// Addr is the listen address, default ":" + env.GRPCPort.
+	Addr string
+	// PollInterval is how often StreamIsActive checks the load, default 5s.
+	PollInterval xtime.Duration
+	// DrainWindow is the time the backlog should be handled in, default 30s.
+	DrainWindow xtime.Duration
+	// DefaultLatency is assumed for the backlog until messages were handled,
+	// default 100ms.
+	DefaultLatency xtime.Duration
+}
+
+func (c *Config) fix() *Config {
+	cc := Config{}
+	if c != nil {
+		cc = *c
+	}
+	if cc.Addr == "" {
+		cc.Addr = ":" + env.GRPCPort
+	}
+	if cc.PollInterval <= 0 {
+		cc.PollInterval = xtime.Duration(5 * time.Second)
+	}
+	if cc.DrainWindow <= 0 {
+		cc.DrainWindow = xtime.Duration(30 * time.Second)
+	}
+	if cc.DefaultLatency <= 0 {
+		cc.DefaultLatency = xtime.Duration(100 * time.Millisecond)
+	}
+	return &cc
+}
+
+// Server is a KEDA external scaler.
+type Server struct {
+	externalscaler.UnimplementedExternalScalerServer
+
+	c   *Config
+	src Source
+	srv *grpc.Server
+
+	closing chan struct{}
+	once    sync.Once
+}
+
+var _ externalscaler.ExternalScalerServer = (*Server)(nil)
+
+// New creates a scaler of the topic loads of src.
+func New(c *Config, src Source) *Server {
+	s := &Server{
+		c:       c.fix(),
+		src:     src,
+		srv:     grpc.NewServer(),
+		closing: make(chan struct{}),
+	}
+	externalscaler.RegisterExternalScalerServer(s.srv, s)
+	return s
+}
+
+// Start listens on Addr and serves in the background.
+func (s *Server) Start() (err error) {
+	var lis net.Listener
+	if lis, err = net.Listen("tcp", s.c.Addr); err != nil {
+		return
+	}
+	go func() {
+		if err := s.Serve(lis); err != nil {
+			log.Errorf("keda.Serve(%s) error(%+v)", s.c.Addr, err)
+		}
+	}()
+	return
+}
+
+// Serve serves on lis until Close.
+func (s *Server) Serve(lis net.Listener) error {
+	return s.srv.Serve(lis)
+}
+
+// Close ends the StreamIsActive calls and stops the server.
+func (s *Server) Close() {
+	s.once.Do(func() { close(s.closing) })
+	s.srv.GracefulStop()
+}
+
+// scaledObject is the trigger metadata of a scaled object.
+type scaledObject struct {
+	topic  string
+	slots  float64
+	window time.Duration
+}
+
+func (s *Server) scaledObject(ref *externalscaler.ScaledObjectRef) (so *scaledObject, err error) {
+	md := ref.GetScalerMetadata()
+	so = &scaledObject{
+		topic:  md[MetaTopic],
+		slots:  1,
+		window: time.Duration(s.c.DrainWindow),
+	}
+	if so.topic == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "scaled object %s/%s: %s is required", ref.GetNamespace(), ref.GetName(), MetaTopic)
+	}
+	if v, ok := md[MetaTargetSlots]; ok {
+		if so.slots, err = strconv.ParseFloat(v, 64); err != nil || so.slots <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "scaled object %s/%s: %s(%s) must be a positive number", ref.GetNamespace(), ref.GetName(), MetaTargetSlots, v)
+		}
+	}
+	if v, ok := md[MetaDrainWindow]; ok {
+		if so.window, err = time.ParseDuration(v); err != nil || so.window <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "scaled object %s/%s: %s(%s) must be a positive duration", ref.GetNamespace(), ref.GetName(), MetaDrainWindow, v)
+		}
+	}
+	return
+}
+
+func (so *scaledObject) metricName() string {
+	return fmt.Sprintf("%s-slots", so.topic)
+}
+
+func (s *Server) load(c context.Context, so *scaledObject) (l *Load, err error) {
+	if l, err = s.src.TopicLoad(c, so.topic); err != nil {
+		log.For(c).Errorf("keda.load(%s) error(%+v)", so.topic, err)
+		return nil, status.Errorf(codes.Unavailable, "load of %s: %v", so.topic, err)
+	}
+	if l.Latency <= 0 {
+		l.Latency = time.Duration(s.c.DefaultLatency)
+	}
+	return
+}
+
+// IsActive reports whether the topic has messages, KEDA scales from and to
+// zero on it.
+func (s *Server) IsActive(c context.Context, ref *externalscaler.ScaledObjectRef) (resp *externalscaler.IsActiveResponse, err error) {
+	var (
+		so *scaledObject
+		l  *Load
+	)
+	if so, err = s.scaledObject(ref); err != nil {
+		return
+	}
+	if l, err = s.load(c, so); err != nil {
+		return
+	}
+	return &externalscaler.IsActiveResponse{Result: l.Active()}, nil
+}
+
+// StreamIsActive pushes the activity of the topic every time it changes.
+func (s *Server) StreamIsActive(ref *externalscaler.ScaledObjectRef, stream externalscaler.ExternalScaler_StreamIsActiveServer) (err error) {
+	var so *scaledObject
+	if so, err = s.scaledObject(ref); err != nil {
+		return
+	}
+
+	c := stream.Context()
+	ticker := time.NewTicker(time.Duration(s.c.PollInterval))
+	defer ticker.Stop()
+	sent, active := false, false
+	for {
+		// a failed poll keeps the last state, KEDA reconnects on errors.
+		if l, e := s.load(c, so); e == nil && (!sent || l.Active() != active) {
+			active = l.Active()
+			if err = stream.Send(&externalscaler.IsActiveResponse{Result: active}); err != nil {
+				return
+			}
+			sent = true
+		}
+
+		select {
+		case <-c.Done():
+			return nil
+		case <-s.closing:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// GetMetricSpec returns the slots a replica of the target handles.
+func (s *Server) GetMetricSpec(c context.Context, ref *externalscaler.ScaledObjectRef) (resp *externalscaler.GetMetricSpecResponse, err error) {
+	var so *scaledObject
+	if so, err = s.scaledObject(ref); err != nil {
+		return
+	}
+	return &externalscaler.GetMetricSpecResponse{
+		MetricSpecs: []*externalscaler.MetricSpec{{
+			MetricName:      so.metricName(),
+			TargetSize:      int64(math.Ceil(so.slots)),
+			TargetSizeFloat: so.slots,
+		}},
+	}, nil
+}
+
+// GetMetrics returns the slots the load of the topic needs, the target is
+// scaled to slots / targetSlots replicas.
+func (s *Server) GetMetrics(c context.Context, req *externalscaler.GetMetricsRequest) (resp *externalscaler.GetMetricsResponse, err error) {
+	var (
+		so *scaledObject
+		l  *Load
+	)
+	if so, err = s.scaledObject(req.GetScaledObjectRef()); err != nil {
+		return
+	}
+	if l, err = s.load(c, so); err != nil {
+		return
+	}
+	slots := l.Slots(so.window)
+	return &externalscaler.GetMetricsResponse{
+		MetricValues: []*externalscaler.MetricValue{{
+			MetricName:       so.metricName(),
+			MetricValue:      int64(math.Ceil(slots)),
+			MetricValueFloat: slots,
+		}},
+	}, nil
+}
@@ -0,0 +1,139 @@
+package keda
+
+import (
+	"ascale/pkg/keda/externalscaler"
+	"ascale/pkg/xtime"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type source struct {
+	mu    sync.Mutex
+	loads map[string]*Load
+}
+
+func (s *source) TopicLoad(c context.Context, topic string) (*Load, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.loads[topic]
+	if !ok {
+		return nil, errors.New("redis down")
+	}
+	cp := *l
+	return &cp, nil
+}
+
+func (s *source) set(topic string, l *Load) {
+	s.mu.Lock()
+	s.loads[topic] = l
+	s.mu.Unlock()
+}
+
+func setup(t *testing.T) (*source, externalscaler.ExternalScalerClient) {
+	src := &source{loads: make(map[string]*Load)}
+	s := New(&Config{PollInterval: xtime.Duration(10 * time.Millisecond)}, src)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go s.Serve(lis)
+
+	cc, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		cc.Close()
+		s.Close()
+	})
+	return src, externalscaler.NewExternalScalerClient(cc)
+}
+
+func ref(md map[string]string) *externalscaler.ScaledObjectRef {
+	return &externalscaler.ScaledObjectRef{Name: "worker", Namespace: "uat", ScalerMetadata: md}
+}
+
+func TestSlots(t *testing.T) {
+	l := &Load{Backlog: 600, InFlight: 4, Latency: 200 * time.Millisecond}
+	assert.InDelta(t, 8.0, l.Slots(30*time.Second), 1e-9)
+	assert.True(t, l.Active())
+	assert.False(t, (&Load{}).Active())
+}
+
+func TestMetrics(t *testing.T) {
+	src, client := setup(t)
+	c := context.Background()
+	md := map[string]string{MetaTopic: "do-task", MetaTargetSlots: "2", MetaDrainWindow: "1m"}
+
+	spec, err := client.GetMetricSpec(c, ref(md))
+	assert.NoError(t, err)
+	assert.Len(t, spec.MetricSpecs, 1)
+	assert.Equal(t, "do-task-slots", spec.MetricSpecs[0].MetricName)
+	assert.Equal(t, int64(2), spec.MetricSpecs[0].TargetSize)
+	assert.Equal(t, 2.0, spec.MetricSpecs[0].TargetSizeFloat)
+
+	// latency is not known yet, the default 100ms applies.
+	src.set("do-task", &Load{Backlog: 1200, InFlight: 3})
+	resp, err := client.GetMetrics(c, &externalscaler.GetMetricsRequest{ScaledObjectRef: ref(md), MetricName: "do-task-slots"})
+	assert.NoError(t, err)
+	assert.Len(t, resp.MetricValues, 1)
+	assert.InDelta(t, 5.0, resp.MetricValues[0].MetricValueFloat, 1e-9)
+	assert.Equal(t, int64(5), resp.MetricValues[0].MetricValue)
+
+	src.set("do-task", &Load{Backlog: 1200, InFlight: 3, Latency: 250 * time.Millisecond})
+	resp, err = client.GetMetrics(c, &externalscaler.GetMetricsRequest{ScaledObjectRef: ref(md), MetricName: "do-task-slots"})
+	assert.NoError(t, err)
+	assert.InDelta(t, 8.0, resp.MetricValues[0].MetricValueFloat, 1e-9)
+
+	active, err := client.IsActive(c, ref(md))
+	assert.NoError(t, err)
+	assert.True(t, active.Result)
+	src.set("do-task", &Load{})
+	active, err = client.IsActive(c, ref(md))
+	assert.NoError(t, err)
+	assert.False(t, active.Result)
+}
+
+func TestInvalid(t *testing.T) {
+	_, client := setup(t)
+	c := context.Background()
+
+	for _, md := range []map[string]string{
+		{},
+		{MetaTopic: "do-task", MetaTargetSlots: "0"},
+		{MetaTopic: "do-task", MetaDrainWindow: "soon"},
+	} {
+		_, err := client.GetMetricSpec(c, ref(md))
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), "%v", md)
+	}
+
+	_, err := client.IsActive(c, ref(map[string]string{MetaTopic: "missing"}))
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestStreamIsActive(t *testing.T) {
+	src, client := setup(t)
+	c, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	src.set("do-task", &Load{})
+	stream, err := client.StreamIsActive(c, ref(map[string]string{MetaTopic: "do-task"}))
+	assert.NoError(t, err)
+
+	var got []bool
+	for _, l := range []*Load{{Backlog: 10}, {}} {
+		resp, err := stream.Recv()
+		assert.NoError(t, err)
+		got = append(got, resp.Result)
+		src.set("do-task", l)
+	}
+	resp, err := stream.Recv()
+	assert.NoError(t, err)
+	got = append(got, resp.Result)
+	assert.Equal(t, []bool{false, true, false}, got)
+}
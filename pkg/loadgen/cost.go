@@ -0,0 +1,100 @@
+package loadgen
+
+import (
+	"ascale/pkg/xtime"
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Distribution of the work cost of events.
+type Distribution string
+
+const (
+	// DistFixed costs Mean every time, the default.
+	DistFixed Distribution = "fixed"
+	// DistUniform costs between 0 and twice Mean.
+	DistUniform Distribution = "uniform"
+	// DistExponential costs mostly little with a long tail.
+	DistExponential Distribution = "exponential"
+	// DistLogNormal has a heavier tail, a few events cost many times Mean.
+	DistLogNormal Distribution = "lognormal"
+)
+
+// Cost is the simulated work of an event.
+type Cost struct {
+	Dist Distribution   `json:"dist"`
+	Mean xtime.Duration `json:"mean"`
+	// Max caps a cost, default 100 times Mean.
+	Max xtime.Duration `json:"max,omitempty"`
+	// CPU burns the cost busy looping instead of sleeping, for CPU based
+	// scaling.
+	CPU bool `json:"cpu"`
+}
+
+// Validate checks the cost, it fills the defaults.
+func (p *Cost) Validate() error {
+	if p.Dist == "" {
+		p.Dist = DistFixed
+	}
+	switch p.Dist {
+	case DistFixed, DistUniform, DistExponential, DistLogNormal:
+	default:
+		return fmt.Errorf("loadgen: unknown cost distribution(%s)", p.Dist)
+	}
+	if p.Mean < 0 {
+		return fmt.Errorf("loadgen: cost mean must not be negative")
+	}
+	if p.Max <= 0 {
+		p.Max = 100 * p.Mean
+	}
+	return nil
+}
+
+// Sample draws a cost.
+func (p *Cost) Sample(rnd *rand.Rand) (d time.Duration) {
+	mean := float64(p.Mean)
+	switch p.Dist {
+	case DistUniform:
+		d = time.Duration(2 * mean * rnd.Float64())
+	case DistExponential:
+		d = time.Duration(mean * rnd.ExpFloat64())
+	case DistLogNormal:
+		// sigma 1, mu set so the mean is Mean.
+		const sigma = 1.0
+		d = time.Duration(math.Exp(math.Log(mean) - sigma*sigma/2 + sigma*rnd.NormFloat64()))
+	default:
+		d = time.Duration(p.Mean)
+	}
+	if max := time.Duration(p.Max); d > max {
+		d = max
+	}
+	return
+}
+
+// Work spends d sleeping, or busy looping when cpu is set, until c is done.
+func Work(c context.Context, d time.Duration, cpu bool) {
+	if d <= 0 {
+		return
+	}
+	if !cpu {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-c.Done():
+		case <-t.C:
+		}
+		return
+	}
+
+	end := time.Now().Add(d)
+	x := 1.0
+	for i := 0; time.Now().Before(end); i++ {
+		x = math.Sqrt(x + float64(i))
+		if i%1000 == 0 && c.Err() != nil {
+			return
+		}
+	}
+}
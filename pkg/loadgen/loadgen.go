@@ -0,0 +1,235 @@
+// Package loadgen generates load following a rate profile, to exercise
+// autoscaling with realistic traffic shapes instead of a constant rate.
+//
+// A Profile gives the target rate at every point of a run, a Generator emits
+// events at that rate with uniform or Poisson arrivals.
+package loadgen
+
+import (
+	"ascale/pkg/xtime"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Shape is the form of the rate over a run.
+type Shape string
+
+const (
+	// ShapeConstant keeps Rate.
+	ShapeConstant Shape = "constant"
+	// ShapeRamp goes linearly from BaseRate to Rate.
+	ShapeRamp Shape = "ramp"
+	// ShapeStep goes from BaseRate to Rate in Steps equal steps.
+	ShapeStep Shape = "step"
+	// ShapeSine oscillates between BaseRate and Rate every Period.
+	ShapeSine Shape = "sine"
+	// ShapeSpike keeps BaseRate but for SpikeLength from SpikeAt at Rate.
+	ShapeSpike Shape = "spike"
+)
+
+// Arrival is how events are spread within the rate.
+type Arrival string
+
+const (
+	// ArrivalUniform spaces events evenly, the default.
+	ArrivalUniform Arrival = "uniform"
+	// ArrivalPoisson draws events as a Poisson process, bursts and gaps
+	// included.
+	ArrivalPoisson Arrival = "poisson"
+)
+
+// MaxRate is the highest rate of a profile, in events per second.
+const MaxRate = 100000
+
+// Profile describes the target rate of a run, rates are events per second.
+type Profile struct {
+	Shape   Shape   `json:"shape"`
+	Arrival Arrival `json:"arrival"`
+	// Rate is the target rate, the end of ramps and steps, the peak of sines
+	// and spikes.
+	Rate float64 `json:"rate"`
+	// BaseRate is the start of ramps and steps, the low of sines and the
+	// rate around spikes.
+	BaseRate float64 `json:"base_rate"`
+	// Duration of the run.
+	Duration xtime.Duration `json:"duration"`
+	// Steps of ShapeStep, default 5.
+	Steps int `json:"steps,omitempty"`
+	// Period of ShapeSine, default a fourth of Duration.
+	Period xtime.Duration `json:"period,omitempty"`
+	// SpikeAt and SpikeLength of ShapeSpike, default the middle tenth of
+	// Duration.
+	SpikeAt     xtime.Duration `json:"spike_at,omitempty"`
+	SpikeLength xtime.Duration `json:"spike_length,omitempty"`
+}
+
+// Validate checks the profile, it fills the defaults of its shape.
+func (p *Profile) Validate() error {
+	if p.Shape == "" {
+		p.Shape = ShapeConstant
+	}
+	if p.Arrival == "" {
+		p.Arrival = ArrivalUniform
+	}
+	switch p.Arrival {
+	case ArrivalUniform, ArrivalPoisson:
+	default:
+		return fmt.Errorf("loadgen: unknown arrival(%s)", p.Arrival)
+	}
+	if p.Rate <= 0 || p.Rate > MaxRate || p.BaseRate < 0 || p.BaseRate > MaxRate {
+		return fmt.Errorf("loadgen: rates must be in (0, %d]", MaxRate)
+	}
+	if p.Duration <= 0 {
+		return errors.New("loadgen: duration is required")
+	}
+
+	d := time.Duration(p.Duration)
+	switch p.Shape {
+	case ShapeConstant, ShapeRamp:
+	case ShapeStep:
+		if p.Steps <= 0 {
+			p.Steps = 5
+		}
+	case ShapeSine:
+		if p.Period <= 0 {
+			p.Period = xtime.Duration(d / 4)
+		}
+	case ShapeSpike:
+		if p.SpikeLength <= 0 {
+			p.SpikeAt, p.SpikeLength = xtime.Duration(d*9/20), xtime.Duration(d/10)
+		}
+		if p.SpikeAt < 0 || time.Duration(p.SpikeAt) >= d {
+			return errors.New("loadgen: spike_at must be within duration")
+		}
+	default:
+		return fmt.Errorf("loadgen: unknown shape(%s)", p.Shape)
+	}
+	return nil
+}
+
+// RateAt returns the target rate at t since the start of the run.
+func (p *Profile) RateAt(t time.Duration) float64 {
+	d := time.Duration(p.Duration)
+	if t < 0 || t >= d {
+		return 0
+	}
+	x := float64(t) / float64(d)
+	switch p.Shape {
+	case ShapeRamp:
+		return p.BaseRate + (p.Rate-p.BaseRate)*x
+	case ShapeStep:
+		step := math.Floor(x * float64(p.Steps))
+		if p.Steps == 1 {
+			return p.Rate
+		}
+		return p.BaseRate + (p.Rate-p.BaseRate)*step/float64(p.Steps-1)
+	case ShapeSine:
+		phase := 2 * math.Pi * float64(t) / float64(p.Period)
+		return p.BaseRate + (p.Rate-p.BaseRate)*(1-math.Cos(phase))/2
+	case ShapeSpike:
+		if t >= time.Duration(p.SpikeAt) && t < time.Duration(p.SpikeAt+p.SpikeLength) {
+			return p.Rate
+		}
+		return p.BaseRate
+	}
+	return p.Rate
+}
+
+// Expected returns the number of events of a run, on average for Poisson
+// arrivals.
+func (p *Profile) Expected() int64 {
+	const dt = 10 * time.Millisecond
+	var n float64
+	for t := time.Duration(0); t < time.Duration(p.Duration); t += dt {
+		n += p.RateAt(t) * dt.Seconds()
+	}
+	return int64(math.Round(n))
+}
+
+// Generator emits the events of a profile.
+type Generator struct {
+	p    *Profile
+	tick time.Duration
+	rnd  *rand.Rand
+}
+
+// New creates a generator of a validated profile.
+func New(p *Profile) *Generator {
+	return &Generator{
+		p:    p,
+		tick: 10 * time.Millisecond,
+		rnd:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Run calls fn for every event until the profile ends or c is done, it
+// returns the number of events. Events are emitted in batches every 10ms,
+// when fn is slower than the rate the next batches catch up.
+func (g *Generator) Run(c context.Context, fn func()) (n int64) {
+	t := time.NewTicker(g.tick)
+	defer t.Stop()
+
+	var (
+		start = time.Now()
+		last  time.Duration
+		due   float64
+	)
+	for {
+		select {
+		case <-c.Done():
+			return
+		case now := <-t.C:
+			elapsed := now.Sub(start)
+			if elapsed >= time.Duration(g.p.Duration) {
+				return
+			}
+			// the rate at the middle of the interval since the last batch.
+			dt := elapsed - last
+			mean := g.p.RateAt(last+dt/2) * dt.Seconds()
+			last = elapsed
+
+			var k int64
+			if g.p.Arrival == ArrivalPoisson {
+				k = g.poisson(mean)
+			} else {
+				due += mean
+				k = int64(due)
+				due -= float64(k)
+			}
+			for i := int64(0); i < k; i++ {
+				if c.Err() != nil {
+					return
+				}
+				fn()
+				n++
+			}
+		}
+	}
+}
+
+// poisson draws the number of events of a Poisson process with mean.
+func (g *Generator) poisson(mean float64) int64 {
+	if mean <= 0 {
+		return 0
+	}
+	if mean > 30 {
+		// normal approximation, exact enough for load shapes.
+		k := math.Round(mean + math.Sqrt(mean)*g.rnd.NormFloat64())
+		if k < 0 {
+			return 0
+		}
+		return int64(k)
+	}
+	// Knuth
+	l, k, p := math.Exp(-mean), int64(0), 1.0
+	for {
+		if p *= g.rnd.Float64(); p <= l {
+			return k
+		}
+		k++
+	}
+}
@@ -0,0 +1,99 @@
+package loadgen
+
+import (
+	"ascale/pkg/xtime"
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateAt(t *testing.T) {
+	d := xtime.Duration(100 * time.Second)
+	tests := []struct {
+		p    Profile
+		at   time.Duration
+		rate float64
+	}{
+		{Profile{Shape: ShapeConstant, Rate: 10, Duration: d}, 50 * time.Second, 10},
+		{Profile{Shape: ShapeRamp, BaseRate: 10, Rate: 110, Duration: d}, 0, 10},
+		{Profile{Shape: ShapeRamp, BaseRate: 10, Rate: 110, Duration: d}, 50 * time.Second, 60},
+		{Profile{Shape: ShapeStep, BaseRate: 0, Rate: 100, Steps: 5, Duration: d}, 10 * time.Second, 0},
+		{Profile{Shape: ShapeStep, BaseRate: 0, Rate: 100, Steps: 5, Duration: d}, 30 * time.Second, 25},
+		{Profile{Shape: ShapeStep, BaseRate: 0, Rate: 100, Steps: 5, Duration: d}, 99 * time.Second, 100},
+		{Profile{Shape: ShapeSine, BaseRate: 10, Rate: 30, Period: xtime.Duration(20 * time.Second), Duration: d}, 0, 10},
+		{Profile{Shape: ShapeSine, BaseRate: 10, Rate: 30, Period: xtime.Duration(20 * time.Second), Duration: d}, 10 * time.Second, 30},
+		{Profile{Shape: ShapeSpike, BaseRate: 5, Rate: 500, Duration: d}, 10 * time.Second, 5},
+		{Profile{Shape: ShapeSpike, BaseRate: 5, Rate: 500, Duration: d}, 50 * time.Second, 500},
+		{Profile{Shape: ShapeConstant, Rate: 10, Duration: d}, 100 * time.Second, 0},
+	}
+	for _, tt := range tests {
+		p := tt.p
+		assert.NoError(t, p.Validate())
+		assert.InDelta(t, tt.rate, p.RateAt(tt.at), 1e-9, "%s at %s", p.Shape, tt.at)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	assert.Error(t, (&Profile{Rate: 10}).Validate())
+	assert.Error(t, (&Profile{Duration: xtime.Duration(time.Second)}).Validate())
+	assert.Error(t, (&Profile{Shape: "saw", Rate: 1, Duration: xtime.Duration(time.Second)}).Validate())
+	assert.Error(t, (&Profile{Arrival: "burst", Rate: 1, Duration: xtime.Duration(time.Second)}).Validate())
+	assert.Error(t, (&Cost{Dist: "pareto"}).Validate())
+
+	p := &Profile{Rate: 1, Duration: xtime.Duration(time.Second)}
+	assert.NoError(t, p.Validate())
+	assert.Equal(t, ShapeConstant, p.Shape)
+	assert.Equal(t, ArrivalUniform, p.Arrival)
+}
+
+func TestExpected(t *testing.T) {
+	p := &Profile{Shape: ShapeRamp, BaseRate: 0, Rate: 100, Duration: xtime.Duration(10 * time.Second)}
+	assert.NoError(t, p.Validate())
+	assert.InDelta(t, 500, p.Expected(), 1)
+}
+
+func TestRun(t *testing.T) {
+	for _, arrival := range []Arrival{ArrivalUniform, ArrivalPoisson} {
+		p := &Profile{Arrival: arrival, Rate: 2000, Duration: xtime.Duration(500 * time.Millisecond)}
+		assert.NoError(t, p.Validate())
+		var calls int64
+		n := New(p).Run(context.Background(), func() { calls++ })
+		assert.Equal(t, calls, n)
+		assert.InDelta(t, p.Expected(), n, float64(p.Expected())*0.2, "%s", arrival)
+	}
+
+	c, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	p := &Profile{Rate: 1000, Duration: xtime.Duration(time.Minute)}
+	assert.NoError(t, p.Validate())
+	start := time.Now()
+	New(p).Run(c, func() {})
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestCostSample(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, dist := range []Distribution{DistFixed, DistUniform, DistExponential, DistLogNormal} {
+		p := &Cost{Dist: dist, Mean: xtime.Duration(10 * time.Millisecond)}
+		assert.NoError(t, p.Validate())
+		var sum time.Duration
+		const n = 20000
+		for i := 0; i < n; i++ {
+			d := p.Sample(rnd)
+			assert.True(t, d >= 0 && d <= time.Second)
+			sum += d
+		}
+		assert.InDelta(t, float64(10*time.Millisecond), float64(sum/n), float64(time.Millisecond), "%s", dist)
+	}
+}
+
+func TestWork(t *testing.T) {
+	for _, cpu := range []bool{false, true} {
+		start := time.Now()
+		Work(context.Background(), 20*time.Millisecond, cpu)
+		assert.True(t, time.Since(start) >= 20*time.Millisecond)
+	}
+}
@@ -0,0 +1,227 @@
+package mq
+
+import (
+	"ascale/pkg/rate"
+	"ascale/pkg/rate/vegas"
+	"ascale/pkg/stat/prom"
+	"ascale/pkg/xtime"
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// AdaptiveConfig adaptive concurrency config, zero values use the defaults.
+type AdaptiveConfig struct {
+	// MinConcurrency and MaxConcurrency bound the limit, default 1 and 64.
+	MinConcurrency int
+	MaxConcurrency int
+	// CPUThreshold is the cpu usage, per mille of the cpu quota, above which
+	// the limit is decreased, default 800.
+	CPUThreshold uint64
+	// Interval between updates of the limit, default 1s.
+	Interval xtime.Duration
+}
+
+func (c *AdaptiveConfig) fix() *AdaptiveConfig {
+	cc := AdaptiveConfig{}
+	if c != nil {
+		cc = *c
+	}
+	if cc.MinConcurrency <= 0 {
+		cc.MinConcurrency = 1
+	}
+	if cc.MaxConcurrency <= 0 {
+		cc.MaxConcurrency = 64
+	}
+	if cc.MaxConcurrency < cc.MinConcurrency {
+		cc.MaxConcurrency = cc.MinConcurrency
+	}
+	if cc.CPUThreshold == 0 {
+		cc.CPUThreshold = 800
+	}
+	if cc.Interval <= 0 {
+		cc.Interval = xtime.Duration(time.Second)
+	}
+	return &cc
+}
+
+// Adaptive limits the messages of a subscription handled concurrently, the
+// limit is adjusted at runtime so that a replica uses its cpu without
+// overloading it:
+//
+//   - cpu usage above the threshold decreases it by a tenth.
+//   - the limit of vegas.Vegas caps it, vegas lowers it once handling time
+//     grows with concurrency, e.g. a saturated database.
+//   - otherwise it grows by its square root while all slots were busy.
+//
+// It is the Limiter of the subscription, the drivers pull no more messages
+// than the limit. Wrap measures the handling time and concurrency.
+type Adaptive struct {
+	c     *AdaptiveConfig
+	cpu   func() uint64
+	name  string
+	vegas *vegas.Vegas
+
+	mu    sync.Mutex
+	limit int
+	// inflight are the slots taken, handling the messages in handlers.
+	inflight int
+	handling int
+	// peak is the max handling since the last update.
+	peak int
+	// free is closed when a slot may have been freed, changed when the
+	// limit changed.
+	free    chan struct{}
+	changed chan struct{}
+
+	closing chan struct{}
+	once    sync.Once
+}
+
+var _ Limiter = (*Adaptive)(nil)
+
+// NewAdaptive creates the limiter of the subscription, cpu returns the cpu
+// usage in per mille, the limit follows handling time only when it is nil.
+// It becomes cfg.Limiter and cfg.MaxOutstandingMessages is raised to
+// MaxConcurrency.
+func NewAdaptive(cfg *SubscriptionConfig, c *AdaptiveConfig, cpu func() uint64) *Adaptive {
+	a := &Adaptive{
+		c:       c.fix(),
+		cpu:     cpu,
+		name:    fmt.Sprintf("consumer:%s", cfg.Topic),
+		vegas:   vegas.New(),
+		free:    make(chan struct{}),
+		changed: make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+	a.limit = a.c.MinConcurrency
+	cfg.MaxOutstandingMessages = a.c.MaxConcurrency
+	cfg.Limiter = a
+	prom.ConsumerConcurrency.State(a.name, int64(a.limit))
+	go a.updateproc()
+	return a
+}
+
+// Limit returns the current limit.
+func (a *Adaptive) Limit() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.limit
+}
+
+// Watch returns the current limit and a channel closed once it changes.
+func (a *Adaptive) Watch() (int, <-chan struct{}) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.limit, a.changed
+}
+
+// Wrap returns h measured by a, the limit follows its handling time and
+// concurrency.
+func (a *Adaptive) Wrap(h Handler) Handler {
+	return func(c context.Context, msg Message) {
+		a.mu.Lock()
+		if a.handling++; a.handling > a.peak {
+			a.peak = a.handling
+		}
+		a.mu.Unlock()
+		done, _ := a.vegas.Acquire()
+		start := time.Now()
+		defer func() {
+			done(start, rate.Success)
+			a.mu.Lock()
+			a.handling--
+			a.mu.Unlock()
+		}()
+		h(c, msg)
+	}
+}
+
+// Close stops updating the limit.
+func (a *Adaptive) Close() {
+	a.once.Do(func() { close(a.closing) })
+}
+
+// Acquire takes a slot, waiting for one until c is done when wait is set.
+func (a *Adaptive) Acquire(c context.Context, wait bool) bool {
+	for {
+		a.mu.Lock()
+		if a.inflight < a.limit {
+			a.inflight++
+			a.mu.Unlock()
+			return true
+		}
+		free := a.free
+		a.mu.Unlock()
+		if !wait {
+			return false
+		}
+
+		select {
+		case <-c.Done():
+			return false
+		case <-free:
+		}
+	}
+}
+
+// Release gives back a slot.
+func (a *Adaptive) Release() {
+	a.mu.Lock()
+	a.inflight--
+	a.wakeup()
+	a.mu.Unlock()
+}
+
+// wakeup lets the waiters check for a slot, a.mu must be held.
+func (a *Adaptive) wakeup() {
+	close(a.free)
+	a.free = make(chan struct{})
+}
+
+func (a *Adaptive) updateproc() {
+	ticker := time.NewTicker(time.Duration(a.c.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.closing:
+			return
+		case <-ticker.C:
+		}
+		a.update()
+	}
+}
+
+func (a *Adaptive) update() {
+	var usage uint64
+	if a.cpu != nil {
+		usage = a.cpu()
+	}
+	capped := int(a.vegas.Stat().Limit)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	limit, peak := a.limit, a.peak
+	a.peak = a.handling
+	switch {
+	case usage > a.c.CPUThreshold:
+		limit -= max(1, limit/10)
+	case capped < limit:
+		limit = capped
+	case peak >= limit:
+		limit = min(capped, limit+max(1, int(math.Sqrt(float64(limit)))))
+	}
+	limit = max(a.c.MinConcurrency, min(a.c.MaxConcurrency, limit))
+	if limit == a.limit {
+		return
+	}
+	if limit > a.limit {
+		a.wakeup()
+	}
+	close(a.changed)
+	a.changed = make(chan struct{})
+	a.limit = limit
+	prom.ConsumerConcurrency.State(a.name, int64(limit))
+}
@@ -0,0 +1,134 @@
+package mq_test
+
+import (
+	"ascale/pkg/mq"
+	"ascale/pkg/xtime"
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// deliver calls h from n goroutines like a driver does, a slot of l is taken
+// before every message, until c is done.
+func deliver(c context.Context, n int, l mq.Limiter, h mq.Handler) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c.Err() == nil && l.Acquire(c, true) {
+				h(c, nil)
+				l.Release()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// track returns a handler which sleeps d and records its max concurrency.
+func track(d time.Duration, peak *int64) mq.Handler {
+	var inflight int64
+	return func(c context.Context, msg mq.Message) {
+		n := atomic.AddInt64(&inflight, 1)
+		for p := atomic.LoadInt64(peak); n > p && !atomic.CompareAndSwapInt64(peak, p, n); p = atomic.LoadInt64(peak) {
+		}
+		time.Sleep(d)
+		atomic.AddInt64(&inflight, -1)
+	}
+}
+
+func TestAdaptiveGrows(t *testing.T) {
+	cfg := &mq.SubscriptionConfig{Topic: "topic"}
+	a := mq.NewAdaptive(cfg, &mq.AdaptiveConfig{
+		MaxConcurrency: 16,
+		Interval:       xtime.Duration(20 * time.Millisecond),
+	}, func() uint64 { return 100 })
+	defer a.Close()
+	assert.Equal(t, 16, cfg.MaxOutstandingMessages)
+	assert.Equal(t, a, cfg.Limiter)
+	assert.Equal(t, 1, a.Limit())
+
+	var peak int64
+	h := a.Wrap(track(5*time.Millisecond, &peak))
+	c, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	deliver(c, 16, a, h)
+
+	// waiting on i/o, the cpu is idle and the limit grows to the max.
+	assert.Equal(t, 16, a.Limit())
+	assert.LessOrEqual(t, atomic.LoadInt64(&peak), int64(16))
+}
+
+func TestAdaptiveCPUOverload(t *testing.T) {
+	var usage uint64 = 100
+	cfg := &mq.SubscriptionConfig{Topic: "topic"}
+	a := mq.NewAdaptive(cfg, &mq.AdaptiveConfig{
+		MinConcurrency: 2,
+		MaxConcurrency: 8,
+		Interval:       xtime.Duration(20 * time.Millisecond),
+	}, func() uint64 { return atomic.LoadUint64(&usage) })
+	defer a.Close()
+
+	var peak int64
+	h := a.Wrap(track(2*time.Millisecond, &peak))
+	c, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		deliver(c, 8, a, h)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool { return a.Limit() == 8 }, time.Second, 10*time.Millisecond)
+	atomic.StoreUint64(&usage, 950)
+	assert.Eventually(t, func() bool { return a.Limit() == 2 }, time.Second, 10*time.Millisecond)
+
+	// the slots over the new limit are given back as messages finish.
+	time.Sleep(50 * time.Millisecond)
+	atomic.StoreInt64(&peak, 0)
+	time.Sleep(50 * time.Millisecond)
+	assert.LessOrEqual(t, atomic.LoadInt64(&peak), int64(2))
+	cancel()
+	<-done
+}
+
+func TestAdaptiveAcquire(t *testing.T) {
+	cfg := &mq.SubscriptionConfig{Topic: "topic"}
+	a := mq.NewAdaptive(cfg, &mq.AdaptiveConfig{
+		MaxConcurrency: 2,
+		Interval:       xtime.Duration(20 * time.Millisecond),
+	}, nil)
+	defer a.Close()
+
+	// messages are not pulled over the limit, a waiting driver stops with
+	// its context.
+	c, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.True(t, a.Acquire(c, true))
+	assert.False(t, a.Acquire(c, false))
+	assert.False(t, a.Acquire(c, true))
+
+	// slots taken by pulls which have not reached the handler are not busy,
+	// the limit grows only with handling.
+	limit, changed := a.Watch()
+	assert.Equal(t, 1, limit)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, a.Limit())
+
+	release := make(chan struct{})
+	h := a.Wrap(func(c context.Context, msg mq.Message) { <-release })
+	go h(context.Background(), nil)
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("limit not changed")
+	}
+	assert.Equal(t, 2, a.Limit())
+	assert.True(t, a.Acquire(context.Background(), false))
+	close(release)
+	a.Release()
+	a.Release()
+}
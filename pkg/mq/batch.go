@@ -0,0 +1,277 @@
+package mq
+
+import (
+	"ascale/pkg/xtime"
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// BatchPublisher is implemented by brokers which publish many messages in
+// one round trip, Batcher falls back to Publish one by one otherwise.
+type BatchPublisher interface {
+	// PublishBatch publishes envs to topic, ids and errs are in the order of
+	// envs.
+	PublishBatch(c context.Context, topic string, envs []*Envelope) (ids []string, errs []error)
+}
+
+// BatchConfig batcher config, zero values use the defaults.
+type BatchConfig struct {
+	// CountThreshold publishes a batch once it has that many messages,
+	// default 100.
+	CountThreshold int
+	// ByteThreshold publishes a batch once its payloads reach that size,
+	// default 1MB.
+	ByteThreshold int
+	// DelayThreshold publishes a batch at most that long after its first
+	// message, default 10ms.
+	DelayThreshold xtime.Duration
+	// MaxOutstandingMessages and MaxOutstandingBytes bound the messages not
+	// published yet, Publish blocks when they are reached. Default 1000 and
+	// 10MB.
+	MaxOutstandingMessages int
+	MaxOutstandingBytes    int
+	// NumGoroutines is the number of batches published concurrently,
+	// default 4. Messages with an ordering key are published by one of them
+	// batch after batch, so that the messages of a key keep their order.
+	NumGoroutines int
+	// Timeout of publishing a batch, default 60s.
+	Timeout xtime.Duration
+	// OnError is called for every message which failed to publish, from the
+	// publishing goroutines.
+	OnError func(env *Envelope, err error)
+}
+
+func (c *BatchConfig) fix() *BatchConfig {
+	cc := BatchConfig{}
+	if c != nil {
+		cc = *c
+	}
+	if cc.CountThreshold <= 0 {
+		cc.CountThreshold = 100
+	}
+	if cc.ByteThreshold <= 0 {
+		cc.ByteThreshold = 1 << 20
+	}
+	if cc.DelayThreshold <= 0 {
+		cc.DelayThreshold = xtime.Duration(10 * time.Millisecond)
+	}
+	if cc.MaxOutstandingMessages <= 0 {
+		cc.MaxOutstandingMessages = 1000
+	}
+	if cc.MaxOutstandingBytes <= 0 {
+		cc.MaxOutstandingBytes = 10 << 20
+	}
+	if cc.NumGoroutines <= 0 {
+		cc.NumGoroutines = 4
+	}
+	if cc.Timeout <= 0 {
+		cc.Timeout = xtime.Duration(60 * time.Second)
+	}
+	return &cc
+}
+
+// PublishResult is the result of an asynchronous publish.
+type PublishResult struct {
+	ready chan struct{}
+	id    string
+	err   error
+}
+
+func newPublishResult() *PublishResult {
+	return &PublishResult{ready: make(chan struct{})}
+}
+
+func (r *PublishResult) set(id string, err error) {
+	r.id, r.err = id, err
+	close(r.ready)
+}
+
+// Ready is closed once the message is published or failed.
+func (r *PublishResult) Ready() <-chan struct{} {
+	return r.ready
+}
+
+// Get waits for the result, the message id or the publish error.
+func (r *PublishResult) Get(c context.Context) (id string, err error) {
+	select {
+	case <-c.Done():
+		return "", c.Err()
+	case <-r.ready:
+		return r.id, r.err
+	}
+}
+
+type pendingMessage struct {
+	env  *Envelope
+	size int64
+	res  *PublishResult
+}
+
+// Batcher publishes messages of a topic asynchronously in batches, with
+// flow control over the messages not published yet.
+type Batcher struct {
+	p     Publisher
+	topic string
+	c     *BatchConfig
+
+	count *semaphore.Weighted
+	bytes *semaphore.Weighted
+	sema  chan struct{}
+	wg    sync.WaitGroup
+
+	mu      sync.Mutex
+	pending []*pendingMessage
+	size    int
+	timer   *time.Timer
+	stopped bool
+	// ordered is closed once the last batch of ordered messages is sent.
+	ordered chan struct{}
+}
+
+// NewBatcher creates a batcher of topic on top of p.
+func NewBatcher(p Publisher, topic string, c *BatchConfig) *Batcher {
+	c = c.fix()
+	return &Batcher{
+		p:     p,
+		topic: topic,
+		c:     c,
+		count: semaphore.NewWeighted(int64(c.MaxOutstandingMessages)),
+		bytes: semaphore.NewWeighted(int64(c.MaxOutstandingBytes)),
+		sema:  make(chan struct{}, c.NumGoroutines),
+	}
+}
+
+// Publish queues env and returns its result. It blocks while the
+// outstanding limits are reached, until c is done.
+func (b *Batcher) Publish(c context.Context, env *Envelope) *PublishResult {
+	res := newPublishResult()
+	size := int64(len(env.Data))
+	for k, v := range env.Attributes {
+		size += int64(len(k) + len(v))
+	}
+	// a message larger than the limit is let through alone.
+	if size > int64(b.c.MaxOutstandingBytes) {
+		size = int64(b.c.MaxOutstandingBytes)
+	}
+
+	if err := b.count.Acquire(c, 1); err != nil {
+		res.set("", err)
+		return res
+	}
+	if err := b.bytes.Acquire(c, size); err != nil {
+		b.count.Release(1)
+		res.set("", err)
+		return res
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stopped {
+		b.count.Release(1)
+		b.bytes.Release(size)
+		res.set("", ErrClosed)
+		return res
+	}
+	b.pending = append(b.pending, &pendingMessage{env: env, size: size, res: res})
+	b.size += len(env.Data)
+	if len(b.pending) >= b.c.CountThreshold || b.size >= b.c.ByteThreshold {
+		b.flush()
+	} else if b.timer == nil {
+		b.timer = time.AfterFunc(time.Duration(b.c.DelayThreshold), b.Flush)
+	}
+	return res
+}
+
+// Flush publishes the pending messages without waiting for the thresholds.
+func (b *Batcher) Flush() {
+	b.mu.Lock()
+	b.flush()
+	b.mu.Unlock()
+}
+
+func (b *Batcher) flush() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.pending) == 0 {
+		return
+	}
+	var batch, ordered []*pendingMessage
+	for _, v := range b.pending {
+		if v.env.Attributes[AttrOrderingKey] != "" {
+			ordered = append(ordered, v)
+		} else {
+			batch = append(batch, v)
+		}
+	}
+	b.pending, b.size = nil, 0
+
+	if len(batch) > 0 {
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			b.sema <- struct{}{}
+			defer func() { <-b.sema }()
+			b.send(batch)
+		}()
+	}
+	if len(ordered) > 0 {
+		prev, done := b.ordered, make(chan struct{})
+		b.ordered = done
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			defer close(done)
+			if prev != nil {
+				<-prev
+			}
+			b.sema <- struct{}{}
+			defer func() { <-b.sema }()
+			b.send(ordered)
+		}()
+	}
+}
+
+func (b *Batcher) send(batch []*pendingMessage) {
+	c, cancel := context.WithTimeout(context.Background(), time.Duration(b.c.Timeout))
+	defer cancel()
+
+	envs := make([]*Envelope, len(batch))
+	for i, v := range batch {
+		envs[i] = v.env
+	}
+	var (
+		ids  = make([]string, len(batch))
+		errs = make([]error, len(batch))
+	)
+	if bp, ok := b.p.(BatchPublisher); ok {
+		ids, errs = bp.PublishBatch(c, b.topic, envs)
+	} else {
+		for i, env := range envs {
+			ids[i], errs[i] = b.p.Publish(c, b.topic, env)
+		}
+	}
+
+	for i, v := range batch {
+		b.count.Release(1)
+		b.bytes.Release(v.size)
+		if errs[i] != nil && b.c.OnError != nil {
+			b.c.OnError(v.env, errs[i])
+		}
+		v.res.set(ids[i], errs[i])
+	}
+}
+
+// Stop publishes the pending messages and waits for all batches, later
+// Publish calls fail with ErrClosed.
+func (b *Batcher) Stop() {
+	b.mu.Lock()
+	b.stopped = true
+	b.flush()
+	b.mu.Unlock()
+	b.wg.Wait()
+}
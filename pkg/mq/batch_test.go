@@ -0,0 +1,130 @@
+package mq_test
+
+import (
+	"ascale/pkg/mq"
+	"ascale/pkg/xtime"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingPublisher records the size of every batch.
+type countingPublisher struct {
+	mq.Publisher
+	mu      sync.Mutex
+	batches []int
+}
+
+func (p *countingPublisher) PublishBatch(c context.Context, topic string, envs []*mq.Envelope) (ids []string, errs []error) {
+	p.mu.Lock()
+	p.batches = append(p.batches, len(envs))
+	p.mu.Unlock()
+	ids, errs = make([]string, len(envs)), make([]error, len(envs))
+	for i, env := range envs {
+		ids[i], errs[i] = p.Publish(c, topic, env)
+	}
+	return
+}
+
+func TestBatcher(t *testing.T) {
+	b, c := setup(t)
+	p := &countingPublisher{Publisher: b}
+	bt := mq.NewBatcher(p, "topic", &mq.BatchConfig{
+		CountThreshold: 10,
+		DelayThreshold: xtime.Duration(time.Hour),
+	})
+
+	var results []*mq.PublishResult
+	for i := 0; i < 25; i++ {
+		results = append(results, bt.Publish(c, &mq.Envelope{Data: []byte("x")}))
+	}
+	bt.Stop()
+	for _, r := range results {
+		id, err := r.Get(c)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, id)
+	}
+	assert.ElementsMatch(t, []int{10, 10, 5}, p.batches)
+
+	_, err := bt.Publish(c, &mq.Envelope{}).Get(c)
+	assert.Equal(t, mq.ErrClosed, err)
+}
+
+func TestBatcherDelay(t *testing.T) {
+	b, c := setup(t)
+	bt := mq.NewBatcher(b, "topic", &mq.BatchConfig{DelayThreshold: xtime.Duration(20 * time.Millisecond)})
+	defer bt.Stop()
+
+	id, err := bt.Publish(c, &mq.Envelope{Data: []byte("x")}).Get(c)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, id)
+}
+
+func TestBatcherFlowControl(t *testing.T) {
+	b, c := setup(t)
+	bt := mq.NewBatcher(b, "missing", &mq.BatchConfig{
+		MaxOutstandingMessages: 1,
+		DelayThreshold:         xtime.Duration(time.Hour),
+	})
+	defer bt.Stop()
+
+	bt.Publish(c, &mq.Envelope{})
+	// the first message is never flushed, the second one can not get in.
+	tc, cancel := context.WithTimeout(c, 50*time.Millisecond)
+	defer cancel()
+	_, err := bt.Publish(tc, &mq.Envelope{}).Get(c)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestBatcherOnError(t *testing.T) {
+	b, c := setup(t)
+	failed := make(chan error, 1)
+	bt := mq.NewBatcher(b, "missing", &mq.BatchConfig{
+		OnError: func(env *mq.Envelope, err error) { failed <- err },
+	})
+	defer bt.Stop()
+
+	_, err := bt.Publish(c, &mq.Envelope{}).Get(c)
+	assert.Equal(t, mq.ErrTopicNotFound, err)
+	assert.Equal(t, mq.ErrTopicNotFound, <-failed)
+}
+
+// slowPublisher publishes the first batch after the others were queued.
+type slowPublisher struct {
+	countingPublisher
+	once sync.Once
+	data []string
+}
+
+func (p *slowPublisher) PublishBatch(c context.Context, topic string, envs []*mq.Envelope) (ids []string, errs []error) {
+	p.once.Do(func() { time.Sleep(50 * time.Millisecond) })
+	p.mu.Lock()
+	for _, env := range envs {
+		p.data = append(p.data, string(env.Data))
+	}
+	p.mu.Unlock()
+	return p.countingPublisher.PublishBatch(c, topic, envs)
+}
+
+func TestBatcherOrdered(t *testing.T) {
+	b, c := setup(t)
+	p := &slowPublisher{countingPublisher: countingPublisher{Publisher: b}}
+	bt := mq.NewBatcher(p, "topic", &mq.BatchConfig{
+		CountThreshold: 2,
+		DelayThreshold: xtime.Duration(time.Hour),
+	})
+
+	// batches of a key are sent one after the other.
+	var want []string
+	for i := 0; i < 6; i++ {
+		v := fmt.Sprint(i)
+		want = append(want, v)
+		bt.Publish(c, &mq.Envelope{Data: []byte(v), Attributes: map[string]string{mq.AttrOrderingKey: "k"}})
+	}
+	bt.Stop()
+	assert.Equal(t, want, p.data)
+}
@@ -0,0 +1,129 @@
+package mq
+
+import (
+	"ascale/pkg/log"
+	"ascale/pkg/stat/prom"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// AttrIdempotencyKey is the attribute Dedup keys messages on when present,
+// publishers set it to dedup messages they may publish more than once.
+const AttrIdempotencyKey = "x-idempotency-key"
+
+const (
+	_defaultDedupTTL      = 24 * time.Hour
+	_defaultDedupClaimTTL = 10 * time.Minute
+)
+
+// ErrInFlight is returned by Dedup for a message whose key is claimed by a
+// handler still processing it, Router redelivers the message without
+// counting the attempt when the broker allows it.
+var ErrInFlight = errors.New("mq: duplicate message in flight")
+
+// DedupStore records processing and processed keys.
+type DedupStore interface {
+	// Claim records key as processing for ttl unless it is recorded
+	// already. It reports whether it claimed key, else whether key was
+	// processed.
+	Claim(c context.Context, key string, ttl time.Duration) (claimed, done bool, err error)
+	// Mark records key as processed for ttl.
+	Mark(c context.Context, key string, ttl time.Duration) error
+	// Unmark drops key, its message is handled again.
+	Unmark(c context.Context, key string) error
+}
+
+// DedupConfig dedup config.
+type DedupConfig struct {
+	Store DedupStore
+	// TTL of processed keys, default 24h. Duplicates delivered later are
+	// handled again.
+	TTL time.Duration
+	// ClaimTTL is how long a key is claimed while its message is handled,
+	// default 10m. Handlers taking longer let duplicates be handled too.
+	ClaimTTL time.Duration
+	// Key of a message, default IdempotencyKey.
+	Key func(msg Message) string
+}
+
+// IdempotencyKey returns the AttrIdempotencyKey attribute of msg, or its ID
+// which brokers keep across redeliveries.
+func IdempotencyKey(msg Message) string {
+	if v := msg.Attributes()[AttrIdempotencyKey]; v != "" {
+		return v
+	}
+	return msg.ID()
+}
+
+// PayloadKey returns the sha1 of the payload of msg, for publishers which
+// may publish the same payload twice.
+func PayloadKey(msg Message) string {
+	sum := sha1.Sum(msg.Data())
+	return hex.EncodeToString(sum[:])
+}
+
+// Dedup skips and acks messages whose key was processed by the subscription
+// already. The key is claimed before the handler runs so that concurrent
+// duplicates, e.g. a redelivery after the ack deadline of a slow handler,
+// fail with ErrInFlight and are redelivered. It is marked processed once the
+// handler returns nil and dropped when it fails. Store errors are logged and
+// the message is handled anyway.
+func Dedup(dc *DedupConfig) Middleware {
+	ttl := dc.TTL
+	if ttl <= 0 {
+		ttl = _defaultDedupTTL
+	}
+	claimTTL := dc.ClaimTTL
+	if claimTTL <= 0 {
+		claimTTL = _defaultDedupClaimTTL
+	}
+	keyFn := dc.Key
+	if keyFn == nil {
+		keyFn = IdempotencyKey
+	}
+
+	return func(cfg *SubscriptionConfig, next HandlerFunc) HandlerFunc {
+		name := fmt.Sprintf("consumer:%s", cfg.Topic)
+		return func(c context.Context, msg Message) (err error) {
+			// keys are per subscription, every subscription of a topic
+			// processes the message once.
+			key := cfg.GetName() + ":" + keyFn(msg)
+			claimed, done, err := dc.Store.Claim(c, key, claimTTL)
+			switch {
+			case err != nil:
+				log.For(c).Errorf("mq.Dedup(%s) Claim(%s) error(%+v)", cfg.Topic, key, err)
+				return next(c, msg)
+			case done:
+				log.For(c).Infof("mq.Dedup(%s) id(%s) skip duplicate key(%s)", cfg.Topic, msg.ID(), key)
+				prom.ConsumerDedup.Incr(name, "hit")
+				return nil
+			case !claimed:
+				prom.ConsumerDedup.Incr(name, "inflight")
+				return ErrInFlight
+			}
+			prom.ConsumerDedup.Incr(name, "miss")
+
+			handled := false
+			defer func() {
+				if handled {
+					return
+				}
+				if e := dc.Store.Unmark(c, key); e != nil {
+					log.For(c).Errorf("mq.Dedup(%s) Unmark(%s) error(%+v)", cfg.Topic, key, e)
+				}
+			}()
+			if err = next(c, msg); err != nil {
+				return
+			}
+			handled = true
+			if e := dc.Store.Mark(c, key, ttl); e != nil {
+				log.For(c).Errorf("mq.Dedup(%s) Mark(%s) error(%+v)", cfg.Topic, key, e)
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package mq
+
+import (
+	"ascale/pkg/stat/prom"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrDrained is the cause of the context of a handler still running when
+// Drain gives up waiting for it, its message has been nacked.
+var ErrDrained = errors.New("mq: drain deadline exceeded")
+
+// Drainer shuts receiving down in order: Receive calls stop pulling, the
+// messages in flight are waited for up to a deadline and the rest are
+// nacked so that other consumers get them right away.
+type Drainer struct {
+	c      context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	draining bool
+	drained  int
+	inflight map[*inflight]struct{}
+	// idle is closed when the last message in flight is done while draining.
+	idle chan struct{}
+}
+
+type inflight struct {
+	name   string
+	msg    Message
+	cancel context.CancelCauseFunc
+}
+
+// NewDrainer creates a drainer.
+func NewDrainer() *Drainer {
+	c, cancel := context.WithCancel(context.Background())
+	return &Drainer{
+		c:        c,
+		cancel:   cancel,
+		inflight: make(map[*inflight]struct{}),
+	}
+}
+
+// Context is the context of the Receive calls, it is done once Drain starts.
+func (d *Drainer) Context() context.Context {
+	return d.c
+}
+
+// Wrap returns h tracked by d. Handlers run with a context which is not
+// cancelled when receiving stops, only when Drain abandons them. Messages
+// delivered while draining are nacked without calling h.
+func (d *Drainer) Wrap(cfg *SubscriptionConfig, h Handler) Handler {
+	name := fmt.Sprintf("consumer:%s", cfg.Topic)
+	return func(c context.Context, msg Message) {
+		d.mu.Lock()
+		if d.draining {
+			d.mu.Unlock()
+			msg.Nack()
+			prom.ConsumerDrain.Incr(name, "rejected")
+			return
+		}
+		ctx, cancel := context.WithCancelCause(context.WithoutCancel(c))
+		f := &inflight{name: name, msg: msg, cancel: cancel}
+		d.inflight[f] = struct{}{}
+		d.mu.Unlock()
+
+		defer func() {
+			cancel(nil)
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			if _, ok := d.inflight[f]; !ok {
+				// abandoned, it was counted by Drain.
+				return
+			}
+			delete(d.inflight, f)
+			if !d.draining {
+				return
+			}
+			d.drained++
+			prom.ConsumerDrain.Incr(name, "drained")
+			if len(d.inflight) == 0 && d.idle != nil {
+				close(d.idle)
+				d.idle = nil
+			}
+		}()
+		h(ctx, msg)
+	}
+}
+
+// Drain stops the Receive calls and waits for the messages in flight until
+// they are done or c is. The messages still in flight then are nacked and
+// the context of their handlers is cancelled with ErrDrained. It returns how
+// many messages were waited for and how many were abandoned, calls after the
+// first one return zeros.
+func (d *Drainer) Drain(c context.Context) (drained, abandoned int) {
+	d.mu.Lock()
+	if d.draining {
+		d.mu.Unlock()
+		return
+	}
+	d.draining = true
+	idle := make(chan struct{})
+	if len(d.inflight) == 0 {
+		close(idle)
+	} else {
+		d.idle = idle
+	}
+	d.mu.Unlock()
+	d.cancel()
+
+	select {
+	case <-idle:
+	case <-c.Done():
+	}
+
+	d.mu.Lock()
+	left := make([]*inflight, 0, len(d.inflight))
+	for f := range d.inflight {
+		left = append(left, f)
+		delete(d.inflight, f)
+	}
+	d.idle = nil
+	drained = d.drained
+	d.mu.Unlock()
+
+	for _, f := range left {
+		// nack first, the handler can not settle the message any more.
+		f.msg.Nack()
+		f.cancel(ErrDrained)
+		prom.ConsumerDrain.Incr(f.name, "abandoned")
+	}
+	return drained, len(left)
+}
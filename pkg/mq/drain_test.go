@@ -0,0 +1,81 @@
+package mq_test
+
+import (
+	"ascale/pkg/mq"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrain(t *testing.T) {
+	b, c := setup(t)
+	r := newRouter(b, 0)
+	d := mq.NewDrainer()
+
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	causes := make(chan error, 1)
+	cfg := &mq.SubscriptionConfig{Topic: "topic", MaxOutstandingMessages: 2}
+	mq.Handle(r, cfg, func(c context.Context, arg *command) error {
+		started <- arg.Name
+		if arg.Name == "fast" {
+			<-release
+			return nil
+		}
+		<-c.Done()
+		causes <- context.Cause(c)
+		return c.Err()
+	})
+	rt := r.Routes()[0]
+	assert.NoError(t, b.EnsureSubscription(c, rt.Config))
+	go b.Receive(d.Context(), rt.Config, d.Wrap(rt.Config, rt.Handler))
+
+	for _, name := range []string{"fast", "slow"} {
+		_, err := b.Publish(c, "topic", &mq.Envelope{Data: []byte(`{"Name":"` + name + `"}`)})
+		assert.NoError(t, err)
+		select {
+		case <-started:
+		case <-c.Done():
+			t.Fatal("message not handled")
+		}
+	}
+
+	dc, cancel := context.WithTimeout(c, 300*time.Millisecond)
+	defer cancel()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	drained, abandoned := d.Drain(dc)
+	assert.Equal(t, 1, drained)
+	assert.Equal(t, 1, abandoned)
+	assert.Equal(t, mq.ErrDrained, <-causes)
+
+	// receiving stopped, new messages stay in the subscription.
+	_, err := b.Publish(c, "topic", &mq.Envelope{Data: []byte(`{"Name":"late"}`)})
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, started, 0)
+
+	// the abandoned message was nacked, the next consumer gets it.
+	got := make(chan string, 2)
+	go b.Receive(c, rt.Config, func(c context.Context, msg mq.Message) {
+		got <- string(msg.Data())
+		msg.Ack()
+	})
+	names := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case v := <-got:
+			names[v] = true
+		case <-c.Done():
+			t.Fatal("message not redelivered")
+		}
+	}
+	assert.Equal(t, map[string]bool{`{"Name":"slow"}`: true, `{"Name":"late"}`: true}, names)
+
+	drained, abandoned = d.Drain(c)
+	assert.Zero(t, drained+abandoned)
+}
@@ -0,0 +1,53 @@
+package memory
+
+import (
+	"ascale/pkg/mq"
+	"context"
+	"sync"
+	"time"
+)
+
+// DedupStore is an in-memory mq.DedupStore, expired keys are dropped lazily.
+type DedupStore struct {
+	mu   sync.Mutex
+	keys map[string]*dedupKey
+}
+
+type dedupKey struct {
+	expire time.Time
+	done   bool
+}
+
+var _ mq.DedupStore = (*DedupStore)(nil)
+
+// NewDedupStore creates an in-memory dedup store.
+func NewDedupStore() *DedupStore {
+	return &DedupStore{keys: make(map[string]*dedupKey)}
+}
+
+// Claim records key as processing for ttl unless it is recorded already.
+func (s *DedupStore) Claim(c context.Context, key string, ttl time.Duration) (claimed, done bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if k, ok := s.keys[key]; ok && time.Now().Before(k.expire) {
+		return false, k.done, nil
+	}
+	s.keys[key] = &dedupKey{expire: time.Now().Add(ttl)}
+	return true, false, nil
+}
+
+// Mark records key as processed for ttl.
+func (s *DedupStore) Mark(c context.Context, key string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[key] = &dedupKey{expire: time.Now().Add(ttl), done: true}
+	return nil
+}
+
+// Unmark drops key.
+func (s *DedupStore) Unmark(c context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, key)
+	return nil
+}
@@ -0,0 +1,448 @@
+// Package memory is an in-process driver of mq for tests and single binary
+// dev mode. It follows pubsub semantics: a message is delivered to every
+// subscription which existed when it was published, unacked messages are
+// redelivered after the ack deadline or right away on Nack, and dead letter
+// policies forward messages after too many delivery attempts.
+package memory
+
+import (
+	"ascale/pkg/log"
+	"ascale/pkg/mq"
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	_defaultAckDeadline = 10 * time.Second
+	_tick               = 50 * time.Millisecond
+)
+
+// Broker is an in-memory mq.Broker.
+type Broker struct {
+	mu     sync.Mutex
+	topics map[string]*topic
+	subs   map[string]*subscription
+	seq    int64
+
+	closed chan struct{}
+	once   sync.Once
+}
+
+var (
+	_ mq.Broker     = (*Broker)(nil)
+	_ mq.Backlogger = (*Broker)(nil)
+	_ mq.Describer  = (*Broker)(nil)
+	_ mq.Updater    = (*Broker)(nil)
+	_ mq.Delayer    = (*message)(nil)
+	_ mq.Extender   = (*message)(nil)
+	_ mq.Requeuer   = (*message)(nil)
+)
+
+// New creates an in-memory broker.
+func New() *Broker {
+	return &Broker{
+		topics: make(map[string]*topic),
+		subs:   make(map[string]*subscription),
+		closed: make(chan struct{}),
+	}
+}
+
+type topic struct {
+	name string
+	subs map[string]*subscription
+}
+
+// EnsureTopic creates the topic if it does not exist.
+func (b *Broker) EnsureTopic(c context.Context, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.topics[name]; !ok {
+		b.topics[name] = &topic{name: name, subs: make(map[string]*subscription)}
+	}
+	return nil
+}
+
+// DeleteTopic deletes a topic, its subscriptions are detached like pubsub
+// does and receive no new messages.
+func (b *Broker) DeleteTopic(c context.Context, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.topics[name]; !ok {
+		return mq.ErrTopicNotFound
+	}
+	delete(b.topics, name)
+	return nil
+}
+
+// Publish delivers env to every subscription of topic.
+func (b *Broker) Publish(c context.Context, name string, env *mq.Envelope) (id string, err error) {
+	select {
+	case <-b.closed:
+		return "", mq.ErrClosed
+	default:
+	}
+
+	b.mu.Lock()
+	t, ok := b.topics[name]
+	if !ok {
+		b.mu.Unlock()
+		return "", mq.ErrTopicNotFound
+	}
+	b.seq++
+	id = strconv.FormatInt(b.seq, 10)
+	subs := make([]*subscription, 0, len(t.subs))
+	for _, s := range t.subs {
+		subs = append(subs, s)
+	}
+	b.mu.Unlock()
+
+	now := time.Now()
+	for _, s := range subs {
+		attrs := make(map[string]string, len(env.Attributes))
+		for k, v := range env.Attributes {
+			attrs[k] = v
+		}
+		s.push(&entry{id: id, data: env.Data, attrs: attrs, publishTime: now})
+	}
+	return
+}
+
+// EnsureSubscription creates the subscription if it does not exist.
+func (b *Broker) EnsureSubscription(c context.Context, cfg *mq.SubscriptionConfig) (err error) {
+	_, err = b.subscription(cfg)
+	return
+}
+
+func (b *Broker) subscription(cfg *mq.SubscriptionConfig) (*subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s, ok := b.subs[cfg.GetName()]; ok {
+		return s, nil
+	}
+	t, ok := b.topics[cfg.Topic]
+	if !ok {
+		return nil, mq.ErrTopicNotFound
+	}
+
+	s := &subscription{
+		b:           b,
+		name:        cfg.GetName(),
+		ackDeadline: cfg.AckDeadline,
+		deadLetter:  cfg.DeadLetterPolicy,
+		cfg:         *cfg,
+		outstanding: make(map[string]*entry),
+		notify:      make(chan struct{}, 1),
+	}
+	if s.ackDeadline <= 0 {
+		s.ackDeadline = _defaultAckDeadline
+	}
+	t.subs[s.name] = s
+	b.subs[s.name] = s
+	return s, nil
+}
+
+// DescribeSubscription returns the settings the subscription was created
+// with.
+func (b *Broker) DescribeSubscription(c context.Context, name string) (cfg *mq.SubscriptionConfig, err error) {
+	b.mu.Lock()
+	s, ok := b.subs[name]
+	b.mu.Unlock()
+	if !ok {
+		return nil, mq.ErrSubscriptionNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &mq.SubscriptionConfig{
+		Topic:            s.cfg.Topic,
+		Name:             s.name,
+		AckDeadline:      s.ackDeadline,
+		Retention:        s.cfg.Retention,
+		DeadLetterPolicy: s.deadLetter,
+		Filter:           s.cfg.Filter,
+		RetryPolicy:      s.cfg.RetryPolicy,
+		Ordered:          s.cfg.Ordered,
+	}, nil
+}
+
+// UpdateSubscription changes the settings of the subscription, the new ack
+// deadline applies to the next deliveries.
+func (b *Broker) UpdateSubscription(c context.Context, cfg *mq.SubscriptionConfig, settings []string) error {
+	b.mu.Lock()
+	s, ok := b.subs[cfg.GetName()]
+	b.mu.Unlock()
+	if !ok {
+		return mq.ErrSubscriptionNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range settings {
+		switch v {
+		case mq.SettingAckDeadline:
+			if s.ackDeadline = cfg.AckDeadline; s.ackDeadline <= 0 {
+				s.ackDeadline = _defaultAckDeadline
+			}
+		case mq.SettingRetention:
+			s.cfg.Retention = cfg.Retention
+		case mq.SettingDeadLetterPolicy:
+			s.deadLetter = cfg.DeadLetterPolicy
+		case mq.SettingRetryPolicy:
+			s.cfg.RetryPolicy = cfg.RetryPolicy
+		default:
+			return fmt.Errorf("mq: setting(%s) not updatable", v)
+		}
+	}
+	return nil
+}
+
+// Backlog returns the queued and outstanding messages of the subscription.
+func (b *Broker) Backlog(c context.Context, cfg *mq.SubscriptionConfig) (n int64, err error) {
+	b.mu.Lock()
+	s, ok := b.subs[cfg.GetName()]
+	b.mu.Unlock()
+	if !ok {
+		return 0, mq.ErrSubscriptionNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int64(len(s.queue) + len(s.outstanding)), nil
+}
+
+// Receive calls h for every message of the subscription until c is done or
+// the broker is closed.
+func (b *Broker) Receive(c context.Context, cfg *mq.SubscriptionConfig, h mq.Handler) (err error) {
+	var s *subscription
+	if s, err = b.subscription(cfg); err != nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	var ordered *mq.Ordered
+	if cfg.Ordered {
+		// entries queued behind their key are not requeued.
+		s.mu.Lock()
+		ordered = mq.NewOrdered(h, s.ackDeadline/3)
+		s.mu.Unlock()
+	}
+	// a slot of the limiter is taken before a message is leased, the
+	// others stay queued.
+	lc, cancel := context.WithCancel(c)
+	defer cancel()
+	go func() {
+		select {
+		case <-b.closed:
+			cancel()
+		case <-lc.Done():
+		}
+	}()
+	sema := make(chan struct{}, cfg.GetMaxOutstandingMessages())
+	release := func() {
+		if l := cfg.Limiter; l != nil {
+			l.Release()
+		}
+		<-sema
+	}
+	ticker := time.NewTicker(_tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.Done():
+			return nil
+		case <-b.closed:
+			return nil
+		case sema <- struct{}{}:
+		}
+		if l := cfg.Limiter; l != nil && !l.Acquire(lc, true) {
+			<-sema
+			return nil
+		}
+
+		e, attempt := s.next(time.Now())
+		if e == nil {
+			release()
+			select {
+			case <-c.Done():
+				return nil
+			case <-b.closed:
+				return nil
+			case <-s.notify:
+			case <-ticker.C:
+			}
+			continue
+		}
+
+		if p := s.deadLetterPolicy(); p != nil && p.MaxDeliveryAttempts > 0 && attempt > p.MaxDeliveryAttempts {
+			s.done(e, attempt, true, 0, false)
+			if _, err := b.Publish(c, p.Topic, mq.DeadLetterEnvelope(cfg.Topic, e.id, e.data, e.attrs, attempt-1, mq.ErrMaxDeliveryAttempts)); err != nil {
+				log.For(c).Errorf("mq.memory.deadLetter(%s) id(%s) error(%+v)", s.name, e.id, err)
+			}
+			release()
+			continue
+		}
+
+		msg := &message{s: s, e: e, attempt: attempt}
+		wg.Add(1)
+		done := func() {
+			release()
+			wg.Done()
+		}
+		if ordered != nil {
+			// keep delivery order, the ordered handler only queues.
+			ordered.Handle(c, msg, done)
+			continue
+		}
+		go func() {
+			defer done()
+			h(c, msg)
+		}()
+	}
+}
+
+// Close stops all running Receive calls, pending messages are dropped.
+func (b *Broker) Close() error {
+	b.once.Do(func() { close(b.closed) })
+	return nil
+}
+
+// --------------------------------------------------------------------
+
+type entry struct {
+	id          string
+	data        []byte
+	attrs       map[string]string
+	publishTime time.Time
+
+	attempt   int
+	deadline  time.Time
+	notBefore time.Time
+}
+
+type subscription struct {
+	b           *Broker
+	name        string
+	ackDeadline time.Duration
+	deadLetter  *mq.DeadLetterPolicy
+	// cfg is the config it was created with, its retention, filter and retry
+	// policy are only described back.
+	cfg mq.SubscriptionConfig
+
+	// mu guards the settings above which are updated in place too.
+	mu          sync.Mutex
+	queue       []*entry
+	outstanding map[string]*entry
+	notify      chan struct{}
+}
+
+func (s *subscription) push(e *entry) {
+	s.mu.Lock()
+	s.queue = append(s.queue, e)
+	s.mu.Unlock()
+	s.wakeup()
+}
+
+func (s *subscription) deadLetterPolicy() *mq.DeadLetterPolicy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deadLetter
+}
+
+func (s *subscription) wakeup() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// next requeues expired deliveries and pops the next entry.
+func (s *subscription) next(now time.Time) (e *entry, attempt int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, o := range s.outstanding {
+		if now.After(o.deadline) {
+			delete(s.outstanding, id)
+			s.queue = append(s.queue, o)
+		}
+	}
+	for i, v := range s.queue {
+		if v.notBefore.After(now) {
+			continue
+		}
+		e = v
+		s.queue = append(s.queue[:i], s.queue[i+1:]...)
+		break
+	}
+	if e == nil {
+		return nil, 0
+	}
+
+	e.attempt++
+	e.deadline = now.Add(s.ackDeadline)
+	s.outstanding[e.id] = e
+	return e, e.attempt
+}
+
+// extend restarts the ack deadline of the delivery attempt of e.
+func (s *subscription) extend(e *entry, attempt int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if o, ok := s.outstanding[e.id]; ok && o == e && e.attempt == attempt {
+		e.deadline = time.Now().Add(s.ackDeadline)
+	}
+}
+
+// done settles the delivery attempt of e, late acks of expired deliveries
+// are ignored. Nacked entries are redelivered after delay, as the same
+// attempt when requeue is set.
+func (s *subscription) done(e *entry, attempt int, ack bool, delay time.Duration, requeue bool) {
+	s.mu.Lock()
+	o, ok := s.outstanding[e.id]
+	if !ok || o != e || e.attempt != attempt {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.outstanding, e.id)
+	if !ack {
+		e.notBefore = time.Now().Add(delay)
+		if requeue {
+			e.attempt--
+		}
+		s.queue = append(s.queue, e)
+	}
+	s.mu.Unlock()
+	if !ack {
+		s.wakeup()
+	}
+}
+
+// --------------------------------------------------------------------
+
+// message is one delivery attempt of an entry.
+type message struct {
+	s       *subscription
+	e       *entry
+	attempt int
+	once    sync.Once
+}
+
+func (m *message) ID() string                    { return m.e.id }
+func (m *message) Data() []byte                  { return m.e.data }
+func (m *message) Attributes() map[string]string { return m.e.attrs }
+func (m *message) PublishTime() time.Time        { return m.e.publishTime }
+func (m *message) DeliveryAttempt() int          { return m.attempt }
+func (m *message) Ack()                          { m.once.Do(func() { m.s.done(m.e, m.attempt, true, 0, false) }) }
+func (m *message) Nack()                         { m.NackDelay(0) }
+func (m *message) Extend()                       { m.s.extend(m.e, m.attempt) }
+
+// NackDelay redelivers the message no sooner than d.
+func (m *message) NackDelay(d time.Duration) {
+	m.once.Do(func() { m.s.done(m.e, m.attempt, false, d, false) })
+}
+
+// Requeue redelivers the message no sooner than d as the same attempt.
+func (m *message) Requeue(d time.Duration) {
+	m.once.Do(func() { m.s.done(m.e, m.attempt, false, d, true) })
+}
@@ -0,0 +1,262 @@
+package memory
+
+import (
+	"ascale/pkg/mq"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setup(t *testing.T, topics ...string) (*Broker, context.Context) {
+	b := New()
+	c, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(func() {
+		cancel()
+		b.Close()
+	})
+	for _, v := range topics {
+		assert.NoError(t, b.EnsureTopic(c, v))
+	}
+	return b, c
+}
+
+func TestFanout(t *testing.T) {
+	b, c := setup(t, "topic")
+
+	got := make(chan string, 2)
+	for _, name := range []string{"a", "b"} {
+		cfg := &mq.SubscriptionConfig{Topic: "topic", Name: name}
+		assert.NoError(t, b.EnsureSubscription(c, cfg))
+		go b.Receive(c, cfg, func(ctx context.Context, msg mq.Message) {
+			assert.Equal(t, "v", msg.Attributes()["k"])
+			assert.Equal(t, 1, msg.DeliveryAttempt())
+			msg.Ack()
+			got <- string(msg.Data())
+		})
+	}
+
+	_, err := b.Publish(c, "topic", &mq.Envelope{Data: []byte("hello"), Attributes: map[string]string{"k": "v"}})
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		select {
+		case v := <-got:
+			assert.Equal(t, "hello", v)
+		case <-c.Done():
+			t.Fatal("message not received")
+		}
+	}
+}
+
+func TestTopicNotFound(t *testing.T) {
+	b, c := setup(t)
+	_, err := b.Publish(c, "missing", &mq.Envelope{})
+	assert.Equal(t, mq.ErrTopicNotFound, err)
+	assert.Equal(t, mq.ErrTopicNotFound, b.EnsureSubscription(c, &mq.SubscriptionConfig{Topic: "missing"}))
+}
+
+func TestRedelivery(t *testing.T) {
+	b, c := setup(t, "topic")
+	cfg := &mq.SubscriptionConfig{Topic: "topic", AckDeadline: 100 * time.Millisecond}
+	assert.NoError(t, b.EnsureSubscription(c, cfg))
+	_, err := b.Publish(c, "topic", &mq.Envelope{Data: []byte("retry")})
+	assert.NoError(t, err)
+
+	attempts := make(chan int, 3)
+	go b.Receive(c, cfg, func(ctx context.Context, msg mq.Message) {
+		attempts <- msg.DeliveryAttempt()
+		switch msg.DeliveryAttempt() {
+		case 1:
+			msg.Nack()
+		case 2:
+			// let the ack deadline expire
+		default:
+			msg.Ack()
+		}
+	})
+
+	for want := 1; want <= 3; want++ {
+		select {
+		case got := <-attempts:
+			assert.Equal(t, want, got)
+		case <-c.Done():
+			t.Fatalf("attempt %d not delivered", want)
+		}
+	}
+	select {
+	case got := <-attempts:
+		t.Fatalf("unexpected attempt %d after ack", got)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	b, c := setup(t, "topic", "dead")
+	cfg := &mq.SubscriptionConfig{
+		Topic:            "topic",
+		DeadLetterPolicy: &mq.DeadLetterPolicy{Topic: "dead", MaxDeliveryAttempts: 3},
+	}
+	dcfg := &mq.SubscriptionConfig{Topic: "dead"}
+	assert.NoError(t, b.EnsureSubscription(c, cfg))
+	assert.NoError(t, b.EnsureSubscription(c, dcfg))
+
+	attempts := 0
+	go b.Receive(c, cfg, func(ctx context.Context, msg mq.Message) {
+		attempts++
+		msg.Nack()
+	})
+	dead := make(chan mq.Message, 1)
+	go b.Receive(c, dcfg, func(ctx context.Context, msg mq.Message) {
+		msg.Ack()
+		dead <- msg
+	})
+
+	_, err := b.Publish(c, "topic", &mq.Envelope{Data: []byte("poison")})
+	assert.NoError(t, err)
+	select {
+	case msg := <-dead:
+		assert.Equal(t, "poison", string(msg.Data()))
+		assert.Equal(t, 3, attempts)
+	case <-c.Done():
+		t.Fatal("message not dead lettered")
+	}
+}
+
+func TestReceiveStopsOnClose(t *testing.T) {
+	b, c := setup(t, "topic")
+	done := make(chan error, 1)
+	go func() {
+		done <- b.Receive(c, &mq.SubscriptionConfig{Topic: "topic"}, func(context.Context, mq.Message) {})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	b.Close()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-c.Done():
+		t.Fatal("Receive not stopped")
+	}
+}
+
+func TestBacklog(t *testing.T) {
+	b, c := setup(t, "topic")
+
+	cfg := &mq.SubscriptionConfig{Topic: "topic"}
+	_, err := b.Backlog(c, cfg)
+	assert.Equal(t, mq.ErrSubscriptionNotFound, err)
+
+	assert.NoError(t, b.EnsureSubscription(c, cfg))
+	for _, v := range []string{"0", "1", "2"} {
+		_, err = b.Publish(c, "topic", &mq.Envelope{Data: []byte(v)})
+		assert.NoError(t, err)
+	}
+	n, err := b.Backlog(c, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+
+	// the first message is acked, the second one is kept in flight.
+	got := make(chan string, 3)
+	go b.Receive(c, cfg, func(ctx context.Context, msg mq.Message) {
+		got <- string(msg.Data())
+		if string(msg.Data()) == "0" {
+			msg.Ack()
+			return
+		}
+		<-ctx.Done()
+	})
+	for _, want := range []string{"0", "1"} {
+		select {
+		case v := <-got:
+			assert.Equal(t, want, v)
+		case <-c.Done():
+			t.Fatal("message not received")
+		}
+	}
+	n, err = b.Backlog(c, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+}
+
+func TestReceiveOrdered(t *testing.T) {
+	b, c := setup(t, "topic")
+	cfg := &mq.SubscriptionConfig{Topic: "topic", MaxOutstandingMessages: 2, Ordered: true}
+	assert.NoError(t, b.EnsureSubscription(c, cfg))
+	for i := 0; i < 4; i++ {
+		env := &mq.Envelope{Data: []byte{byte(i)}, Attributes: map[string]string{mq.AttrOrderingKey: "key"}}
+		_, err := b.Publish(c, "topic", env)
+		assert.NoError(t, err)
+	}
+
+	rc, cancel := context.WithCancel(c)
+	started := make(chan struct{}, 4)
+	release := make(chan struct{})
+	returned := make(chan struct{})
+	go func() {
+		b.Receive(rc, cfg, func(ctx context.Context, msg mq.Message) {
+			started <- struct{}{}
+			<-release
+			msg.Ack()
+		})
+		close(returned)
+	}()
+
+	// the queued message holds a slot, the others stay in the backlog.
+	<-started
+	time.Sleep(50 * time.Millisecond)
+	n, err := b.Backlog(c, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), n)
+	b.mu.Lock()
+	s := b.subs[cfg.GetName()]
+	b.mu.Unlock()
+	s.mu.Lock()
+	assert.Len(t, s.outstanding, 2)
+	s.mu.Unlock()
+
+	// Receive waits for the running handler, the queued one is nacked.
+	cancel()
+	select {
+	case <-returned:
+		t.Fatal("Receive returned before its handlers")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-returned
+	assert.Len(t, started, 0)
+}
+
+func TestReceiveOrderedExtend(t *testing.T) {
+	b, c := setup(t, "topic")
+	cfg := &mq.SubscriptionConfig{Topic: "topic", AckDeadline: 150 * time.Millisecond, MaxOutstandingMessages: 10, Ordered: true}
+	assert.NoError(t, b.EnsureSubscription(c, cfg))
+	for i := 0; i < 4; i++ {
+		env := &mq.Envelope{Data: []byte{byte(i)}, Attributes: map[string]string{mq.AttrOrderingKey: "key"}}
+		_, err := b.Publish(c, "topic", env)
+		assert.NoError(t, err)
+	}
+
+	// the messages queued longer than the ack deadline are not redelivered.
+	got := make(chan string, 8)
+	rc, cancel := context.WithCancel(c)
+	defer cancel()
+	go b.Receive(rc, cfg, func(ctx context.Context, msg mq.Message) {
+		time.Sleep(100 * time.Millisecond)
+		got <- fmt.Sprintf("%d:%d", msg.Data()[0], msg.DeliveryAttempt())
+		msg.Ack()
+	})
+	for _, want := range []string{"0:1", "1:1", "2:1", "3:1"} {
+		select {
+		case v := <-got:
+			assert.Equal(t, want, v)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s not handled", want)
+		}
+	}
+	select {
+	case v := <-got:
+		t.Fatalf("%s redelivered", v)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -1 +1,194 @@
+// Package mq defines a broker-agnostic message queue abstraction. Drivers
+// live in sub packages (e.g. mq/pubsub) and all of them satisfy Broker, so
+// business code only ever depends on this package.
 package mq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrClosed is returned when using a broker after Close.
+	ErrClosed = errors.New("mq: broker closed")
+
+	// ErrTopicNotFound is returned when publishing to a missing topic.
+	ErrTopicNotFound = errors.New("mq: topic not found")
+
+	// ErrSubscriptionNotFound is returned when receiving from a missing subscription.
+	ErrSubscriptionNotFound = errors.New("mq: subscription not found")
+
+	// ErrMaxDeliveryAttempts is the error of messages a broker dead letters
+	// once they are out of delivery attempts.
+	ErrMaxDeliveryAttempts = errors.New("mq: max delivery attempts exceeded")
+)
+
+// Message is a message delivered by a Subscriber. Handlers must call Ack or
+// Nack exactly once, calls after the first one have no effect.
+type Message interface {
+	// ID is the broker assigned message id.
+	ID() string
+	// Data is the message payload.
+	Data() []byte
+	// Attributes are the key-value pairs attached when publishing.
+	Attributes() map[string]string
+	// PublishTime is the time the broker accepted the message.
+	PublishTime() time.Time
+	// DeliveryAttempt is the 1-based number of times this message has been
+	// delivered, 0 if the broker does not track it.
+	DeliveryAttempt() int
+	// Ack acknowledges the message, it will not be redelivered.
+	Ack()
+	// Nack tells the broker the message was not processed and should be
+	// redelivered.
+	Nack()
+}
+
+// Envelope is a message to be published.
+type Envelope struct {
+	Data       []byte
+	Attributes map[string]string
+}
+
+// Handler processes a message received from a subscription.
+type Handler func(c context.Context, msg Message)
+
+// Publisher publishes messages to a topic.
+type Publisher interface {
+	// Publish publishes env to topic and blocks until the broker accepted it,
+	// it returns the broker assigned message id.
+	Publish(c context.Context, topic string, env *Envelope) (id string, err error)
+}
+
+// Subscriber receives messages from a subscription.
+type Subscriber interface {
+	// EnsureSubscription creates the subscription if it does not exist.
+	EnsureSubscription(c context.Context, cfg *SubscriptionConfig) error
+	// Receive calls h for every message of the subscription until c is done
+	// or an unrecoverable error occurs. It returns nil when c is done.
+	Receive(c context.Context, cfg *SubscriptionConfig, h Handler) error
+}
+
+// Broker is implemented by every driver.
+type Broker interface {
+	Publisher
+	Subscriber
+
+	// EnsureTopic creates the topic if it does not exist.
+	EnsureTopic(c context.Context, topic string) error
+	// DeleteTopic deletes a topic.
+	DeleteTopic(c context.Context, topic string) error
+	// Close releases the resources held by the broker.
+	Close() error
+}
+
+// Backlogger is implemented by brokers which report the backlog of a
+// subscription, e.g. to scale its consumers.
+type Backlogger interface {
+	// Backlog returns the number of messages of the subscription which were
+	// not acked yet, in flight ones included.
+	Backlog(c context.Context, cfg *SubscriptionConfig) (n int64, err error)
+}
+
+// Describer is implemented by brokers which read back the settings of an
+// existing subscription, e.g. to report its drift from the declared ones.
+type Describer interface {
+	// DescribeSubscription returns the settings of the subscription named
+	// name, ErrSubscriptionNotFound when it does not exist. Only Topic, Name
+	// and the settings kept by the broker are set.
+	DescribeSubscription(c context.Context, name string) (cfg *SubscriptionConfig, err error)
+}
+
+// Updater is implemented by brokers which change the settings of an existing
+// subscription in place, e.g. to correct its drift from the declared ones.
+type Updater interface {
+	// UpdateSubscription sets the settings of the subscription to the ones
+	// of cfg, only the updatable settings listed are changed.
+	UpdateSubscription(c context.Context, cfg *SubscriptionConfig, settings []string) error
+}
+
+// SubscriptionConfig describes a subscription and how it is received.
+type SubscriptionConfig struct {
+	// Topic the subscription is attached to.
+	Topic string
+	// Name of the subscription, default SubscriptionName(Topic, "ascale").
+	Name string
+	// AckDeadline is the time a handler has to Ack or Nack a message before
+	// it is redelivered, 0 means broker default.
+	AckDeadline time.Duration
+	// Retention is how long unacked messages are kept, 0 means broker
+	// default.
+	Retention time.Duration
+	// DeadLetterPolicy is optional, messages are redelivered forever when nil.
+	DeadLetterPolicy *DeadLetterPolicy
+	// Filter delivers only the messages whose attributes match it, e.g.
+	// attributes.kind = "load". Only pubsub filters, it is set at creation.
+	Filter string
+	// RetryPolicy is the redelivery backoff of nacked messages kept by the
+	// broker, only pubsub has one. Messages are redelivered right away when
+	// nil.
+	RetryPolicy *RetryPolicy
+
+	// MaxOutstandingMessages is the maximum number of messages handled
+	// concurrently, default 1.
+	MaxOutstandingMessages int
+	// Ordered handles messages with the same ordering key one at a time in
+	// delivery order, pubsub orders them natively and the other drivers hand
+	// them to an Ordered.
+	Ordered bool
+	// Limiter is optional, it lowers how many messages are handled at once
+	// below MaxOutstandingMessages at runtime.
+	Limiter Limiter
+}
+
+// Limiter limits the messages of a subscription handled at once. Drivers
+// take a slot before they pull a message, so that the messages over the
+// limit stay with the broker, and give it back once the message is handled.
+// Drivers which can not gate pulling receive again with the new limit as
+// their MaxOutstandingMessages when it changes.
+type Limiter interface {
+	// Acquire takes a slot, waiting for one until c is done when wait is
+	// set. It reports whether it took one.
+	Acquire(c context.Context, wait bool) bool
+	// Release gives back a slot.
+	Release()
+	// Watch returns the limit and a channel closed once it changes.
+	Watch() (limit int, changed <-chan struct{})
+}
+
+// DeadLetterPolicy routes messages which can not be delivered to another topic.
+type DeadLetterPolicy struct {
+	// Topic is the dead letter topic name.
+	Topic string
+	// MaxDeliveryAttempts before a message is forwarded to Topic.
+	MaxDeliveryAttempts int
+}
+
+// RetryPolicy is the backoff of the broker between deliveries of a message.
+type RetryPolicy struct {
+	MinimumBackoff time.Duration
+	MaximumBackoff time.Duration
+}
+
+// SubscriptionName returns the subscription name of topic for a consumer group.
+func SubscriptionName(topic, group string) string {
+	return fmt.Sprintf("%s.sub.%s", topic, group)
+}
+
+// GetName returns the subscription name.
+func (c *SubscriptionConfig) GetName() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return SubscriptionName(c.Topic, "ascale")
+}
+
+// GetMaxOutstandingMessages returns the receive concurrency.
+func (c *SubscriptionConfig) GetMaxOutstandingMessages() int {
+	if c.MaxOutstandingMessages > 0 {
+		return c.MaxOutstandingMessages
+	}
+	return 1
+}
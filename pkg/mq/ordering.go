@@ -0,0 +1,137 @@
+package mq
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// AttrOrderingKey is the attribute carrying the ordering key of a message.
+// The pubsub driver publishes it as the pubsub ordering key and pubsub orders
+// by it, the other drivers order on the consumer, see Ordered.
+const AttrOrderingKey = "x-ordering-key"
+
+// OrderingKey returns the ordering key of msg, empty when it has none.
+func OrderingKey(msg Message) string {
+	return msg.Attributes()[AttrOrderingKey]
+}
+
+// Ordered hands messages to a handler so that messages with the same
+// ordering key are handled one at a time in the order Handle is called,
+// messages of different keys and messages without a key are handled
+// concurrently.
+//
+// The memory and redis drivers call Handle one message at a time in publish
+// order. A message redelivered after Nack is handled after the messages of
+// its key delivered meanwhile. Queued messages stay leased, the ones
+// implementing Extender are extended while they wait so that the broker does
+// not deliver them to another consumer.
+type Ordered struct {
+	h      Handler
+	extend time.Duration
+
+	mu     sync.Mutex
+	queues map[string][]*delivery
+}
+
+// Extender is implemented by messages whose lease can be extended.
+type Extender interface {
+	// Extend restarts the ack deadline of the message.
+	Extend()
+}
+
+// NewOrdered creates an Ordered handing messages to h, queued messages are
+// extended every extend, never when it is 0.
+func NewOrdered(h Handler, extend time.Duration) *Ordered {
+	return &Ordered{h: h, extend: extend, queues: make(map[string][]*delivery)}
+}
+
+type delivery struct {
+	c    context.Context
+	msg  Message
+	done func()
+}
+
+// Handle queues msg behind the messages of its key and returns, h is called
+// for it in the background and done once h returned. Messages still queued
+// when c is done are nacked instead. Callers bound how many messages are
+// queued by waiting for done, e.g. it releases a receive slot.
+func (o *Ordered) Handle(c context.Context, msg Message, done func()) {
+	d := &delivery{c: c, msg: msg, done: done}
+	key := OrderingKey(msg)
+	if key == "" {
+		go o.handle(d)
+		return
+	}
+
+	o.mu.Lock()
+	q, busy := o.queues[key]
+	o.queues[key] = append(q, d)
+	o.mu.Unlock()
+	if !busy {
+		go o.drain(key)
+	}
+}
+
+func (o *Ordered) handle(d *delivery) {
+	defer d.done()
+	if d.c.Err() != nil {
+		d.msg.Nack()
+		return
+	}
+	o.h(d.c, d.msg)
+}
+
+// drain handles the queue of key until it is empty, a queue in the map means
+// a drain of it is running.
+func (o *Ordered) drain(key string) {
+	for {
+		o.mu.Lock()
+		q := o.queues[key]
+		if len(q) == 0 {
+			delete(o.queues, key)
+			o.mu.Unlock()
+			return
+		}
+		d := q[0]
+		o.queues[key] = q[1:]
+		o.mu.Unlock()
+
+		// the handler gets a whole ack deadline however long d waited.
+		if e, ok := d.msg.(Extender); ok && o.extend > 0 {
+			e.Extend()
+		}
+		stop := o.extendQueue(key)
+		o.handle(d)
+		stop()
+	}
+}
+
+// extendQueue extends the messages queued behind the one of key handled
+// every o.extend until stop is called.
+func (o *Ordered) extendQueue(key string) (stop func()) {
+	if o.extend <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(o.extend)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			o.mu.Lock()
+			q := append([]*delivery(nil), o.queues[key]...)
+			o.mu.Unlock()
+			for _, d := range q {
+				if e, ok := d.msg.(Extender); ok {
+					e.Extend()
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,154 @@
+package mq
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Drift is a setting of an existing subscription which differs from its
+// declaration. Corrected drifts were updated to the declaration, Actual is
+// the setting before.
+type Drift struct {
+	Subscription string `json:"subscription"`
+	Setting      string `json:"setting"`
+	Declared     string `json:"declared"`
+	Actual       string `json:"actual"`
+	Corrected    bool   `json:"corrected"`
+}
+
+// Settings of a subscription compared with its declaration.
+const (
+	SettingTopic            = "topic"
+	SettingAckDeadline      = "ack_deadline"
+	SettingRetention        = "retention"
+	SettingDeadLetterPolicy = "dead_letter_policy"
+	SettingFilter           = "filter"
+	SettingRetryPolicy      = "retry_policy"
+	SettingOrdered          = "ordered"
+)
+
+// _updatable are the settings an Updater changes in place, the others are
+// fixed once the subscription is created, e.g. pubsub can not turn on
+// message ordering.
+var _updatable = map[string]bool{
+	SettingAckDeadline:      true,
+	SettingRetention:        true,
+	SettingDeadLetterPolicy: true,
+	SettingRetryPolicy:      true,
+}
+
+func (d *Drift) String() string {
+	return fmt.Sprintf("subscription(%s) %s declared(%s) actual(%s) corrected(%t)", d.Subscription, d.Setting, d.Declared, d.Actual, d.Corrected)
+}
+
+// Provision creates the missing topics and subscriptions, the topics of the
+// subscriptions and their dead letter topics included. It returns how the
+// existing subscriptions drifted from cfgs, brokers which do not implement
+// Describer report none. The drifted settings which can be changed are
+// updated in place by brokers implementing Updater and reported corrected,
+// the others, e.g. the filter or ordering, are only reported.
+func Provision(c context.Context, b Broker, topics []string, cfgs []*SubscriptionConfig) (drifts []*Drift, err error) {
+	seen := make(map[string]bool)
+	ensure := func(topic string) error {
+		if topic == "" || seen[topic] {
+			return nil
+		}
+		seen[topic] = true
+		return b.EnsureTopic(c, topic)
+	}
+	for _, topic := range topics {
+		if err = ensure(topic); err != nil {
+			return
+		}
+	}
+	for _, cfg := range cfgs {
+		if err = ensure(cfg.Topic); err != nil {
+			return
+		}
+		if p := cfg.DeadLetterPolicy; p != nil {
+			if err = ensure(p.Topic); err != nil {
+				return
+			}
+		}
+	}
+
+	d, _ := b.(Describer)
+	u, _ := b.(Updater)
+	for _, cfg := range cfgs {
+		if d != nil {
+			var actual *SubscriptionConfig
+			actual, err = d.DescribeSubscription(c, cfg.GetName())
+			if err == nil {
+				var (
+					settings  []string
+					corrected []*Drift
+				)
+				for _, v := range diff(cfg, actual) {
+					if u != nil && _updatable[v.Setting] {
+						settings = append(settings, v.Setting)
+						corrected = append(corrected, v)
+					}
+					drifts = append(drifts, v)
+				}
+				if len(settings) > 0 {
+					if err = u.UpdateSubscription(c, cfg, settings); err != nil {
+						return
+					}
+					for _, v := range corrected {
+						v.Corrected = true
+					}
+				}
+				continue
+			}
+			if err != ErrSubscriptionNotFound {
+				return
+			}
+		}
+		if err = b.EnsureSubscription(c, cfg); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// diff returns the settings of actual which differ from declared, settings
+// declared with their zero value are the broker defaults and not compared.
+func diff(declared, actual *SubscriptionConfig) (drifts []*Drift) {
+	add := func(setting, d, a string) {
+		if d != a {
+			drifts = append(drifts, &Drift{Subscription: declared.GetName(), Setting: setting, Declared: d, Actual: a})
+		}
+	}
+	duration := func(setting string, d, a time.Duration) {
+		if d > 0 {
+			add(setting, d.String(), a.String())
+		}
+	}
+
+	add(SettingTopic, declared.Topic, actual.Topic)
+	duration(SettingAckDeadline, declared.AckDeadline, actual.AckDeadline)
+	duration(SettingRetention, declared.Retention, actual.Retention)
+	add(SettingDeadLetterPolicy, declared.DeadLetterPolicy.String(), actual.DeadLetterPolicy.String())
+	add(SettingFilter, declared.Filter, actual.Filter)
+	add(SettingRetryPolicy, declared.RetryPolicy.String(), actual.RetryPolicy.String())
+	if declared.Ordered {
+		add(SettingOrdered, "true", strconv.FormatBool(actual.Ordered))
+	}
+	return
+}
+
+func (p *DeadLetterPolicy) String() string {
+	if p == nil {
+		return "none"
+	}
+	return fmt.Sprintf("%s after %d attempts", p.Topic, p.MaxDeliveryAttempts)
+}
+
+func (p *RetryPolicy) String() string {
+	if p == nil {
+		return "none"
+	}
+	return fmt.Sprintf("%s to %s", p.MinimumBackoff, p.MaximumBackoff)
+}
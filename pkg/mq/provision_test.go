@@ -0,0 +1,71 @@
+package mq_test
+
+import (
+	"ascale/pkg/mq"
+	"ascale/pkg/mq/memory"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProvision(t *testing.T) {
+	b := memory.New()
+	defer b.Close()
+	c, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := &mq.SubscriptionConfig{
+		Topic:            "topic",
+		AckDeadline:      time.Minute,
+		DeadLetterPolicy: &mq.DeadLetterPolicy{Topic: "dead", MaxDeliveryAttempts: 5},
+	}
+	drifts, err := mq.Provision(c, b, []string{"other"}, []*mq.SubscriptionConfig{cfg})
+	assert.NoError(t, err)
+	assert.Empty(t, drifts)
+	for _, v := range []string{"topic", "dead", "other"} {
+		_, err = b.Publish(c, v, &mq.Envelope{Data: []byte("a")})
+		assert.NoError(t, err)
+	}
+	n, err := b.Backlog(c, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	// settings declared with their zero value are not compared, the ones
+	// which can be changed are updated in place.
+	declared := &mq.SubscriptionConfig{
+		Topic:            "topic",
+		AckDeadline:      time.Second,
+		DeadLetterPolicy: &mq.DeadLetterPolicy{Topic: "dead", MaxDeliveryAttempts: 10},
+		Filter:           `attributes.kind = "load"`,
+		Ordered:          true,
+	}
+	drifts, err = mq.Provision(c, b, nil, []*mq.SubscriptionConfig{declared})
+	assert.NoError(t, err)
+	assert.Equal(t, []*mq.Drift{
+		{Subscription: "topic.sub.ascale", Setting: "ack_deadline", Declared: "1s", Actual: "1m0s", Corrected: true},
+		{Subscription: "topic.sub.ascale", Setting: "dead_letter_policy", Declared: "dead after 10 attempts", Actual: "dead after 5 attempts", Corrected: true},
+		{Subscription: "topic.sub.ascale", Setting: "filter", Declared: `attributes.kind = "load"`, Actual: ""},
+		{Subscription: "topic.sub.ascale", Setting: "ordered", Declared: "true", Actual: "false"},
+	}, drifts)
+	actual, err := b.DescribeSubscription(c, declared.GetName())
+	assert.NoError(t, err)
+	assert.Equal(t, time.Second, actual.AckDeadline)
+	assert.Equal(t, declared.DeadLetterPolicy, actual.DeadLetterPolicy)
+	assert.Empty(t, actual.Filter)
+	assert.False(t, actual.Ordered)
+
+	// corrected drift is not reported again.
+	drifts, err = mq.Provision(c, b, nil, []*mq.SubscriptionConfig{declared})
+	assert.NoError(t, err)
+	assert.Len(t, drifts, 2)
+
+	// an ordered subscription matches its declaration.
+	ordered := &mq.SubscriptionConfig{Topic: "topic", Name: "ordered", Ordered: true}
+	_, err = mq.Provision(c, b, nil, []*mq.SubscriptionConfig{ordered})
+	assert.NoError(t, err)
+	drifts, err = mq.Provision(c, b, nil, []*mq.SubscriptionConfig{ordered})
+	assert.NoError(t, err)
+	assert.Empty(t, drifts)
+}
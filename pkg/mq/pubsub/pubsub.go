@@ -0,0 +1,429 @@
+// Package pubsub is the Google Cloud Pub/Sub driver of mq.
+package pubsub
+
+import (
+	"ascale/pkg/log"
+	"ascale/pkg/mq"
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gpubsub "cloud.google.com/go/pubsub"
+	vkit "cloud.google.com/go/pubsub/apiv1"
+	"google.golang.org/api/option"
+	pb "google.golang.org/genproto/googleapis/pubsub/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// _defaultAckDeadline is the ack deadline of pubsub when none is set.
+const _defaultAckDeadline = 10 * time.Second
+
+// attributes pubsub adds to the messages it dead letters.
+const (
+	_attrSourceSubscription = "CloudPubSubDeadLetterSourceSubscription"
+	_attrSourceAttempt      = "CloudPubSubDeadLetterSourceDeliveryCount"
+)
+
+// Config pubsub driver config.
+type Config struct {
+	// ProjectID gcloud project id.
+	ProjectID string
+	// Endpoint of a pubsub emulator, the real service is used when empty.
+	Endpoint string
+}
+
+// Broker is a mq.Broker backed by Google Cloud Pub/Sub.
+type Broker struct {
+	c      *Config
+	client *gpubsub.Client
+	// subs creates and describes subscriptions, the client lacks filters
+	// and retry policies.
+	subs *vkit.SubscriberClient
+
+	mu     sync.Mutex
+	topics map[string]*gpubsub.Topic
+	// sources are the topics of dead lettering subscriptions by name.
+	sources map[string]string
+}
+
+var (
+	_ mq.Broker         = (*Broker)(nil)
+	_ mq.BatchPublisher = (*Broker)(nil)
+	_ mq.Describer      = (*Broker)(nil)
+	_ mq.Updater        = (*Broker)(nil)
+)
+
+// New creates a pubsub broker.
+func New(c context.Context, conf *Config, opts ...option.ClientOption) (b *Broker, err error) {
+	if conf.Endpoint != "" {
+		opts = append(opts,
+			option.WithEndpoint(conf.Endpoint),
+			option.WithoutAuthentication(),
+			option.WithGRPCDialOption(grpc.WithInsecure()),
+		)
+	}
+
+	b = &Broker{c: conf, topics: make(map[string]*gpubsub.Topic), sources: make(map[string]string)}
+	if b.client, err = gpubsub.NewClient(c, conf.ProjectID, opts...); err != nil {
+		return nil, err
+	}
+	if b.subs, err = vkit.NewSubscriberClient(c, opts...); err != nil {
+		b.client.Close()
+		return nil, err
+	}
+	return
+}
+
+// Client returns the underlying pubsub client.
+func (b *Broker) Client() *gpubsub.Client {
+	return b.client
+}
+
+// topic returns a cached topic handle, pubsub batches publishes per handle so
+// they must be reused. Messages with an ordering key are published in order.
+func (b *Broker) topic(name string) *gpubsub.Topic {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, ok := b.topics[name]
+	if !ok {
+		t = b.client.Topic(name)
+		t.EnableMessageOrdering = true
+		b.topics[name] = t
+	}
+	return t
+}
+
+// EnsureTopic creates the topic if it does not exist.
+func (b *Broker) EnsureTopic(c context.Context, topic string) (err error) {
+	var exists bool
+	if exists, err = b.topic(topic).Exists(c); err != nil || exists {
+		return
+	}
+	_, err = b.client.CreateTopic(c, topic)
+	return
+}
+
+// DeleteTopic deletes a topic.
+func (b *Broker) DeleteTopic(c context.Context, topic string) (err error) {
+	b.mu.Lock()
+	if t, ok := b.topics[topic]; ok {
+		t.Stop()
+		delete(b.topics, topic)
+	}
+	b.mu.Unlock()
+	return b.client.Topic(topic).Delete(c)
+}
+
+// Publish publishes env to topic and waits for the server ack.
+func (b *Broker) Publish(c context.Context, topic string, env *mq.Envelope) (id string, err error) {
+	t := b.topic(topic)
+	if id, err = t.Publish(c, toMessage(env)).Get(c); err != nil {
+		resume(t, env)
+	}
+	return
+}
+
+// PublishBatch publishes envs through the bundler of the topic and waits for
+// all of them.
+func (b *Broker) PublishBatch(c context.Context, topic string, envs []*mq.Envelope) (ids []string, errs []error) {
+	t := b.topic(topic)
+	results := make([]*gpubsub.PublishResult, len(envs))
+	for i, env := range envs {
+		results[i] = t.Publish(c, toMessage(env))
+	}
+	ids, errs = make([]string, len(envs)), make([]error, len(envs))
+	for i, r := range results {
+		if ids[i], errs[i] = r.Get(c); errs[i] != nil {
+			resume(t, envs[i])
+		}
+	}
+	return
+}
+
+// toMessage returns the pubsub message of env, its mq.AttrOrderingKey is the
+// ordering key.
+func toMessage(env *mq.Envelope) *gpubsub.Message {
+	return &gpubsub.Message{
+		Data:        env.Data,
+		Attributes:  env.Attributes,
+		OrderingKey: env.Attributes[mq.AttrOrderingKey],
+	}
+}
+
+// resume resumes publishing the ordering key of env, pubsub pauses a key
+// after a failed publish so that later messages are not published ahead.
+func resume(t *gpubsub.Topic, env *mq.Envelope) {
+	if key := env.Attributes[mq.AttrOrderingKey]; key != "" {
+		t.ResumePublish(key)
+	}
+}
+
+// EnsureSubscription creates the subscription if it does not exist.
+func (b *Broker) EnsureSubscription(c context.Context, cfg *mq.SubscriptionConfig) (err error) {
+	_, err = b.ensureSubscription(c, cfg)
+	return
+}
+
+func (b *Broker) ensureSubscription(c context.Context, cfg *mq.SubscriptionConfig) (sub *gpubsub.Subscription, err error) {
+	sub = b.client.Subscription(cfg.GetName())
+	var exists bool
+	if exists, err = sub.Exists(c); err != nil || exists {
+		return
+	}
+
+	if _, err = b.subs.CreateSubscription(c, b.subscription(cfg)); status.Code(err) == codes.AlreadyExists {
+		err = nil
+	}
+	return
+}
+
+// subscription returns the pubsub subscription of cfg.
+func (b *Broker) subscription(cfg *mq.SubscriptionConfig) *pb.Subscription {
+	ps := &pb.Subscription{
+		Name:                  b.subscriptionPath(cfg.GetName()),
+		Topic:                 b.topicPath(cfg.Topic),
+		AckDeadlineSeconds:    int32(_defaultAckDeadline / time.Second),
+		Filter:                cfg.Filter,
+		EnableMessageOrdering: cfg.Ordered,
+	}
+	if cfg.AckDeadline > 0 {
+		ps.AckDeadlineSeconds = int32(cfg.AckDeadline / time.Second)
+	}
+	if cfg.Retention > 0 {
+		ps.MessageRetentionDuration = durationpb.New(cfg.Retention)
+	}
+	if p := cfg.DeadLetterPolicy; p != nil {
+		ps.DeadLetterPolicy = &pb.DeadLetterPolicy{
+			DeadLetterTopic:     b.topicPath(p.Topic),
+			MaxDeliveryAttempts: int32(p.MaxDeliveryAttempts),
+		}
+	}
+	if p := cfg.RetryPolicy; p != nil {
+		ps.RetryPolicy = &pb.RetryPolicy{
+			MinimumBackoff: durationpb.New(p.MinimumBackoff),
+			MaximumBackoff: durationpb.New(p.MaximumBackoff),
+		}
+	}
+	return ps
+}
+
+// _updateMask are the fields of the updatable settings.
+var _updateMask = map[string]string{
+	mq.SettingAckDeadline:      "ack_deadline_seconds",
+	mq.SettingRetention:        "message_retention_duration",
+	mq.SettingDeadLetterPolicy: "dead_letter_policy",
+	mq.SettingRetryPolicy:      "retry_policy",
+}
+
+// UpdateSubscription changes the settings of the subscription.
+func (b *Broker) UpdateSubscription(c context.Context, cfg *mq.SubscriptionConfig, settings []string) (err error) {
+	mask := &fieldmaskpb.FieldMask{}
+	for _, v := range settings {
+		f, ok := _updateMask[v]
+		if !ok {
+			return fmt.Errorf("mq: setting(%s) not updatable", v)
+		}
+		mask.Paths = append(mask.Paths, f)
+	}
+	req := &pb.UpdateSubscriptionRequest{Subscription: b.subscription(cfg), UpdateMask: mask}
+	if _, err = b.subs.UpdateSubscription(c, req); status.Code(err) == codes.NotFound {
+		err = mq.ErrSubscriptionNotFound
+	}
+	return
+}
+
+// DescribeSubscription returns the settings of the subscription.
+func (b *Broker) DescribeSubscription(c context.Context, name string) (cfg *mq.SubscriptionConfig, err error) {
+	var ps *pb.Subscription
+	if ps, err = b.subs.GetSubscription(c, &pb.GetSubscriptionRequest{Subscription: b.subscriptionPath(name)}); err != nil {
+		if status.Code(err) == codes.NotFound {
+			err = mq.ErrSubscriptionNotFound
+		}
+		return
+	}
+	cfg = &mq.SubscriptionConfig{
+		Topic:       b.topicName(ps.Topic),
+		Name:        name,
+		AckDeadline: time.Duration(ps.AckDeadlineSeconds) * time.Second,
+		Retention:   ps.MessageRetentionDuration.AsDuration(),
+		Filter:      ps.Filter,
+		Ordered:     ps.EnableMessageOrdering,
+	}
+	if p := ps.DeadLetterPolicy; p != nil {
+		cfg.DeadLetterPolicy = &mq.DeadLetterPolicy{
+			Topic:               b.topicName(p.DeadLetterTopic),
+			MaxDeliveryAttempts: int(p.MaxDeliveryAttempts),
+		}
+	}
+	if p := ps.RetryPolicy; p != nil {
+		cfg.RetryPolicy = &mq.RetryPolicy{
+			MinimumBackoff: p.MinimumBackoff.AsDuration(),
+			MaximumBackoff: p.MaximumBackoff.AsDuration(),
+		}
+	}
+	return
+}
+
+// Receive calls h for every message of the subscription until c is done.
+// The client pulls as many messages as it may handle, so the limiter of the
+// subscription is not used to gate pulling, receiving restarts with its new
+// limit instead once the messages in flight are handled. Restarts stall
+// pulling for the slowest of them, so they wait for the limit to move a step
+// and are at least _restartInterval apart.
+func (b *Broker) Receive(c context.Context, cfg *mq.SubscriptionConfig, h mq.Handler) (err error) {
+	var sub *gpubsub.Subscription
+	if sub, err = b.ensureSubscription(c, cfg); err != nil {
+		return
+	}
+
+	sub.ReceiveSettings.Synchronous = true
+	sub.ReceiveSettings.MaxOutstandingBytes = 1e10
+	sub.ReceiveSettings.NumGoroutines = 1
+	for {
+		limit := cfg.GetMaxOutstandingMessages()
+		l := cfg.Limiter
+		if l != nil {
+			limit, _ = l.Watch()
+		}
+		sub.ReceiveSettings.MaxOutstandingMessages = limit
+
+		rc, cancel := context.WithCancel(c)
+		if l != nil {
+			go func(limit int) {
+				if watch(rc, l, limit, _restartInterval) {
+					cancel()
+				}
+			}(limit)
+		}
+		// the client handles the messages of an ordering key one at a time
+		// when the subscription is ordered. Handlers get c, a restart does
+		// not cancel them.
+		err = sub.Receive(rc, func(_ context.Context, msg *gpubsub.Message) {
+			b.deadLetter(c, msg)
+			h(c, &message{msg: msg})
+		})
+		cancel()
+		if err != nil || c.Err() != nil {
+			return
+		}
+	}
+}
+
+// _restartInterval is the minimum time between restarts of Receive.
+const _restartInterval = 10 * time.Second
+
+// watch waits until the limit of l moved a step, a quarter of cur or 1, from
+// cur, no sooner than wait from now. It returns false once c is done.
+func watch(c context.Context, l mq.Limiter, cur int, wait time.Duration) bool {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	var ready bool
+	for {
+		limit, changed := l.Watch()
+		if d := limit - cur; ready && (d >= max(1, cur/4) || -d >= max(1, cur/4)) {
+			return true
+		}
+		select {
+		case <-c.Done():
+			return false
+		case <-changed:
+		case <-timer.C:
+			ready = true
+		}
+	}
+}
+
+// deadLetter replaces the attributes pubsub adds to the messages it dead
+// letters with the ones of mq.DeadLetterEnvelope, pubsub does not keep the
+// source message id. They are left as they are when the source topic can not
+// be found.
+func (b *Broker) deadLetter(c context.Context, msg *gpubsub.Message) {
+	sub, ok := msg.Attributes[_attrSourceSubscription]
+	if !ok {
+		return
+	}
+	topic, err := b.sourceTopic(c, path.Base(sub))
+	if err != nil {
+		log.For(c).Errorf("mq.pubsub.deadLetter(%s) source subscription(%s) error(%+v)", msg.ID, sub, err)
+		return
+	}
+	attempt, _ := strconv.Atoi(msg.Attributes[_attrSourceAttempt])
+	attrs := make(map[string]string, len(msg.Attributes))
+	for k, v := range msg.Attributes {
+		if !strings.HasPrefix(k, "CloudPubSubDeadLetter") {
+			attrs[k] = v
+		}
+	}
+	msg.Attributes = mq.DeadLetterEnvelope(topic, "", msg.Data, attrs, attempt, mq.ErrMaxDeliveryAttempts).Attributes
+}
+
+// sourceTopic returns the topic of the subscription name.
+func (b *Broker) sourceTopic(c context.Context, name string) (topic string, err error) {
+	b.mu.Lock()
+	topic, ok := b.sources[name]
+	b.mu.Unlock()
+	if ok {
+		return
+	}
+	var ps *pb.Subscription
+	if ps, err = b.subs.GetSubscription(c, &pb.GetSubscriptionRequest{Subscription: b.subscriptionPath(name)}); err != nil {
+		return
+	}
+	topic = b.topicName(ps.Topic)
+	b.mu.Lock()
+	b.sources[name] = topic
+	b.mu.Unlock()
+	return
+}
+
+// Close stops all topics and closes the client.
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	for _, t := range b.topics {
+		t.Stop()
+	}
+	b.topics = make(map[string]*gpubsub.Topic)
+	b.mu.Unlock()
+	b.subs.Close()
+	return b.client.Close()
+}
+
+func (b *Broker) topicPath(topic string) string {
+	return fmt.Sprintf("projects/%s/topics/%s", b.c.ProjectID, topic)
+}
+
+// topicName returns the name of a topic of the project from its path.
+func (b *Broker) topicName(path string) string {
+	return strings.TrimPrefix(path, b.topicPath(""))
+}
+
+func (b *Broker) subscriptionPath(name string) string {
+	return fmt.Sprintf("projects/%s/subscriptions/%s", b.c.ProjectID, name)
+}
+
+// message adapts *gpubsub.Message to mq.Message.
+type message struct {
+	msg *gpubsub.Message
+}
+
+func (m *message) ID() string                    { return m.msg.ID }
+func (m *message) Data() []byte                  { return m.msg.Data }
+func (m *message) Attributes() map[string]string { return m.msg.Attributes }
+func (m *message) PublishTime() time.Time        { return m.msg.PublishTime }
+func (m *message) Ack()                          { m.msg.Ack() }
+func (m *message) Nack()                         { m.msg.Nack() }
+
+func (m *message) DeliveryAttempt() int {
+	if m.msg.DeliveryAttempt == nil {
+		return 0
+	}
+	return *m.msg.DeliveryAttempt
+}
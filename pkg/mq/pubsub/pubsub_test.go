@@ -0,0 +1,312 @@
+package pubsub
+
+import (
+	"ascale/pkg/mq"
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestBroker(t *testing.T) (*Broker, func()) {
+	srv := pstest.NewServer()
+	b, err := New(context.Background(), &Config{ProjectID: "test", Endpoint: srv.Addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, func() {
+		b.Close()
+		srv.Close()
+	}
+}
+
+func TestPublishReceive(t *testing.T) {
+	b, closer := newTestBroker(t)
+	defer closer()
+
+	c, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	assert.NoError(t, b.EnsureTopic(c, "topic"))
+	assert.NoError(t, b.EnsureTopic(c, "topic"))
+	cfg := &mq.SubscriptionConfig{Topic: "topic"}
+	assert.NoError(t, b.EnsureSubscription(c, cfg))
+
+	id, err := b.Publish(c, "topic", &mq.Envelope{
+		Data:       []byte("hello"),
+		Attributes: map[string]string{"k": "v"},
+	})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, id)
+
+	got := make(chan mq.Message, 1)
+	go b.Receive(c, cfg, func(ctx context.Context, msg mq.Message) {
+		msg.Ack()
+		got <- msg
+	})
+
+	select {
+	case msg := <-got:
+		assert.Equal(t, id, msg.ID())
+		assert.Equal(t, "hello", string(msg.Data()))
+		assert.Equal(t, "v", msg.Attributes()["k"])
+		assert.False(t, msg.PublishTime().IsZero())
+	case <-c.Done():
+		t.Fatal("message not received")
+	}
+}
+
+func TestPublishBatch(t *testing.T) {
+	b, closer := newTestBroker(t)
+	defer closer()
+
+	c, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	assert.NoError(t, b.EnsureTopic(c, "topic"))
+	ids, errs := b.PublishBatch(c, "topic", []*mq.Envelope{{Data: []byte("a")}, {Data: []byte("b")}})
+	assert.Equal(t, []error{nil, nil}, errs)
+	assert.Len(t, ids, 2)
+	assert.NotEqual(t, ids[0], ids[1])
+}
+
+func TestReceiveOrdered(t *testing.T) {
+	b, closer := newTestBroker(t)
+	defer closer()
+
+	c, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	assert.NoError(t, b.EnsureTopic(c, "topic"))
+	cfg := &mq.SubscriptionConfig{Topic: "topic", MaxOutstandingMessages: 4, Ordered: true}
+	assert.NoError(t, b.EnsureSubscription(c, cfg))
+
+	const n = 20
+	envs := make([]*mq.Envelope, n)
+	for i := range envs {
+		envs[i] = &mq.Envelope{
+			Data:       []byte{byte(i)},
+			Attributes: map[string]string{mq.AttrOrderingKey: "key"},
+		}
+	}
+	_, errs := b.PublishBatch(c, "topic", envs)
+	assert.Equal(t, make([]error, n), errs)
+
+	// pstest does not keep the delivery order, only that the messages of a
+	// key are handled one at a time is checked.
+	var running int32
+	got := make(chan struct{}, n)
+	go b.Receive(c, cfg, func(ctx context.Context, msg mq.Message) {
+		assert.Equal(t, "key", msg.(*message).msg.OrderingKey)
+		assert.Equal(t, int32(1), atomic.AddInt32(&running, 1))
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		msg.Ack()
+		got <- struct{}{}
+	})
+	for i := 0; i < n; i++ {
+		select {
+		case <-got:
+		case <-c.Done():
+			t.Fatal("messages not received")
+		}
+	}
+}
+
+func TestDescribeSubscription(t *testing.T) {
+	b, closer := newTestBroker(t)
+	defer closer()
+
+	c, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := b.DescribeSubscription(c, "missing")
+	assert.Equal(t, mq.ErrSubscriptionNotFound, err)
+
+	for _, v := range []string{"topic", "dead"} {
+		assert.NoError(t, b.EnsureTopic(c, v))
+	}
+	cfg := &mq.SubscriptionConfig{
+		Topic:            "topic",
+		AckDeadline:      time.Minute,
+		Retention:        time.Hour,
+		DeadLetterPolicy: &mq.DeadLetterPolicy{Topic: "dead", MaxDeliveryAttempts: 5},
+		Filter:           `attributes.kind = "load"`,
+		RetryPolicy:      &mq.RetryPolicy{MinimumBackoff: time.Second, MaximumBackoff: time.Minute},
+		Ordered:          true,
+	}
+	assert.NoError(t, b.EnsureSubscription(c, cfg))
+	assert.NoError(t, b.EnsureSubscription(c, cfg))
+
+	actual, err := b.DescribeSubscription(c, cfg.GetName())
+	assert.NoError(t, err)
+	assert.Equal(t, &mq.SubscriptionConfig{
+		Topic:            "topic",
+		Name:             cfg.GetName(),
+		AckDeadline:      time.Minute,
+		Retention:        time.Hour,
+		DeadLetterPolicy: &mq.DeadLetterPolicy{Topic: "dead", MaxDeliveryAttempts: 5},
+		Filter:           `attributes.kind = "load"`,
+		RetryPolicy:      &mq.RetryPolicy{MinimumBackoff: time.Second, MaximumBackoff: time.Minute},
+		Ordered:          true,
+	}, actual)
+}
+
+func TestProvisionUpdate(t *testing.T) {
+	b, closer := newTestBroker(t)
+	defer closer()
+
+	c, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cfg := &mq.SubscriptionConfig{
+		Topic:            "topic",
+		AckDeadline:      time.Minute,
+		DeadLetterPolicy: &mq.DeadLetterPolicy{Topic: "dead", MaxDeliveryAttempts: 5},
+	}
+	drifts, err := mq.Provision(c, b, nil, []*mq.SubscriptionConfig{cfg})
+	assert.NoError(t, err)
+	assert.Empty(t, drifts)
+
+	// the drift of the ack deadline, retention, dead letter and retry
+	// policies is corrected, the filter and ordering are fixed once created.
+	declared := &mq.SubscriptionConfig{
+		Topic:            "topic",
+		AckDeadline:      30 * time.Second,
+		Retention:        time.Hour,
+		DeadLetterPolicy: &mq.DeadLetterPolicy{Topic: "dead", MaxDeliveryAttempts: 10},
+		Filter:           `attributes.kind = "load"`,
+		RetryPolicy:      &mq.RetryPolicy{MinimumBackoff: time.Second, MaximumBackoff: time.Minute},
+		Ordered:          true,
+	}
+	drifts, err = mq.Provision(c, b, nil, []*mq.SubscriptionConfig{declared})
+	assert.NoError(t, err)
+	assert.Equal(t, []*mq.Drift{
+		{Subscription: cfg.GetName(), Setting: "ack_deadline", Declared: "30s", Actual: "1m0s", Corrected: true},
+		{Subscription: cfg.GetName(), Setting: "retention", Declared: "1h0m0s", Actual: "168h0m0s", Corrected: true},
+		{Subscription: cfg.GetName(), Setting: "dead_letter_policy", Declared: "dead after 10 attempts", Actual: "dead after 5 attempts", Corrected: true},
+		{Subscription: cfg.GetName(), Setting: "filter", Declared: `attributes.kind = "load"`, Actual: ""},
+		{Subscription: cfg.GetName(), Setting: "retry_policy", Declared: "1s to 1m0s", Actual: "none", Corrected: true},
+		{Subscription: cfg.GetName(), Setting: "ordered", Declared: "true", Actual: "false"},
+	}, drifts)
+
+	actual, err := b.DescribeSubscription(c, cfg.GetName())
+	assert.NoError(t, err)
+	assert.Equal(t, &mq.SubscriptionConfig{
+		Topic:            "topic",
+		Name:             cfg.GetName(),
+		AckDeadline:      30 * time.Second,
+		Retention:        time.Hour,
+		DeadLetterPolicy: &mq.DeadLetterPolicy{Topic: "dead", MaxDeliveryAttempts: 10},
+		RetryPolicy:      &mq.RetryPolicy{MinimumBackoff: time.Second, MaximumBackoff: time.Minute},
+	}, actual)
+}
+
+func TestReceiveDeadLetter(t *testing.T) {
+	b, closer := newTestBroker(t)
+	defer closer()
+
+	c, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	source := &mq.SubscriptionConfig{Topic: "topic"}
+	dead := &mq.SubscriptionConfig{Topic: "dead"}
+	for _, cfg := range []*mq.SubscriptionConfig{source, dead} {
+		assert.NoError(t, b.EnsureTopic(c, cfg.Topic))
+		assert.NoError(t, b.EnsureSubscription(c, cfg))
+	}
+
+	// the attributes pubsub adds when it dead letters a message.
+	_, err := b.Publish(c, "dead", &mq.Envelope{
+		Data: []byte("hello"),
+		Attributes: map[string]string{
+			"k":                     "v",
+			_attrSourceSubscription: source.GetName(),
+			_attrSourceAttempt:      "5",
+			"CloudPubSubDeadLetterSourceSubscriptionProject": "test",
+		},
+	})
+	assert.NoError(t, err)
+
+	got := make(chan mq.Message, 1)
+	go b.Receive(c, dead, func(ctx context.Context, msg mq.Message) {
+		msg.Ack()
+		got <- msg
+	})
+
+	select {
+	case msg := <-got:
+		assert.Equal(t, map[string]string{
+			"k":                "v",
+			mq.AttrSourceTopic: "topic",
+			mq.AttrSourceID:    "",
+			mq.AttrError:       mq.ErrMaxDeliveryAttempts.Error(),
+			mq.AttrAttempt:     "5",
+		}, msg.Attributes())
+	case <-c.Done():
+		t.Fatal("message not received")
+	}
+}
+
+// testLimiter is a mq.Limiter whose limit is set by the test.
+type testLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	changed chan struct{}
+}
+
+func (l *testLimiter) Acquire(context.Context, bool) bool { return true }
+
+func (l *testLimiter) Release() {}
+
+func (l *testLimiter) Watch() (int, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit, l.changed
+}
+
+func (l *testLimiter) set(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func TestWatch(t *testing.T) {
+	l := &testLimiter{limit: 40, changed: make(chan struct{})}
+	done := make(chan bool, 1)
+	go func() {
+		done <- watch(context.Background(), l, 40, 100*time.Millisecond)
+	}()
+
+	// a small move does not restart, nor does a step before wait.
+	l.set(45)
+	l.set(30)
+	select {
+	case <-done:
+		t.Fatal("restarted before wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	l.set(35)
+	select {
+	case <-done:
+		t.Fatal("restarted by a small move")
+	case <-time.After(100 * time.Millisecond):
+	}
+	l.set(50)
+	select {
+	case ok := <-done:
+		assert.True(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("not restarted by a step")
+	}
+
+	c, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(t, watch(c, l, 50, time.Millisecond))
+}
@@ -0,0 +1,81 @@
+package redis
+
+import (
+	"ascale/pkg/cache/redis"
+	"ascale/pkg/log"
+	"ascale/pkg/mq"
+	"context"
+	"time"
+)
+
+// luaClaim sets KEYS[1] to processing for ARGV[1] ms unless it is set, it
+// returns 1 once claimed, 2 when processed and 0 when processing.
+var luaClaim = redis.NewScript(1, `
+if redis.call("set", KEYS[1], "0", "NX", "PX", ARGV[1]) then return 1 end
+if redis.call("get", KEYS[1]) == "1" then return 2 end
+return 0`)
+
+// DedupStore is a mq.DedupStore keeping keys as redis keys with a TTL, "0"
+// while processing and "1" once processed.
+type DedupStore struct {
+	pool   *redis.Pool
+	prefix string
+}
+
+var _ mq.DedupStore = (*DedupStore)(nil)
+
+// NewDedupStore creates a dedup store on top of pool, keys are prefixed by
+// prefix, default "mq:dedup:".
+func NewDedupStore(pool *redis.Pool, prefix string) *DedupStore {
+	if prefix == "" {
+		prefix = "mq:dedup:"
+	}
+	return &DedupStore{pool: pool, prefix: prefix}
+}
+
+// Claim records key as processing for ttl unless it is recorded already.
+func (s *DedupStore) Claim(c context.Context, key string, ttl time.Duration) (claimed, done bool, err error) {
+	var conn redis.Conn
+	if conn, err = s.pool.GetContext(c); err != nil {
+		log.For(c).Errorf("mq.redis.DedupStore.Claim() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	var n int
+	if n, err = redis.Int(luaClaim.Do(conn, s.prefix+key, int64(ttl/time.Millisecond))); err != nil {
+		log.For(c).Errorf("mq.redis.DedupStore.Claim() key(%s) error(%+v)", key, err)
+		return
+	}
+	return n == 1, n == 2, nil
+}
+
+// Mark records key as processed for ttl.
+func (s *DedupStore) Mark(c context.Context, key string, ttl time.Duration) (err error) {
+	var conn redis.Conn
+	if conn, err = s.pool.GetContext(c); err != nil {
+		log.For(c).Errorf("mq.redis.DedupStore.Mark() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err = conn.Do("SET", s.prefix+key, 1, "PX", int64(ttl/time.Millisecond)); err != nil {
+		log.For(c).Errorf("mq.redis.DedupStore.Mark() SET(%s) error(%+v)", key, err)
+	}
+	return
+}
+
+// Unmark drops key.
+func (s *DedupStore) Unmark(c context.Context, key string) (err error) {
+	var conn redis.Conn
+	if conn, err = s.pool.GetContext(c); err != nil {
+		log.For(c).Errorf("mq.redis.DedupStore.Unmark() error(%+v)", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err = conn.Do("DEL", s.prefix+key); err != nil {
+		log.For(c).Errorf("mq.redis.DedupStore.Unmark() DEL(%s) error(%+v)", key, err)
+	}
+	return
+}
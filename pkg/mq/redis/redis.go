@@ -0,0 +1,725 @@
+// Package redis is the Redis Streams driver of mq.
+//
+// Every topic is a stream and every subscription is a consumer group of that
+// stream. Messages are read with XREADGROUP and acknowledged with XACK,
+// entries left pending longer than the ack deadline (crashed consumers or
+// Nack) are taken over with XAUTOCLAIM and redelivered. Entries nacked with a
+// delay longer than the ack deadline are kept from going idle until they are
+// due. Requires Redis 6.2+.
+package redis
+
+import (
+	"ascale/pkg/cache/redis"
+	"ascale/pkg/conf/env"
+	"ascale/pkg/log"
+	"ascale/pkg/mq"
+	"ascale/pkg/xtime"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	_fieldData  = "data"
+	_fieldAttrs = "attrs"
+
+	_defaultAckDeadline = 30 * time.Second
+	_defaultBlock       = 2 * time.Second
+	// _backlogScan caps the undelivered entries Backlog counts.
+	_backlogScan = 10000
+)
+
+// Config redis stream driver config.
+type Config struct {
+	// Prefix of the stream keys, default "mq:".
+	Prefix string
+	// MaxLen trims streams to about MaxLen entries on publish, 0 disables trimming.
+	MaxLen int64
+	// Block is how long XREADGROUP waits for new entries, default 2s.
+	Block xtime.Duration
+	// Consumer name inside the consumer groups, default hostname.
+	Consumer string
+}
+
+// Broker is a mq.Broker backed by Redis Streams.
+type Broker struct {
+	c    *Config
+	pool *redis.Pool
+
+	closed chan struct{}
+	once   sync.Once
+}
+
+var (
+	_ mq.Broker         = (*Broker)(nil)
+	_ mq.BatchPublisher = (*Broker)(nil)
+	_ mq.Backlogger     = (*Broker)(nil)
+	_ mq.Delayer        = (*message)(nil)
+	_ mq.Extender       = (*message)(nil)
+	_ mq.Requeuer       = (*message)(nil)
+)
+
+// New creates a redis stream broker on top of pool, the pool is not closed
+// by Broker.Close.
+func New(pool *redis.Pool, c *Config) *Broker {
+	if c == nil {
+		c = &Config{}
+	}
+	if c.Prefix == "" {
+		c.Prefix = "mq:"
+	}
+	if c.Block <= 0 {
+		c.Block = xtime.Duration(_defaultBlock)
+	}
+	if c.Consumer == "" {
+		c.Consumer = env.Hostname
+	}
+	return &Broker{c: c, pool: pool, closed: make(chan struct{})}
+}
+
+func (b *Broker) key(topic string) string {
+	return b.c.Prefix + topic
+}
+
+func (b *Broker) topicsKey() string {
+	return b.c.Prefix + "topics"
+}
+
+func (b *Broker) do(c context.Context, cmd string, args ...interface{}) (reply interface{}, err error) {
+	var conn redis.Conn
+	if conn, err = b.pool.GetContext(c); err != nil {
+		return
+	}
+	defer conn.Close()
+	return conn.Do(cmd, args...)
+}
+
+// EnsureTopic registers the topic, streams themselves are created lazily.
+func (b *Broker) EnsureTopic(c context.Context, topic string) (err error) {
+	_, err = b.do(c, "SADD", b.topicsKey(), topic)
+	return
+}
+
+// DeleteTopic deletes the stream and all of its consumer groups.
+func (b *Broker) DeleteTopic(c context.Context, topic string) (err error) {
+	if _, err = b.do(c, "DEL", b.key(topic)); err != nil {
+		return
+	}
+	_, err = b.do(c, "SREM", b.topicsKey(), topic)
+	return
+}
+
+// Publish appends env to the topic stream.
+func (b *Broker) Publish(c context.Context, topic string, env *mq.Envelope) (id string, err error) {
+	if b.isClosed() {
+		return "", mq.ErrClosed
+	}
+	var args redis.Args
+	if args, err = b.xaddArgs(topic, env); err != nil {
+		return
+	}
+	return redis.String(b.do(c, "XADD", args...))
+}
+
+// PublishBatch appends envs to the topic stream in one pipeline.
+func (b *Broker) PublishBatch(c context.Context, topic string, envs []*mq.Envelope) (ids []string, errs []error) {
+	ids, errs = make([]string, len(envs)), make([]error, len(envs))
+	fail := func(err error) ([]string, []error) {
+		for i := range errs {
+			if errs[i] == nil && ids[i] == "" {
+				errs[i] = err
+			}
+		}
+		return ids, errs
+	}
+	if b.isClosed() {
+		return fail(mq.ErrClosed)
+	}
+
+	conn, err := b.pool.GetContext(c)
+	if err != nil {
+		return fail(err)
+	}
+	defer conn.Close()
+
+	sent := make([]bool, len(envs))
+	for i, env := range envs {
+		var args redis.Args
+		if args, errs[i] = b.xaddArgs(topic, env); errs[i] != nil {
+			continue
+		}
+		if err = conn.Send("XADD", args...); err != nil {
+			return fail(err)
+		}
+		sent[i] = true
+	}
+	if err = conn.Flush(); err != nil {
+		return fail(err)
+	}
+	for i := range envs {
+		if sent[i] {
+			if ids[i], errs[i] = redis.String(conn.Receive()); errs[i] != nil {
+				// the connection is broken when it is not a redis error.
+				if _, ok := errs[i].(redis.Error); !ok {
+					return fail(errs[i])
+				}
+			}
+		}
+	}
+	return
+}
+
+func (b *Broker) xaddArgs(topic string, env *mq.Envelope) (args redis.Args, err error) {
+	args = redis.Args{b.key(topic)}
+	if b.c.MaxLen > 0 {
+		args = args.Add("MAXLEN", "~", b.c.MaxLen)
+	}
+	args = args.Add("*", _fieldData, env.Data)
+	if len(env.Attributes) > 0 {
+		var attrs []byte
+		if attrs, err = jsoniter.Marshal(env.Attributes); err != nil {
+			return
+		}
+		args = args.Add(_fieldAttrs, attrs)
+	}
+	return
+}
+
+// EnsureSubscription creates the consumer group, new groups start at the end
+// of the stream like a new pubsub subscription does.
+func (b *Broker) EnsureSubscription(c context.Context, cfg *mq.SubscriptionConfig) (err error) {
+	_, err = b.do(c, "XGROUP", "CREATE", b.key(cfg.Topic), cfg.GetName(), "$", "MKSTREAM")
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		err = nil
+	}
+	return
+}
+
+// Receive reads the consumer group until c is done, handlers run on at most
+// cfg.MaxOutstandingMessages goroutines.
+func (b *Broker) Receive(c context.Context, cfg *mq.SubscriptionConfig, h mq.Handler) (err error) {
+	if err = b.EnsureSubscription(c, cfg); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(c)
+	defer cancel()
+	go func() {
+		select {
+		case <-b.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	r := &receiver{
+		b:    b,
+		cfg:  cfg,
+		h:    h,
+		key:  b.key(cfg.Topic),
+		sema: make(chan struct{}, cfg.GetMaxOutstandingMessages()),
+	}
+	r.ackDeadline = cfg.AckDeadline
+	if r.ackDeadline <= 0 {
+		r.ackDeadline = _defaultAckDeadline
+	}
+	if cfg.Ordered {
+		// entries queued behind their key are not claimed by others.
+		r.ordered = mq.NewOrdered(h, r.ackDeadline/3)
+	}
+	defer r.wg.Wait()
+
+	dc, stop := context.WithCancel(ctx)
+	delayed := make(chan struct{})
+	go func() {
+		r.delayproc(dc)
+		close(delayed)
+	}()
+	defer func() {
+		stop()
+		<-delayed
+	}()
+	return r.run(ctx)
+}
+
+// Backlog returns the pending entries of the consumer group plus the ones
+// not delivered yet, which are counted up to 10000. The lag of XINFO is not
+// used, it is unknown before Redis 7 and after trimming.
+func (b *Broker) Backlog(c context.Context, cfg *mq.SubscriptionConfig) (n int64, err error) {
+	var groups []interface{}
+	if groups, err = redis.Values(b.do(c, "XINFO", "GROUPS", b.key(cfg.Topic))); err != nil {
+		if strings.Contains(err.Error(), "no such key") {
+			err = mq.ErrSubscriptionNotFound
+		}
+		return
+	}
+
+	for _, g := range groups {
+		var fields []interface{}
+		if fields, err = redis.Values(g, nil); err != nil {
+			return
+		}
+		var (
+			name, last string
+			pending    int64
+		)
+		for i := 0; i+1 < len(fields); i += 2 {
+			switch k, _ := redis.String(fields[i], nil); k {
+			case "name":
+				name, _ = redis.String(fields[i+1], nil)
+			case "pending":
+				pending, _ = redis.Int64(fields[i+1], nil)
+			case "last-delivered-id":
+				last, _ = redis.String(fields[i+1], nil)
+			}
+		}
+		if name != cfg.GetName() {
+			continue
+		}
+
+		var entries []interface{}
+		if entries, err = redis.Values(b.do(c, "XRANGE", b.key(cfg.Topic), "("+last, "+", "COUNT", _backlogScan)); err != nil {
+			return
+		}
+		return pending + int64(len(entries)), nil
+	}
+	return 0, mq.ErrSubscriptionNotFound
+}
+
+// Close stops all running Receive calls.
+func (b *Broker) Close() error {
+	b.once.Do(func() { close(b.closed) })
+	return nil
+}
+
+func (b *Broker) isClosed() bool {
+	select {
+	case <-b.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// --------------------------------------------------------------------
+
+type receiver struct {
+	b           *Broker
+	cfg         *mq.SubscriptionConfig
+	h           mq.Handler
+	ordered     *mq.Ordered
+	key         string
+	ackDeadline time.Duration
+
+	sema   chan struct{}
+	wg     sync.WaitGroup
+	nacked int32
+}
+
+func (r *receiver) run(c context.Context) error {
+	lastClaim := time.Time{}
+	for {
+		// wait for a free slot before reading, so that unread entries stay in
+		// the stream for other consumers.
+		if !r.acquire(c, true) {
+			return nil
+		}
+		free := 1
+		for free < cap(r.sema) && r.acquire(c, false) {
+			free++
+		}
+
+		var (
+			msgs []*message
+			err  error
+		)
+		if atomic.SwapInt32(&r.nacked, 0) == 1 || time.Since(lastClaim) > r.ackDeadline/2 {
+			if msgs, err = r.claim(c, free); err == nil && len(msgs) < free {
+				lastClaim = time.Now()
+			}
+		}
+		if err == nil && len(msgs) == 0 {
+			msgs, err = r.read(c, free)
+		}
+		if err != nil {
+			r.release(free)
+			if c.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		r.release(free - len(msgs))
+		for _, m := range msgs {
+			r.dispatch(c, m)
+		}
+	}
+}
+
+// delayKey is the sorted set of the entries of the subscription nacked with
+// a delay longer than the ack deadline, scored by the ms they are due at.
+func (r *receiver) delayKey() string {
+	return r.key + ":delayed:" + r.cfg.GetName()
+}
+
+// delayproc keeps the delayed entries from going idle for XAUTOCLAIM until
+// they are due, they are made idle then and redelivered by the next claim.
+// Any consumer of the group holds them, a delay outlives its consumer.
+func (r *receiver) delayproc(c context.Context) {
+	t := time.NewTicker(r.ackDeadline / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.Done():
+			return
+		case <-t.C:
+		}
+		if err := r.holdDelayed(c); err != nil && c.Err() == nil {
+			log.For(c).Errorf("mq.redis.holdDelayed(%s) error(%+v)", r.key, err)
+		}
+	}
+}
+
+func (r *receiver) holdDelayed(c context.Context) (err error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	var held, due []string
+	if held, err = redis.Strings(r.b.do(c, "ZRANGEBYSCORE", r.delayKey(), "("+now, "+inf", "LIMIT", 0, 1000)); err != nil {
+		return
+	}
+	if due, err = redis.Strings(r.b.do(c, "ZRANGEBYSCORE", r.delayKey(), "-inf", now, "LIMIT", 0, 1000)); err != nil {
+		return
+	}
+
+	// JUSTID leaves the delivery counter as it is.
+	claim := func(ids []string, idle time.Duration) error {
+		args := redis.Args{}.Add(r.key, r.cfg.GetName(), r.b.c.Consumer, 0).AddFlat(ids).
+			Add("IDLE", int64(idle/time.Millisecond), "JUSTID")
+		_, err := r.b.do(c, "XCLAIM", args...)
+		return err
+	}
+	if len(held) > 0 {
+		if err = claim(held, 0); err != nil {
+			return
+		}
+	}
+	if len(due) > 0 {
+		if err = claim(due, r.ackDeadline); err != nil {
+			return
+		}
+		if _, err = r.b.do(c, "ZREM", redis.Args{}.Add(r.delayKey()).AddFlat(due)...); err != nil {
+			return
+		}
+		atomic.StoreInt32(&r.nacked, 1)
+	}
+	return
+}
+
+// acquire takes a slot of the receiver and of the limiter of the
+// subscription, waiting for them until c is done when wait is set.
+func (r *receiver) acquire(c context.Context, wait bool) bool {
+	if wait {
+		select {
+		case <-c.Done():
+			return false
+		case r.sema <- struct{}{}:
+		}
+	} else {
+		select {
+		case r.sema <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	if l := r.cfg.Limiter; l != nil && !l.Acquire(c, wait) {
+		<-r.sema
+		return false
+	}
+	return true
+}
+
+func (r *receiver) release(n int) {
+	for i := 0; i < n; i++ {
+		if l := r.cfg.Limiter; l != nil {
+			l.Release()
+		}
+		<-r.sema
+	}
+}
+
+func (r *receiver) dispatch(c context.Context, m *message) {
+	if p := r.cfg.DeadLetterPolicy; p != nil && p.MaxDeliveryAttempts > 0 && m.attempt > p.MaxDeliveryAttempts {
+		if err := r.deadLetter(c, m); err != nil {
+			log.For(c).Errorf("mq.redis.deadLetter(%s) id(%s) error(%+v)", r.key, m.id, err)
+		}
+		r.release(1)
+		return
+	}
+
+	r.wg.Add(1)
+	done := func() {
+		r.release(1)
+		r.wg.Done()
+	}
+	if r.ordered != nil {
+		// keep delivery order, the ordered handler only queues.
+		r.ordered.Handle(c, m, done)
+		return
+	}
+	go func() {
+		defer done()
+		r.h(c, m)
+	}()
+}
+
+// deadLetter forwards m to the dead letter topic and acks it.
+func (r *receiver) deadLetter(c context.Context, m *message) (err error) {
+	env := mq.DeadLetterEnvelope(r.cfg.Topic, m.id, m.data, m.attrs, m.attempt-1, mq.ErrMaxDeliveryAttempts)
+	if _, err = r.b.Publish(c, r.cfg.DeadLetterPolicy.Topic, env); err != nil {
+		return
+	}
+	_, err = r.b.do(c, "XACK", r.key, r.cfg.GetName(), m.id)
+	return
+}
+
+// read reads new entries of the group.
+func (r *receiver) read(c context.Context, count int) (msgs []*message, err error) {
+	var conn redis.Conn
+	if conn, err = r.b.pool.GetContext(c); err != nil {
+		return
+	}
+	defer conn.Close()
+
+	block := time.Duration(r.b.c.Block)
+	reply, err := redis.Values(redis.DoWithTimeout(conn, block+time.Second,
+		"XREADGROUP", "GROUP", r.cfg.GetName(), r.b.c.Consumer,
+		"COUNT", count, "BLOCK", int64(block/time.Millisecond),
+		"STREAMS", r.key, ">"))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		if strings.HasPrefix(err.Error(), "NOGROUP") {
+			err = mq.ErrSubscriptionNotFound
+		}
+		return
+	}
+
+	for _, s := range reply {
+		var stream []interface{}
+		if stream, err = redis.Values(s, nil); err != nil || len(stream) != 2 {
+			return
+		}
+		var entries []interface{}
+		if entries, err = redis.Values(stream[1], nil); err != nil {
+			return
+		}
+		for _, m := range r.parseAll(c, entries) {
+			m.attempt = 1
+			msgs = append(msgs, m)
+		}
+	}
+	return
+}
+
+// claim takes over entries pending longer than the ack deadline.
+func (r *receiver) claim(c context.Context, count int) (msgs []*message, err error) {
+	var reply []interface{}
+	reply, err = redis.Values(r.b.do(c, "XAUTOCLAIM", r.key, r.cfg.GetName(), r.b.c.Consumer,
+		int64(r.ackDeadline/time.Millisecond), "0-0", "COUNT", count))
+	if err != nil {
+		return
+	}
+	if len(reply) < 2 {
+		return
+	}
+
+	var entries []interface{}
+	if entries, err = redis.Values(reply[1], nil); err != nil {
+		return
+	}
+	if msgs = r.parseAll(c, entries); len(msgs) == 0 {
+		return
+	}
+
+	// XAUTOCLAIM increments the delivery counter, read it back from the PEL.
+	var pending []interface{}
+	if pending, err = redis.Values(r.b.do(c, "XPENDING", r.key, r.cfg.GetName(),
+		msgs[0].id, msgs[len(msgs)-1].id, len(msgs)*2, r.b.c.Consumer)); err != nil {
+		return
+	}
+	attempts := make(map[string]int, len(pending))
+	for _, p := range pending {
+		var v []interface{}
+		if v, err = redis.Values(p, nil); err != nil || len(v) < 4 {
+			return
+		}
+		id, _ := redis.String(v[0], nil)
+		n, _ := redis.Int(v[3], nil)
+		attempts[id] = n
+	}
+	for _, m := range msgs {
+		m.attempt = attempts[m.id]
+	}
+	return
+}
+
+// parseAll parses entries, deleted entries are acked and skipped. Entries
+// which can not be parsed are logged and dead lettered or acked, left
+// pending they would be claimed again after every restart.
+func (r *receiver) parseAll(c context.Context, entries []interface{}) (msgs []*message) {
+	for _, e := range entries {
+		id, m, err := r.parse(e)
+		switch {
+		case err != nil:
+			log.For(c).Errorf("mq.redis.parse(%s) id(%s) error(%+v)", r.key, id, err)
+			if id != "" {
+				r.reject(c, id, m, err)
+			}
+		case m == nil:
+			if _, err = r.b.do(c, "XACK", r.key, r.cfg.GetName(), id); err != nil {
+				log.For(c).Errorf("mq.redis.parse(%s) id(%s) ack deleted error(%+v)", r.key, id, err)
+			}
+		default:
+			msgs = append(msgs, m)
+		}
+	}
+	return
+}
+
+// parse parses a stream entry [id, [field, value, ...]], m is nil for
+// deleted entries (nil fields). id is empty when the entry has none and m
+// holds the payload read so far when err is set.
+func (r *receiver) parse(e interface{}) (id string, m *message, err error) {
+	var entry []interface{}
+	if entry, err = redis.Values(e, nil); err != nil {
+		return
+	}
+	if len(entry) != 2 {
+		err = fmt.Errorf("mq: stream entry of %d elements", len(entry))
+		return
+	}
+	if id, err = redis.String(entry[0], nil); err != nil || entry[1] == nil {
+		return
+	}
+
+	var fields [][]byte
+	if fields, err = redis.ByteSlices(entry[1], nil); err != nil {
+		return
+	}
+	m = &message{r: r, id: id}
+	for i := 0; i+1 < len(fields); i += 2 {
+		switch string(fields[i]) {
+		case _fieldData:
+			m.data = fields[i+1]
+		case _fieldAttrs:
+			if err = jsoniter.Unmarshal(fields[i+1], &m.attrs); err != nil {
+				err = fmt.Errorf("mq: decode attrs: %w", err)
+			}
+		}
+	}
+	return
+}
+
+// reject forwards the entry id which can not be parsed to the dead letter
+// topic of the subscription, if any, and acks it.
+func (r *receiver) reject(c context.Context, id string, m *message, cause error) {
+	if p := r.cfg.DeadLetterPolicy; p != nil && m != nil {
+		env := mq.DeadLetterEnvelope(r.cfg.Topic, id, m.data, nil, 1, cause)
+		if _, err := r.b.Publish(c, p.Topic, env); err != nil {
+			log.For(c).Errorf("mq.redis.reject(%s) id(%s) dead letter error(%+v)", r.key, id, err)
+			return
+		}
+	}
+	if _, err := r.b.do(c, "XACK", r.key, r.cfg.GetName(), id); err != nil {
+		log.For(c).Errorf("mq.redis.reject(%s) id(%s) ack error(%+v)", r.key, id, err)
+	}
+}
+
+// --------------------------------------------------------------------
+
+// message is a stream entry delivered to a handler.
+type message struct {
+	r       *receiver
+	id      string
+	data    []byte
+	attrs   map[string]string
+	attempt int
+
+	once sync.Once
+}
+
+func (m *message) ID() string                    { return m.id }
+func (m *message) Data() []byte                  { return m.data }
+func (m *message) Attributes() map[string]string { return m.attrs }
+func (m *message) DeliveryAttempt() int          { return m.attempt }
+
+// PublishTime is the millisecond part of the entry id.
+func (m *message) PublishTime() time.Time {
+	ms, _ := strconv.ParseInt(strings.SplitN(m.id, "-", 2)[0], 10, 64)
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// Ack removes the entry from the pending entries list.
+func (m *message) Ack() {
+	m.once.Do(func() {
+		r := m.r
+		if _, err := r.b.do(context.Background(), "XACK", r.key, r.cfg.GetName(), m.id); err != nil {
+			log.Errorf("mq.redis.Ack(%s) id(%s) error(%+v)", r.key, m.id, err)
+		}
+	})
+}
+
+// Extend resets the idle time of the pending entry, XAUTOCLAIM takes it over
+// an ack deadline later.
+func (m *message) Extend() {
+	r := m.r
+	if _, err := r.b.do(context.Background(), "XCLAIM", r.key, r.cfg.GetName(), r.b.c.Consumer,
+		0, m.id, "IDLE", 0, "RETRYCOUNT", m.attempt, "JUSTID"); err != nil {
+		log.Errorf("mq.redis.Extend(%s) id(%s) error(%+v)", r.key, m.id, err)
+	}
+}
+
+// Nack marks the pending entry idle for a whole ack deadline so that the
+// next XAUTOCLAIM redelivers it right away.
+func (m *message) Nack() {
+	m.NackDelay(0)
+}
+
+// NackDelay marks the pending entry idle for the ack deadline minus d, so
+// that XAUTOCLAIM takes it over after d. RETRYCOUNT keeps the delivery
+// counter untouched as the claim increments it. Entries delayed longer than
+// the ack deadline are held by delayproc until d.
+func (m *message) NackDelay(d time.Duration) {
+	m.once.Do(func() { m.nack(d, m.attempt) })
+}
+
+// Requeue is NackDelay with the delivery counter set back, the claim
+// redelivers it as the same attempt.
+func (m *message) Requeue(d time.Duration) {
+	m.once.Do(func() { m.nack(d, m.attempt-1) })
+}
+
+func (m *message) nack(d time.Duration, retries int) {
+	r := m.r
+	idle := r.ackDeadline - d
+	if idle < 0 {
+		due := time.Now().Add(d).UnixMilli()
+		if _, err := r.b.do(context.Background(), "ZADD", r.delayKey(), due, m.id); err != nil {
+			log.Errorf("mq.redis.Nack(%s) id(%s) delay error(%+v)", r.key, m.id, err)
+		}
+		idle = 0
+	}
+	if _, err := r.b.do(context.Background(), "XCLAIM", r.key, r.cfg.GetName(), r.b.c.Consumer,
+		0, m.id, "IDLE", int64(idle/time.Millisecond), "RETRYCOUNT", retries, "JUSTID"); err != nil {
+		log.Errorf("mq.redis.Nack(%s) id(%s) error(%+v)", r.key, m.id, err)
+		return
+	}
+	if d <= 0 {
+		atomic.StoreInt32(&r.nacked, 1)
+	}
+}
@@ -0,0 +1,360 @@
+package redis
+
+import (
+	"ascale/pkg/cache/redis"
+	"ascale/pkg/cache/redis/redistest"
+	"ascale/pkg/mq"
+	"ascale/pkg/xtime"
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestBroker(t *testing.T) *Broker {
+	b := New(redistest.NewPool(t, 0), &Config{
+		Prefix:   fmt.Sprintf("mqtest:%d:", time.Now().UnixNano()),
+		Block:    xtime.Duration(100 * time.Millisecond),
+		Consumer: "test",
+	})
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func receive(c context.Context, b *Broker, cfg *mq.SubscriptionConfig, h mq.Handler) <-chan error {
+	ch := make(chan error, 1)
+	go func() { ch <- b.Receive(c, cfg, h) }()
+	return ch
+}
+
+func TestPublishReceive(t *testing.T) {
+	b := newTestBroker(t)
+	c, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := &mq.SubscriptionConfig{Topic: "topic"}
+	assert.NoError(t, b.EnsureTopic(c, "topic"))
+	assert.NoError(t, b.EnsureSubscription(c, cfg))
+	assert.NoError(t, b.EnsureSubscription(c, cfg))
+
+	id, err := b.Publish(c, "topic", &mq.Envelope{
+		Data:       []byte("hello"),
+		Attributes: map[string]string{"k": "v"},
+	})
+	assert.NoError(t, err)
+
+	got := make(chan mq.Message, 1)
+	done := receive(c, b, cfg, func(ctx context.Context, msg mq.Message) {
+		msg.Ack()
+		got <- msg
+	})
+
+	select {
+	case msg := <-got:
+		assert.Equal(t, id, msg.ID())
+		assert.Equal(t, "hello", string(msg.Data()))
+		assert.Equal(t, "v", msg.Attributes()["k"])
+		assert.Equal(t, 1, msg.DeliveryAttempt())
+		assert.WithinDuration(t, time.Now(), msg.PublishTime(), 5*time.Second)
+	case <-c.Done():
+		t.Fatal("message not received")
+	}
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestNackRedelivery(t *testing.T) {
+	b := newTestBroker(t)
+	c, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := &mq.SubscriptionConfig{Topic: "topic", AckDeadline: time.Second}
+	assert.NoError(t, b.EnsureSubscription(c, cfg))
+	_, err := b.Publish(c, "topic", &mq.Envelope{Data: []byte("retry")})
+	assert.NoError(t, err)
+
+	attempts := make(chan int, 3)
+	receive(c, b, cfg, func(ctx context.Context, msg mq.Message) {
+		attempts <- msg.DeliveryAttempt()
+		if msg.DeliveryAttempt() < 2 {
+			msg.Nack()
+			return
+		}
+		msg.Ack()
+	})
+
+	for want := 1; want <= 2; want++ {
+		select {
+		case got := <-attempts:
+			assert.Equal(t, want, got)
+		case <-c.Done():
+			t.Fatalf("attempt %d not delivered", want)
+		}
+	}
+}
+
+func TestNackDelayLong(t *testing.T) {
+	b := newTestBroker(t)
+	c, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := &mq.SubscriptionConfig{Topic: "topic", AckDeadline: 300 * time.Millisecond}
+	assert.NoError(t, b.EnsureSubscription(c, cfg))
+	_, err := b.Publish(c, "topic", &mq.Envelope{Data: []byte("later")})
+	assert.NoError(t, err)
+
+	// a delay longer than the ack deadline is not cut to it.
+	delivered := make(chan time.Time, 2)
+	receive(c, b, cfg, func(ctx context.Context, msg mq.Message) {
+		delivered <- time.Now()
+		if msg.DeliveryAttempt() < 2 {
+			msg.(mq.Delayer).NackDelay(time.Second)
+			return
+		}
+		msg.Ack()
+	})
+
+	var times []time.Time
+	for i := 0; i < 2; i++ {
+		select {
+		case v := <-delivered:
+			times = append(times, v)
+		case <-c.Done():
+			t.Fatalf("attempt %d not delivered", i+1)
+		}
+	}
+	assert.True(t, times[1].Sub(times[0]) >= time.Second, "redelivered after %s", times[1].Sub(times[0]))
+}
+
+func TestDeadLetter(t *testing.T) {
+	b := newTestBroker(t)
+	c, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := &mq.SubscriptionConfig{
+		Topic:            "topic",
+		AckDeadline:      time.Second,
+		DeadLetterPolicy: &mq.DeadLetterPolicy{Topic: "dead", MaxDeliveryAttempts: 2},
+	}
+	dcfg := &mq.SubscriptionConfig{Topic: "dead"}
+	assert.NoError(t, b.EnsureSubscription(c, cfg))
+	assert.NoError(t, b.EnsureSubscription(c, dcfg))
+	_, err := b.Publish(c, "topic", &mq.Envelope{Data: []byte("poison")})
+	assert.NoError(t, err)
+
+	receive(c, b, cfg, func(ctx context.Context, msg mq.Message) {
+		msg.Nack()
+	})
+	dead := make(chan mq.Message, 1)
+	receive(c, b, dcfg, func(ctx context.Context, msg mq.Message) {
+		msg.Ack()
+		dead <- msg
+	})
+
+	select {
+	case msg := <-dead:
+		assert.Equal(t, "poison", string(msg.Data()))
+	case <-c.Done():
+		t.Fatal("message not dead lettered")
+	}
+}
+
+func TestMalformedEntry(t *testing.T) {
+	b := newTestBroker(t)
+	c, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := &mq.SubscriptionConfig{
+		Topic:            "topic",
+		DeadLetterPolicy: &mq.DeadLetterPolicy{Topic: "dead", MaxDeliveryAttempts: 5},
+	}
+	dcfg := &mq.SubscriptionConfig{Topic: "dead"}
+	assert.NoError(t, b.EnsureSubscription(c, cfg))
+	assert.NoError(t, b.EnsureSubscription(c, dcfg))
+	bad, err := redis.String(b.do(c, "XADD", b.key("topic"), "*", _fieldData, "bad", _fieldAttrs, "{"))
+	assert.NoError(t, err)
+	_, err = b.Publish(c, "topic", &mq.Envelope{Data: []byte("good")})
+	assert.NoError(t, err)
+
+	// the entry after the malformed one in the batch is delivered.
+	got := make(chan mq.Message, 2)
+	receive(c, b, cfg, func(ctx context.Context, msg mq.Message) {
+		msg.Ack()
+		got <- msg
+	})
+	dead := make(chan mq.Message, 1)
+	receive(c, b, dcfg, func(ctx context.Context, msg mq.Message) {
+		msg.Ack()
+		dead <- msg
+	})
+	for _, ch := range []chan mq.Message{got, dead} {
+		select {
+		case msg := <-ch:
+			if ch == got {
+				assert.Equal(t, "good", string(msg.Data()))
+			} else {
+				assert.Equal(t, "bad", string(msg.Data()))
+				assert.Equal(t, bad, msg.Attributes()[mq.AttrSourceID])
+			}
+		case <-c.Done():
+			t.Fatal("message not received")
+		}
+	}
+
+	// the malformed entry is not left pending.
+	pending, err := redis.Values(b.do(c, "XPENDING", b.key("topic"), cfg.GetName()))
+	assert.NoError(t, err)
+	n, _ := redis.Int(pending[0], nil)
+	assert.Equal(t, 0, n)
+}
+
+func TestMaxLen(t *testing.T) {
+	b := newTestBroker(t)
+	b.c.MaxLen = 10
+	c := context.Background()
+
+	for i := 0; i < 1000; i++ {
+		_, err := b.Publish(c, "topic", &mq.Envelope{Data: []byte("x")})
+		assert.NoError(t, err)
+	}
+	n, err := redis.Int64(b.do(c, "XLEN", b.key("topic")))
+	assert.NoError(t, err)
+	assert.True(t, n < 1000, "stream not trimmed, len %d", n)
+}
+
+func TestDedupStore(t *testing.T) {
+	b := newTestBroker(t)
+	c := context.Background()
+	s := NewDedupStore(b.pool, b.c.Prefix+"dedup:")
+
+	claimed, done, err := s.Claim(c, "key", time.Second)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+	assert.False(t, done)
+	claimed, done, err = s.Claim(c, "key", time.Second)
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+	assert.False(t, done)
+
+	assert.NoError(t, s.Mark(c, "key", time.Second))
+	claimed, done, err = s.Claim(c, "key", time.Second)
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+	assert.True(t, done)
+
+	assert.NoError(t, s.Unmark(c, "key"))
+	claimed, _, err = s.Claim(c, "key", time.Second)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+}
+
+func TestPublishBatch(t *testing.T) {
+	b := newTestBroker(t)
+	c, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := &mq.SubscriptionConfig{Topic: "topic"}
+	assert.NoError(t, b.EnsureTopic(c, "topic"))
+	assert.NoError(t, b.EnsureSubscription(c, cfg))
+
+	envs := []*mq.Envelope{{Data: []byte("a")}, {Data: []byte("b"), Attributes: map[string]string{"k": "v"}}}
+	ids, errs := b.PublishBatch(c, "topic", envs)
+	assert.Equal(t, []error{nil, nil}, errs)
+
+	got := make(chan mq.Message, 2)
+	done := receive(c, b, cfg, func(ctx context.Context, msg mq.Message) {
+		msg.Ack()
+		got <- msg
+	})
+	for i := range envs {
+		select {
+		case msg := <-got:
+			assert.Equal(t, ids[i], msg.ID())
+			assert.Equal(t, envs[i].Data, msg.Data())
+		case <-c.Done():
+			t.Fatal("message not received")
+		}
+	}
+	cancel()
+	<-done
+}
+
+func TestReceiveOrdered(t *testing.T) {
+	b := newTestBroker(t)
+	c, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := &mq.SubscriptionConfig{Topic: "topic", MaxOutstandingMessages: 4, Ordered: true}
+	assert.NoError(t, b.EnsureTopic(c, "topic"))
+	assert.NoError(t, b.EnsureSubscription(c, cfg))
+	for i := 0; i < 5; i++ {
+		env := &mq.Envelope{
+			Data:       []byte(strconv.Itoa(i)),
+			Attributes: map[string]string{mq.AttrOrderingKey: "key"},
+		}
+		_, err := b.Publish(c, "topic", env)
+		assert.NoError(t, err)
+	}
+
+	got := make(chan string, 5)
+	done := receive(c, b, cfg, func(ctx context.Context, msg mq.Message) {
+		time.Sleep(10 * time.Millisecond)
+		msg.Ack()
+		got <- string(msg.Data())
+	})
+	for i := 0; i < 5; i++ {
+		select {
+		case v := <-got:
+			assert.Equal(t, strconv.Itoa(i), v)
+		case <-c.Done():
+			t.Fatal("message not received")
+		}
+	}
+	cancel()
+	<-done
+}
+
+func TestBacklog(t *testing.T) {
+	b := newTestBroker(t)
+	c, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := &mq.SubscriptionConfig{Topic: "topic"}
+	_, err := b.Backlog(c, cfg)
+	assert.Equal(t, mq.ErrSubscriptionNotFound, err)
+
+	assert.NoError(t, b.EnsureSubscription(c, cfg))
+	for i := 0; i < 3; i++ {
+		_, err = b.Publish(c, "topic", &mq.Envelope{Data: []byte(strconv.Itoa(i))})
+		assert.NoError(t, err)
+	}
+	n, err := b.Backlog(c, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+
+	// the first message is acked, the second one is kept in flight.
+	got := make(chan string, 3)
+	receive(c, b, cfg, func(ctx context.Context, msg mq.Message) {
+		got <- string(msg.Data())
+		if string(msg.Data()) == "0" {
+			msg.Ack()
+			return
+		}
+		<-ctx.Done()
+	})
+	for _, want := range []string{"0", "1"} {
+		select {
+		case v := <-got:
+			assert.Equal(t, want, v)
+		case <-c.Done():
+			t.Fatal("message not received")
+		}
+	}
+	n, err = b.Backlog(c, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+}
@@ -0,0 +1,47 @@
+package mq
+
+import (
+	"errors"
+	"time"
+)
+
+// Delayer is implemented by messages whose broker can redeliver a nacked
+// message after a delay. Router falls back to holding the message for the
+// delay before Nack when a message does not implement it.
+type Delayer interface {
+	// NackDelay nacks the message, it is redelivered no sooner than d.
+	NackDelay(d time.Duration)
+}
+
+// Requeuer is implemented by messages whose broker can redeliver a nacked
+// message without counting the delivery attempt, e.g. a duplicate which is
+// not handled because the original still is.
+type Requeuer interface {
+	// Requeue nacks the message, it is redelivered no sooner than d with
+	// the delivery attempt it had.
+	Requeue(d time.Duration)
+}
+
+// permanentError marks an error that retrying will not fix.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so that Router forwards the message to the dead letter
+// topic instead of retrying it. Errors are retryable unless wrapped.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether err or any error it wraps was returned by
+// Permanent.
+func IsPermanent(err error) bool {
+	var pe *permanentError
+	return errors.As(err, &pe)
+}
@@ -0,0 +1,225 @@
+package mq
+
+import (
+	"ascale/pkg/log"
+	netutil "ascale/pkg/net"
+	"ascale/pkg/stat/prom"
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Attributes added to messages forwarded to the dead letter topic.
+const (
+	AttrSourceTopic = "x-source-topic"
+	AttrSourceID    = "x-source-id"
+	AttrError       = "x-error"
+	AttrAttempt     = "x-delivery-attempt"
+)
+
+// DeadLetterEnvelope builds the dead letter of the message id of topic, its
+// attributes are kept and the source, cause and delivery attempt are added.
+func DeadLetterEnvelope(topic, id string, data []byte, attrs map[string]string, attempt int, cause error) *Envelope {
+	da := make(map[string]string, len(attrs)+4)
+	for k, v := range attrs {
+		da[k] = v
+	}
+	da[AttrSourceTopic] = topic
+	da[AttrSourceID] = id
+	da[AttrError] = cause.Error()
+	da[AttrAttempt] = strconv.Itoa(attempt)
+	return &Envelope{Data: data, Attributes: da}
+}
+
+// _maxRetryWait caps the backoff a handler waits for before it nacks a
+// message its broker can not delay.
+const _maxRetryWait = time.Second
+
+// RouterConfig router config.
+type RouterConfig struct {
+	// DeadLetter is the topic of undecodable messages, permanent failures and
+	// messages out of delivery attempts. They are only logged when empty.
+	DeadLetter string
+	// MaxDeliveryAttempts before a failing message goes to DeadLetter, 0
+	// retries forever. Requires a broker which tracks delivery attempts.
+	// Subscriptions with a DeadLetterPolicy use its topic and attempts.
+	MaxDeliveryAttempts int
+	// Backoff of redeliveries, default netutil.DefaultBackoffConfig.
+	Backoff *netutil.BackoffConfig
+}
+
+// HandlerFunc handles a message, see Router.HandleRaw for how its result
+// settles the message.
+type HandlerFunc func(c context.Context, msg Message) error
+
+// Middleware wraps the HandlerFunc of a subscription.
+type Middleware func(cfg *SubscriptionConfig, next HandlerFunc) HandlerFunc
+
+// Route is a subscription and the handler of its messages.
+type Route struct {
+	Config  *SubscriptionConfig
+	Handler Handler
+}
+
+// Router registers handlers per subscription, handlers are wrapped with
+// decoding, metrics, logging, retries and dead lettering.
+type Router struct {
+	b      Publisher
+	c      *RouterConfig
+	routes []*Route
+}
+
+// NewRouter creates a router.
+func NewRouter(b Publisher, c *RouterConfig) *Router {
+	if c == nil {
+		c = &RouterConfig{}
+	}
+	if c.Backoff == nil {
+		bc := netutil.DefaultBackoffConfig
+		c.Backoff = &bc
+	}
+	return &Router{b: b, c: c}
+}
+
+// Routes returns the registered routes in registration order.
+func (r *Router) Routes() []*Route {
+	return r.routes
+}
+
+// HandleRaw registers fn for the subscription without decoding the payload.
+// The message is acked when fn returns nil, errors wrapped by Permanent go
+// to the dead letter topic and other errors are redelivered with backoff
+// until MaxDeliveryAttempts. Middlewares wrap fn in order, the first one is
+// the outermost.
+func (r *Router) HandleRaw(cfg *SubscriptionConfig, fn HandlerFunc, mws ...Middleware) {
+	for i := len(mws) - 1; i >= 0; i-- {
+		fn = mws[i](cfg, fn)
+	}
+	r.routes = append(r.routes, &Route{Config: cfg, Handler: r.wrap(cfg, fn)})
+}
+
+// Handle registers fn for the subscription, the JSON payload is decoded into
+// a new T. Results are handled like HandleRaw, payloads which can not be
+// decoded go to the dead letter topic.
+func Handle[T any](r *Router, cfg *SubscriptionConfig, fn func(c context.Context, arg *T) error, mws ...Middleware) {
+	r.HandleRaw(cfg, func(c context.Context, msg Message) (err error) {
+		arg := new(T)
+		if err = jsoniter.Unmarshal(msg.Data(), arg); err != nil {
+			return Permanent(fmt.Errorf("mq: decode payload: %w", err))
+		}
+		return fn(c, arg)
+	}, mws...)
+}
+
+func (r *Router) wrap(cfg *SubscriptionConfig, fn HandlerFunc) Handler {
+	topic := cfg.Topic
+	name := fmt.Sprintf("consumer:%s", topic)
+	dead, maxAttempts := r.c.DeadLetter, r.c.MaxDeliveryAttempts
+	if p := cfg.DeadLetterPolicy; p != nil {
+		dead, maxAttempts = p.Topic, p.MaxDeliveryAttempts
+	}
+	return func(c context.Context, msg Message) {
+		now := time.Now()
+		result := "ack"
+		defer func() {
+			if e := recover(); e != nil {
+				buf := make([]byte, 64*1024)
+				buf = buf[:runtime.Stack(buf, false)]
+				log.For(c).Errorf("mq.Handle(%s) id(%s) panic(%v) stack(%s)", topic, msg.ID(), e, buf)
+				msg.Nack()
+				result = "nack"
+			}
+			prom.Consumer.Timing(name, int64(time.Since(now)/time.Millisecond))
+			prom.Consumer.Incr(name)
+			prom.ConsumerResult.Incr(name, result)
+		}()
+
+		err := fn(c, msg)
+		switch {
+		case err == nil:
+			msg.Ack()
+			return
+		case errors.Is(err, ErrInFlight):
+			// not a failure, the attempt is not counted when the broker
+			// can requeue it.
+			result = "inflight"
+			r.requeue(c, cfg, msg)
+			return
+		case IsPermanent(err):
+		case maxAttempts > 0 && msg.DeliveryAttempt() >= maxAttempts:
+		default:
+			log.For(c).Warnf("mq.Handle(%s) id(%s) attempt(%d) retry error(%+v)", topic, msg.ID(), msg.DeliveryAttempt(), err)
+			result = "retry"
+			r.retry(c, cfg, msg)
+			return
+		}
+
+		log.For(c).Errorf("mq.Handle(%s) id(%s) attempt(%d) data(%s) dead letter error(%+v)", topic, msg.ID(), msg.DeliveryAttempt(), msg.Data(), err)
+		result = "dead"
+		if e := r.deadLetter(c, dead, topic, msg, err); e != nil {
+			log.For(c).Errorf("mq.Handle(%s) id(%s) publish dead letter error(%+v)", topic, msg.ID(), e)
+			result = "retry"
+			r.retry(c, cfg, msg)
+			return
+		}
+		msg.Ack()
+	}
+}
+
+// requeue redelivers msg after the first backoff without counting its
+// delivery attempt, it is retried like a failure by other brokers.
+func (r *Router) requeue(c context.Context, cfg *SubscriptionConfig, msg Message) {
+	if q, ok := msg.(Requeuer); ok {
+		q.Requeue(r.c.Backoff.Backoff(0))
+		return
+	}
+	r.retry(c, cfg, msg)
+}
+
+// retry nacks msg, it is redelivered after the backoff of its attempt.
+// Brokers which can not delay it, e.g. pubsub, leave the backoff to the
+// RetryPolicy of the subscription, msg is nacked right away then. Without
+// one the handler waits up to _maxRetryWait, the subscription is blocked
+// meanwhile.
+func (r *Router) retry(c context.Context, cfg *SubscriptionConfig, msg Message) {
+	retries := msg.DeliveryAttempt() - 1
+	if retries < 0 {
+		retries = 0
+	}
+	delay := r.c.Backoff.Backoff(retries)
+	if d, ok := msg.(Delayer); ok {
+		d.NackDelay(delay)
+		return
+	}
+	if cfg.RetryPolicy != nil {
+		msg.Nack()
+		return
+	}
+	if delay > _maxRetryWait {
+		delay = _maxRetryWait
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-c.Done():
+	case <-t.C:
+	}
+	msg.Nack()
+}
+
+// deadLetter forwards msg to the dead letter topic dead.
+func (r *Router) deadLetter(c context.Context, dead, topic string, msg Message, cause error) (err error) {
+	if dead == "" || dead == topic {
+		// nowhere to go, only the log keeps it.
+		return
+	}
+	env := DeadLetterEnvelope(topic, msg.ID(), msg.Data(), msg.Attributes(), msg.DeliveryAttempt(), cause)
+	_, err = r.b.Publish(c, dead, env)
+	return
+}
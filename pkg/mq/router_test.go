@@ -0,0 +1,394 @@
+package mq_test
+
+import (
+	"ascale/pkg/mq"
+	"ascale/pkg/mq/memory"
+	netutil "ascale/pkg/net"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type command struct {
+	Name string
+}
+
+func setup(t *testing.T) (*memory.Broker, context.Context) {
+	b := memory.New()
+	c, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(func() {
+		cancel()
+		b.Close()
+	})
+	for _, v := range []string{"topic", "dead"} {
+		assert.NoError(t, b.EnsureTopic(c, v))
+	}
+	return b, c
+}
+
+func newRouter(b mq.Broker, maxAttempts int) *mq.Router {
+	return mq.NewRouter(b, &mq.RouterConfig{
+		DeadLetter:          "dead",
+		MaxDeliveryAttempts: maxAttempts,
+		Backoff: &netutil.BackoffConfig{
+			BaseDelay: 50 * time.Millisecond,
+			MaxDelay:  200 * time.Millisecond,
+			Factor:    2,
+		},
+	})
+}
+
+func run(c context.Context, b mq.Broker, r *mq.Router) {
+	for _, rt := range r.Routes() {
+		b.EnsureSubscription(c, rt.Config)
+		go b.Receive(c, rt.Config, rt.Handler)
+	}
+	time.Sleep(10 * time.Millisecond)
+}
+
+func TestHandle(t *testing.T) {
+	b, c := setup(t)
+	r := newRouter(b, 0)
+
+	got := make(chan *command, 2)
+	attempts := 0
+	mq.Handle(r, &mq.SubscriptionConfig{Topic: "topic"}, func(c context.Context, arg *command) error {
+		attempts++
+		got <- arg
+		if attempts == 1 {
+			return errors.New("try again")
+		}
+		return nil
+	})
+	run(c, b, r)
+
+	_, err := b.Publish(c, "topic", &mq.Envelope{Data: []byte(`{"Name":"do task"}`)})
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		select {
+		case arg := <-got:
+			assert.Equal(t, "do task", arg.Name)
+		case <-c.Done():
+			t.Fatal("message not handled")
+		}
+	}
+}
+
+func TestHandlePoison(t *testing.T) {
+	b, c := setup(t)
+	r := newRouter(b, 0)
+
+	mq.Handle(r, &mq.SubscriptionConfig{Topic: "topic"}, func(c context.Context, arg *command) error {
+		t.Error("poison message handled")
+		return nil
+	})
+	dead := make(chan mq.Message, 1)
+	r.HandleRaw(&mq.SubscriptionConfig{Topic: "dead"}, func(c context.Context, msg mq.Message) error {
+		dead <- msg
+		return nil
+	})
+	run(c, b, r)
+
+	id, err := b.Publish(c, "topic", &mq.Envelope{Data: []byte(`not json`)})
+	assert.NoError(t, err)
+	select {
+	case msg := <-dead:
+		assert.Equal(t, "not json", string(msg.Data()))
+		assert.Equal(t, "topic", msg.Attributes()[mq.AttrSourceTopic])
+		assert.Equal(t, id, msg.Attributes()[mq.AttrSourceID])
+		assert.NotEmpty(t, msg.Attributes()[mq.AttrError])
+	case <-c.Done():
+		t.Fatal("message not dead lettered")
+	}
+}
+
+func TestHandlePanic(t *testing.T) {
+	b, c := setup(t)
+	r := newRouter(b, 0)
+
+	attempts := make(chan int, 2)
+	r.HandleRaw(&mq.SubscriptionConfig{Topic: "topic"}, func(c context.Context, msg mq.Message) error {
+		attempts <- msg.DeliveryAttempt()
+		if msg.DeliveryAttempt() == 1 {
+			panic("boom")
+		}
+		return nil
+	})
+	run(c, b, r)
+
+	_, err := b.Publish(c, "topic", &mq.Envelope{Data: []byte(`{}`)})
+	assert.NoError(t, err)
+	for want := 1; want <= 2; want++ {
+		select {
+		case got := <-attempts:
+			assert.Equal(t, want, got)
+		case <-c.Done():
+			t.Fatal("message not redelivered after panic")
+		}
+	}
+}
+
+func TestHandleBackoff(t *testing.T) {
+	b, c := setup(t)
+	r := newRouter(b, 0)
+
+	at := make(chan time.Time, 3)
+	mq.Handle(r, &mq.SubscriptionConfig{Topic: "topic"}, func(c context.Context, arg *command) error {
+		at <- time.Now()
+		if len(at) < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+	run(c, b, r)
+
+	_, err := b.Publish(c, "topic", &mq.Envelope{Data: []byte(`{}`)})
+	assert.NoError(t, err)
+	var times []time.Time
+	for i := 0; i < 3; i++ {
+		select {
+		case v := <-at:
+			times = append(times, v)
+		case <-c.Done():
+			t.Fatal("message not redelivered")
+		}
+	}
+	assert.True(t, times[1].Sub(times[0]) >= 50*time.Millisecond)
+	assert.True(t, times[2].Sub(times[1]) >= 100*time.Millisecond)
+}
+
+func TestHandleDeadLetter(t *testing.T) {
+	for name, tc := range map[string]struct {
+		maxAttempts int
+		policy      *mq.DeadLetterPolicy
+		err         error
+		attempt     string
+	}{
+		"permanent": {err: mq.Permanent(errors.New("bad request")), attempt: "1"},
+		"exhausted": {maxAttempts: 3, err: errors.New("transient"), attempt: "3"},
+		// the policy of the subscription overrides the router.
+		"policy": {policy: &mq.DeadLetterPolicy{Topic: "dead", MaxDeliveryAttempts: 2}, err: errors.New("transient"), attempt: "2"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			b, c := setup(t)
+			r := newRouter(b, tc.maxAttempts)
+			mq.Handle(r, &mq.SubscriptionConfig{Topic: "topic", DeadLetterPolicy: tc.policy}, func(c context.Context, arg *command) error {
+				return tc.err
+			})
+			dead := make(chan mq.Message, 1)
+			r.HandleRaw(&mq.SubscriptionConfig{Topic: "dead"}, func(c context.Context, msg mq.Message) error {
+				dead <- msg
+				return nil
+			})
+			run(c, b, r)
+
+			_, err := b.Publish(c, "topic", &mq.Envelope{Data: []byte(`{}`)})
+			assert.NoError(t, err)
+			select {
+			case msg := <-dead:
+				assert.Equal(t, tc.err.Error(), msg.Attributes()[mq.AttrError])
+				assert.Equal(t, tc.attempt, msg.Attributes()[mq.AttrAttempt])
+			case <-c.Done():
+				t.Fatal("message not dead lettered")
+			}
+		})
+	}
+}
+
+// plainMessage is a message of a broker which can not delay a nack.
+type plainMessage struct {
+	nacked chan time.Time
+}
+
+func (m *plainMessage) ID() string                    { return "1" }
+func (m *plainMessage) Data() []byte                  { return []byte(`{}`) }
+func (m *plainMessage) Attributes() map[string]string { return nil }
+func (m *plainMessage) PublishTime() time.Time        { return time.Now() }
+func (m *plainMessage) DeliveryAttempt() int          { return 1 }
+func (m *plainMessage) Ack()                          {}
+func (m *plainMessage) Nack()                         { m.nacked <- time.Now() }
+
+func TestHandleRetryPolicy(t *testing.T) {
+	for name, tc := range map[string]struct {
+		policy *mq.RetryPolicy
+		wait   time.Duration
+	}{
+		// the broker delays the redelivery.
+		"policy": {policy: &mq.RetryPolicy{MinimumBackoff: time.Second, MaximumBackoff: time.Minute}},
+		"wait":   {wait: 50 * time.Millisecond},
+	} {
+		t.Run(name, func(t *testing.T) {
+			b, c := setup(t)
+			r := newRouter(b, 0)
+			mq.Handle(r, &mq.SubscriptionConfig{Topic: "topic", RetryPolicy: tc.policy}, func(c context.Context, arg *command) error {
+				return errors.New("transient")
+			})
+			msg := &plainMessage{nacked: make(chan time.Time, 1)}
+			start := time.Now()
+			r.Routes()[0].Handler(c, msg)
+			d := (<-msg.nacked).Sub(start)
+			assert.True(t, d >= tc.wait)
+			assert.True(t, d < tc.wait+40*time.Millisecond, d)
+		})
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	assert.Nil(t, mq.Permanent(nil))
+	err := errors.New("bad")
+	assert.False(t, mq.IsPermanent(err))
+	assert.True(t, mq.IsPermanent(mq.Permanent(err)))
+	assert.True(t, errors.Is(mq.Permanent(err), err))
+}
+
+func TestHandleDedup(t *testing.T) {
+	b, c := setup(t)
+	r := newRouter(b, 0)
+
+	handled := make(chan string, 3)
+	dedup := mq.Dedup(&mq.DedupConfig{Store: memory.NewDedupStore(), TTL: time.Minute})
+	r.HandleRaw(&mq.SubscriptionConfig{Topic: "topic"}, func(c context.Context, msg mq.Message) error {
+		handled <- string(msg.Data())
+		return nil
+	}, dedup)
+	run(c, b, r)
+
+	for _, v := range []string{"a", "b", "a"} {
+		env := &mq.Envelope{Data: []byte(v), Attributes: map[string]string{mq.AttrIdempotencyKey: v}}
+		_, err := b.Publish(c, "topic", env)
+		assert.NoError(t, err)
+	}
+	for _, want := range []string{"a", "b"} {
+		select {
+		case got := <-handled:
+			assert.Equal(t, want, got)
+		case <-c.Done():
+			t.Fatal("message not handled")
+		}
+	}
+	select {
+	case got := <-handled:
+		t.Fatalf("duplicate %s handled", got)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestDedupInFlight(t *testing.T) {
+	c := context.Background()
+	cfg := &mq.SubscriptionConfig{Topic: "topic"}
+	started, release := make(chan struct{}), make(chan error)
+	var handled int
+	h := mq.Dedup(&mq.DedupConfig{Store: memory.NewDedupStore()})(cfg, func(c context.Context, msg mq.Message) error {
+		handled++
+		started <- struct{}{}
+		return <-release
+	})
+
+	// a duplicate delivered while the first is handled is redelivered.
+	msg := &plainMessage{}
+	done := make(chan error)
+	go func() { done <- h(c, msg) }()
+	<-started
+	assert.Equal(t, mq.ErrInFlight, h(c, msg))
+
+	// a failed message is handled again, a processed one is skipped.
+	release <- errors.New("transient")
+	assert.Error(t, <-done)
+	go func() { done <- h(c, msg) }()
+	<-started
+	release <- nil
+	assert.NoError(t, <-done)
+	assert.NoError(t, h(c, msg))
+	assert.Equal(t, 2, handled)
+}
+
+func TestHandleInFlight(t *testing.T) {
+	b, c := setup(t)
+	r := newRouter(b, 1)
+
+	// duplicates in flight are redelivered as the same attempt, they are
+	// not dead lettered at the attempt cap.
+	attempts := make(chan int, 3)
+	calls := 0
+	r.HandleRaw(&mq.SubscriptionConfig{Topic: "topic"}, func(c context.Context, msg mq.Message) error {
+		attempts <- msg.DeliveryAttempt()
+		if calls++; calls < 3 {
+			return mq.ErrInFlight
+		}
+		return nil
+	})
+	run(c, b, r)
+
+	_, err := b.Publish(c, "topic", &mq.Envelope{Data: []byte("a")})
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		select {
+		case got := <-attempts:
+			assert.Equal(t, 1, got)
+		case <-c.Done():
+			t.Fatal("message not redelivered")
+		}
+	}
+}
+
+func TestHandleOrdered(t *testing.T) {
+	b, c := setup(t)
+	r := newRouter(b, 0)
+
+	var (
+		mu      sync.Mutex
+		got     = make(map[string][]string)
+		running = make(map[string]bool)
+		overlap bool
+	)
+	done := make(chan struct{}, 6)
+	r.HandleRaw(&mq.SubscriptionConfig{Topic: "topic", MaxOutstandingMessages: 4, Ordered: true}, func(c context.Context, msg mq.Message) error {
+		key := mq.OrderingKey(msg)
+		mu.Lock()
+		if running[key] {
+			t.Errorf("key %s handled concurrently", key)
+		}
+		running[key] = true
+		overlap = overlap || len(running) > 1
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		delete(running, key)
+		got[key] = append(got[key], string(msg.Data()))
+		mu.Unlock()
+		done <- struct{}{}
+		return nil
+	})
+	run(c, b, r)
+
+	for i := 1; i <= 3; i++ {
+		for _, key := range []string{"a", "b"} {
+			env := &mq.Envelope{
+				Data:       []byte(fmt.Sprintf("%s%d", key, i)),
+				Attributes: map[string]string{mq.AttrOrderingKey: key},
+			}
+			_, err := b.Publish(c, "topic", env)
+			assert.NoError(t, err)
+		}
+	}
+	for i := 0; i < 6; i++ {
+		select {
+		case <-done:
+		case <-c.Done():
+			t.Fatal("messages not handled")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"a1", "a2", "a3"}, got["a"])
+	assert.Equal(t, []string{"b1", "b2", "b3"}, got["b"])
+	assert.True(t, overlap, "keys not handled in parallel")
+}
@@ -0,0 +1,187 @@
+package mq
+
+import (
+	"ascale/pkg/log"
+	netutil "ascale/pkg/net"
+	"ascale/pkg/stat/prom"
+	"ascale/pkg/xtime"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// States of a supervised subscription.
+const (
+	// StateStarting ensures the topic and the subscription.
+	StateStarting = "starting"
+	// StateRunning receives messages.
+	StateRunning = "running"
+	// StateBackoff waits to restart after a failure.
+	StateBackoff = "backoff"
+	// StateStopped stopped receiving, its context is done.
+	StateStopped = "stopped"
+)
+
+// errReceiveReturned is the failure of a Receive which returned nil while
+// its context is not done.
+var errReceiveReturned = errors.New("mq: receive returned")
+
+// SupervisorConfig supervisor config, zero values use the defaults.
+type SupervisorConfig struct {
+	// Backoff between restarts, default netutil.DefaultBackoffConfig.
+	Backoff *netutil.BackoffConfig
+	// Stable is how long a subscription receives before its failures are
+	// forgotten and the backoff starts over, default 1m.
+	Stable xtime.Duration
+	// MaxFailures is how many failures in a row a subscription is healthy
+	// with, default 3.
+	MaxFailures int
+}
+
+func (c *SupervisorConfig) fix() *SupervisorConfig {
+	cc := SupervisorConfig{}
+	if c != nil {
+		cc = *c
+	}
+	if cc.Backoff == nil {
+		bc := netutil.DefaultBackoffConfig
+		cc.Backoff = &bc
+	}
+	if cc.Stable <= 0 {
+		cc.Stable = xtime.Duration(time.Minute)
+	}
+	if cc.MaxFailures <= 0 {
+		cc.MaxFailures = 3
+	}
+	return &cc
+}
+
+// SubscriptionHealth is the health of a supervised subscription.
+type SubscriptionHealth struct {
+	Topic   string `json:"topic"`
+	State   string `json:"state"`
+	Healthy bool   `json:"healthy"`
+	// Failures in a row, Restarts since started.
+	Failures  int    `json:"failures"`
+	Restarts  int    `json:"restarts"`
+	LastError string `json:"last_error,omitempty"`
+	// Since is when the subscription entered State.
+	Since time.Time `json:"since"`
+}
+
+// Supervisor runs subscriptions and restarts them with backoff when they
+// fail instead of giving up, a failing subscription is reported unhealthy
+// while the others keep receiving.
+type Supervisor struct {
+	b Broker
+	c *SupervisorConfig
+
+	mu   sync.Mutex
+	subs []*SubscriptionHealth
+	wg   sync.WaitGroup
+}
+
+// NewSupervisor creates a supervisor.
+func NewSupervisor(b Broker, c *SupervisorConfig) *Supervisor {
+	return &Supervisor{b: b, c: c.fix()}
+}
+
+// Go runs the subscription in the background until c is done. Its topic,
+// the dead letter topic and the subscription are ensured, then its messages
+// are received, any failure restarts it after a backoff.
+func (s *Supervisor) Go(c context.Context, cfg *SubscriptionConfig, h Handler) {
+	sh := &SubscriptionHealth{Topic: cfg.Topic, State: StateStarting, Healthy: true, Since: time.Now()}
+	s.mu.Lock()
+	s.subs = append(s.subs, sh)
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.run(c, sh, cfg, h)
+	}()
+}
+
+func (s *Supervisor) run(c context.Context, sh *SubscriptionHealth, cfg *SubscriptionConfig, h Handler) {
+	name := fmt.Sprintf("consumer:%s", cfg.Topic)
+	for retries := 0; ; retries++ {
+		var started time.Time
+		err := s.ensure(c, cfg)
+		if err == nil {
+			s.set(sh, StateRunning, nil)
+			started = time.Now()
+			if err = s.b.Receive(c, cfg, h); err == nil {
+				err = errReceiveReturned
+			}
+		}
+		if c.Err() != nil {
+			s.set(sh, StateStopped, nil)
+			return
+		}
+		if !started.IsZero() && time.Since(started) >= time.Duration(s.c.Stable) {
+			s.mu.Lock()
+			sh.Failures = 0
+			s.mu.Unlock()
+			retries = 0
+		}
+
+		d := s.c.Backoff.Backoff(retries)
+		s.set(sh, StateBackoff, err)
+		prom.ConsumerRestart.Incr(name)
+		log.For(c).Errorf("subscription topic(%s) restart in %s error(%+v)", cfg.Topic, d, err)
+		select {
+		case <-c.Done():
+			s.set(sh, StateStopped, nil)
+			return
+		case <-time.After(d):
+		}
+		s.set(sh, StateStarting, nil)
+	}
+}
+
+func (s *Supervisor) ensure(c context.Context, cfg *SubscriptionConfig) (err error) {
+	if err = s.b.EnsureTopic(c, cfg.Topic); err != nil {
+		return
+	}
+	if dp := cfg.DeadLetterPolicy; dp != nil && dp.Topic != "" {
+		if err = s.b.EnsureTopic(c, dp.Topic); err != nil {
+			return
+		}
+	}
+	return s.b.EnsureSubscription(c, cfg)
+}
+
+// set moves sh to state, a non nil err is a failure.
+func (s *Supervisor) set(sh *SubscriptionHealth, state string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		sh.Failures++
+		sh.Restarts++
+		sh.LastError = err.Error()
+	}
+	sh.Healthy = sh.Failures <= s.c.MaxFailures
+	if sh.State != state {
+		sh.State = state
+		sh.Since = time.Now()
+	}
+}
+
+// Health returns a copy of the health of the subscriptions in start order.
+func (s *Supervisor) Health() []*SubscriptionHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hs := make([]*SubscriptionHealth, len(s.subs))
+	for i, sh := range s.subs {
+		h := *sh
+		hs[i] = &h
+	}
+	return hs
+}
+
+// Wait waits for the subscriptions to stop once their contexts are done.
+func (s *Supervisor) Wait() {
+	s.wg.Wait()
+}
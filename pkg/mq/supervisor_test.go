@@ -0,0 +1,99 @@
+package mq_test
+
+import (
+	"ascale/pkg/mq"
+	netutil "ascale/pkg/net"
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyBroker fails EnsureTopic and Receive as many times as set.
+type flakyBroker struct {
+	mq.Broker
+	ensureFails  int32
+	receiveFails int32
+}
+
+func (b *flakyBroker) EnsureTopic(c context.Context, topic string) error {
+	if atomic.AddInt32(&b.ensureFails, -1) >= 0 {
+		return errors.New("ensure failed")
+	}
+	return b.Broker.EnsureTopic(c, topic)
+}
+
+func (b *flakyBroker) Receive(c context.Context, cfg *mq.SubscriptionConfig, h mq.Handler) error {
+	if atomic.AddInt32(&b.receiveFails, -1) >= 0 {
+		return errors.New("receive failed")
+	}
+	return b.Broker.Receive(c, cfg, h)
+}
+
+func newSupervisor(b mq.Broker) *mq.Supervisor {
+	return mq.NewSupervisor(b, &mq.SupervisorConfig{
+		Backoff: &netutil.BackoffConfig{
+			BaseDelay: 10 * time.Millisecond,
+			MaxDelay:  50 * time.Millisecond,
+			Factor:    2,
+		},
+		MaxFailures: 2,
+	})
+}
+
+func TestSupervisorRestarts(t *testing.T) {
+	b, c := setup(t)
+	fb := &flakyBroker{Broker: b, ensureFails: 1, receiveFails: 1}
+	s := newSupervisor(fb)
+
+	rc, cancel := context.WithCancel(c)
+	received := make(chan struct{}, 1)
+	s.Go(rc, &mq.SubscriptionConfig{Topic: "topic"}, func(c context.Context, msg mq.Message) {
+		msg.Ack()
+		received <- struct{}{}
+	})
+
+	assert.Eventually(t, func() bool {
+		h := s.Health()[0]
+		return h.State == mq.StateRunning && h.Restarts == 2
+	}, time.Second, 5*time.Millisecond)
+	_, err := b.Publish(c, "topic", &mq.Envelope{Data: []byte("a")})
+	assert.NoError(t, err)
+	select {
+	case <-received:
+	case <-c.Done():
+		t.Fatal("message not received")
+	}
+
+	h := s.Health()[0]
+	assert.Equal(t, "topic", h.Topic)
+	assert.True(t, h.Healthy)
+	assert.Equal(t, 2, h.Restarts)
+	assert.Equal(t, "receive failed", h.LastError)
+
+	cancel()
+	s.Wait()
+	assert.Equal(t, mq.StateStopped, s.Health()[0].State)
+}
+
+func TestSupervisorUnhealthy(t *testing.T) {
+	b, c := setup(t)
+	fb := &flakyBroker{Broker: b, receiveFails: 3}
+	s := newSupervisor(fb)
+
+	rc, cancel := context.WithCancel(c)
+	defer cancel()
+	s.Go(rc, &mq.SubscriptionConfig{Topic: "topic"}, func(c context.Context, msg mq.Message) {})
+
+	// failures are forgotten only once it received for a while.
+	assert.Eventually(t, func() bool {
+		h := s.Health()[0]
+		return h.State == mq.StateRunning && h.Restarts == 3
+	}, time.Second, 5*time.Millisecond)
+	h := s.Health()[0]
+	assert.Equal(t, 3, h.Failures)
+	assert.False(t, h.Healthy)
+}
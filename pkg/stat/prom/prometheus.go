@@ -36,6 +36,16 @@ var (
 
 	Consumer = New().WithTimer("go_consumer", []string{"name"}).
 			WithCounter("go_consumer_total", []string{"name"})
+	// ConsumerResult for consumer outcome count, result is ack, nack, retry, inflight or dead.
+	ConsumerResult = New().WithCounter("go_consumer_result", []string{"name", "result"})
+	// ConsumerDrain for messages on shutdown, result is drained, abandoned or rejected.
+	ConsumerDrain = New().WithCounter("go_consumer_drain", []string{"name", "result"})
+	// ConsumerConcurrency for the adaptive concurrency limit of consumers.
+	ConsumerConcurrency = New().WithState("go_consumer_concurrency", []string{"name"})
+	// ConsumerDedup for deduplicated messages, result is hit, miss or inflight.
+	ConsumerDedup = New().WithCounter("go_consumer_dedup", []string{"name", "result"})
+	// ConsumerRestart for restarts of failed subscriptions.
+	ConsumerRestart = New().WithCounter("go_consumer_restart", []string{"name"})
 	// CacheHit for cache hit
 	CacheHit = New().WithCounter("go_cache_hit", []string{"name"})
 	// CacheMiss for cache miss
@@ -2,6 +2,7 @@ package cpu
 
 import (
 	"fmt"
+	"runtime"
 	"sync/atomic"
 	"time"
 
@@ -18,16 +19,40 @@ var (
 	preTotal  uint64
 )
 
+// refresh returns the cpu usage since its last call.
+var refresh = refreshCPU
+
 func init() {
+	if err := initCgroup(); err != nil {
+		// e.g. cgroup v2, fall back to the cpu time of the process.
+		if err = initProcess(); err != nil {
+			panic(err)
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Millisecond * 250)
+		defer ticker.Stop()
+		for {
+			<-ticker.C
+			cpu := refresh()
+			if cpu != 0 {
+				atomic.StoreUint64(&usage, cpu)
+			}
+		}
+	}()
+}
+
+func initCgroup() (err error) {
 	cpus, err := perCPUUsage()
 	if err != nil {
-		panic(fmt.Errorf("stat/sys/cpu: perCPUUsage() failed!err:=%v", err))
+		return fmt.Errorf("stat/sys/cpu: perCPUUsage() failed!err:=%v", err)
 	}
 	cores = uint64(len(cpus))
 
 	sets, err := cpuSets()
 	if err != nil {
-		panic(fmt.Errorf("stat/sys/cpu: cpuSets() failed!err:=%v", err))
+		return fmt.Errorf("stat/sys/cpu: cpuSets() failed!err:=%v", err)
 	}
 	quota = float64(len(sets))
 	cq, err := cpuQuota()
@@ -35,7 +60,7 @@ func init() {
 		if cq != -1 {
 			var period uint64
 			if period, err = cpuPeriod(); err != nil {
-				panic(fmt.Errorf("stat/sys/cpu: cpuPeriod() failed!err:=%v", err))
+				return fmt.Errorf("stat/sys/cpu: cpuPeriod() failed!err:=%v", err)
 			}
 			limit := float64(cq) / float64(period)
 			if limit < quota {
@@ -47,24 +72,45 @@ func init() {
 
 	preSystem, err = systemCPUUsage()
 	if err != nil {
-		panic(fmt.Errorf("sys/cpu: systemCPUUsage() failed!err:=%v", err))
+		return fmt.Errorf("sys/cpu: systemCPUUsage() failed!err:=%v", err)
 	}
 	preTotal, err = totalCPUUsage()
 	if err != nil {
-		panic(fmt.Errorf("sys/cpu: totalCPUUsage() failed!err:=%v", err))
+		return fmt.Errorf("sys/cpu: totalCPUUsage() failed!err:=%v", err)
 	}
+	return nil
+}
 
-	go func() {
-		ticker := time.NewTicker(time.Millisecond * 250)
-		defer ticker.Stop()
-		for {
-			<-ticker.C
-			cpu := refreshCPU()
-			if cpu != 0 {
-				atomic.StoreUint64(&usage, cpu)
-			}
-		}
-	}()
+// initProcess measures the cpu time of the process over the cpu quota.
+func initProcess() (err error) {
+	cores = uint64(runtime.NumCPU())
+	quota = float64(cores)
+	if limit, err := cpuMax(); err == nil && limit > 0 && limit < quota {
+		quota = limit
+	}
+	maxFreq = cpuMaxFreq()
+
+	if preTotal, err = processCPUUsage(); err != nil {
+		return fmt.Errorf("sys/cpu: processCPUUsage() failed!err:=%v", err)
+	}
+	preSystem = uint64(time.Now().UnixNano())
+	refresh = refreshProcess
+	return nil
+}
+
+func refreshProcess() (u uint64) {
+	total, err := processCPUUsage()
+	if err != nil {
+		log.Warn(fmt.Sprintf("os/stat: get processCPUUsage failed,error(%v)", err))
+		return
+	}
+	now := uint64(time.Now().UnixNano())
+	if now != preSystem {
+		u = uint64(float64((total-preTotal)*1e3) / (float64(now-preSystem) * quota))
+	}
+	preSystem = now
+	preTotal = total
+	return u
 }
 
 func refreshCPU() (u uint64) {
@@ -18,3 +18,11 @@ func cpuSets() (sets []uint64, err error)      { return []uint64{0, 1, 2, 3}, ni
 func cpuQuota() (quota int64, err error)       { return 100, nil }
 func cpuPeriod() (peroid uint64, err error)    { return 10, nil }
 func cpuMaxFreq() (feq uint64)                 { return 10 }
+
+var pu uint64 = 10
+
+func processCPUUsage() (usage uint64, err error) {
+	pu += 500
+	return pu, nil
+}
+func cpuMax() (limit float64, err error) { return 0, nil }
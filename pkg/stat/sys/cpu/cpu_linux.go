@@ -8,6 +8,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/pkg/errors"
 )
@@ -145,3 +146,40 @@ func cpuMaxFreq() uint64 {
 	}
 	return feq
 }
+
+// processCPUUsage returns the user and system cpu time of the process in
+// nanoseconds.
+func processCPUUsage() (usage uint64, err error) {
+	var ru syscall.Rusage
+	if err = syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return
+	}
+	return uint64(ru.Utime.Nano() + ru.Stime.Nano()), nil
+}
+
+// cpuMax returns the cpu limit of the cgroup v2 of the process, in cpus.
+// /sys/fs/cgroup/cpu.max holds "$MAX $PERIOD", $MAX is "max" when unlimited.
+func cpuMax() (limit float64, err error) {
+	var data string
+	if data, err = readFile("/sys/fs/cgroup/cpu.max"); err != nil {
+		return
+	}
+	fields := strings.Fields(data)
+	if len(fields) != 2 {
+		return 0, errors.Errorf("bad format of cpu.max: %q", data)
+	}
+	if fields[0] == "max" {
+		return 0, ErrNoCFSLimit
+	}
+	var max, period uint64
+	if max, err = parseUint(fields[0]); err != nil {
+		return
+	}
+	if period, err = parseUint(fields[1]); err != nil {
+		return
+	}
+	if period == 0 {
+		return 0, errors.Errorf("bad format of cpu.max: %q", data)
+	}
+	return float64(max) / float64(period), nil
+}
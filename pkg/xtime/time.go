@@ -144,6 +144,11 @@ func (d *Duration) UnmarshalText(text []byte) error {
 	return err
 }
 
+// MarshalText marshal duration to text, like 1s, 500ms.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
 // Shrink will decrease the duration by comparing with context's timeout duration
 // and return new timeout\context\CancelFunc.
 func (d Duration) Shrink(c context.Context) (Duration, context.Context, context.CancelFunc) {